@@ -17,8 +17,20 @@ package drivers
 // VolumeDriver interface used by the refcountedVolume module to handle
 // recovery mounts/unmounts.
 type VolumeDriver interface {
-	MountVolume(string, string, string, bool, bool) (string, error)
+	MountVolume(string, string, string, bool, bool, map[string]interface{}) (string, error)
 	UnmountVolume(string) error
 	GetVolume(string) (map[string]interface{}, error)
 	DetachVolume(string) error
 }
+
+// AttachedLister is implemented by drivers which can tell the volumes attached
+// to the VM, so recovery can detach those attached but not mounted.
+type AttachedLister interface {
+	ListAttached() ([]string, error)
+}
+
+// InProgressLister is implemented by drivers which attach volumes outside of mounts,
+// e.g. while creating them, so recovery doesn't take those for orphan attachments.
+type InProgressLister interface {
+	ListInProgress() []string
+}
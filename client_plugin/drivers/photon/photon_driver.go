@@ -118,7 +118,6 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	d.MountRoot = mountDir
 	d.RefCounts = refcount.NewRefCountsMap()
 	d.RefCounts.Init(d, mountDir, cfg.Driver)
-	d.MountIDtoName = make(map[string]string)
 
 	log.WithFields(log.Fields{
 		"version": version,
@@ -329,7 +328,7 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 
 // MountVolume - Request attach and them mounts the volume.
 // Returns mount point and  error (or nil)
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, volumeMeta map[string]interface{}) (string, error) {
 	mountpoint := d.GetMountPoint(name)
 
 	// First, make sure  that mountpoint exists.
@@ -356,7 +355,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		return volume.Response{Err: err.Error()}
 	}
 	r.Name = volumeInfo.VolumeName
-	d.MountIDtoName[r.ID] = r.Name
+	d.RefCounts.AddMountID(r.ID, r.Name)
 
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
@@ -400,7 +399,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	}
 
 	// Mount the volume and for now its always read-write.
-	mountpoint, err := d.MountVolume(r.Name, fstype.(string), volumeMeta["ID"].(string), false, skipAttach)
+	mountpoint, err := d.MountVolume(r.Name, fstype.(string), volumeMeta["ID"].(string), false, skipAttach, nil)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
@@ -508,7 +507,7 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errGetDevicePath.Error()}
 	}
 
-	errMkfs := fs.MkfsByDevicePath(r.Options[fsTypeTag], r.Name, device)
+	errMkfs := fs.MkfsByDevicePath(r.Options[fsTypeTag], r.Name, device, "")
 	if errMkfs != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errMkfs}).Error("Create filesystem failed, removing the volume ")
 		err = d.detachVolume(r.Name, createTask.Entity.ID)
@@ -625,9 +624,8 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 		return volume.Response{Err: ""}
 	}
 
-	if fullVolName, exist := d.MountIDtoName[r.ID]; exist {
+	if fullVolName, exist := d.RefCounts.RemoveMountID(r.ID); exist {
 		r.Name = fullVolName
-		delete(d.MountIDtoName, r.ID) //cleanup the map
 	} else {
 		volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
 		if err != nil {
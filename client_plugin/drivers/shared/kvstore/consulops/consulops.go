@@ -0,0 +1,566 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Consul implementation for KV Store interface
+//
+// Talks to an existing Consul cluster over its HTTP API. Compare-and-put uses
+// the modify index of keys, metadata of a volume is written and deleted in a
+// transaction, and swarm managers watch global refcounts with blocking queries.
+
+package consulops
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/dockerops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore"
+)
+
+/*
+   requestTimeout:       After how long should a consul request timeout
+   checkSleepDuration:   How long to wait in any busy waiting situation
+                         before checking again
+   watchWait:            How long a blocking query on global refcounts waits for changes
+   kvPath:               Path of the KV API
+   txnPath:              Path of the transaction API
+   leaderPath:           Path of the API returning the cluster leader
+*/
+const (
+	requestTimeout     = 5 * time.Second
+	checkSleepDuration = time.Second
+	watchWait          = 5 * time.Minute
+	kvPath             = "/v1/kv/"
+	txnPath            = "/v1/txn"
+	leaderPath         = "/v1/status/leader"
+)
+
+// ConsulKVS - KV store in a Consul cluster
+type ConsulKVS struct {
+	dockerOps   *dockerops.DockerOps
+	endpoints   []string     // base URLs of consul agents, tried in order
+	client      *http.Client // for requests
+	watchClient *http.Client // for blocking queries
+}
+
+// consulPair is a key as returned by the KV API
+type consulPair struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// consulTxnOp is an operation of a transaction
+type consulTxnOp struct {
+	KV consulTxnKV
+}
+
+// consulTxnKV is a KV operation of a transaction
+type consulTxnKV struct {
+	Verb  string
+	Key   string
+	Value []byte `json:",omitempty"`
+}
+
+// grefChange is a change of a global refcount seen by the watcher
+type grefChange struct {
+	key     string
+	prevVal string
+	newVal  string
+}
+
+// NewKvStore function: use the Consul cluster at endpoints.
+// Swarm managers watch global refcounts to run the file services of volumes.
+func NewKvStore(dockerOps *dockerops.DockerOps, endpoints []string, tlsConfig *tls.Config) *ConsulKVS {
+	if len(endpoints) == 0 {
+		log.Error("No endpoints given for Consul cluster ")
+		return nil
+	}
+
+	c := &ConsulKVS{
+		dockerOps:   dockerOps,
+		client:      &http.Client{Timeout: requestTimeout},
+		watchClient: &http.Client{Timeout: watchWait + requestTimeout},
+	}
+	if tlsConfig != nil {
+		c.client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+		c.watchClient.Transport = c.client.Transport
+	}
+	for _, endpoint := range endpoints {
+		c.endpoints = append(c.endpoints, consulURL(endpoint, tlsConfig != nil))
+	}
+
+	// check the cluster is reachable and has a leader
+	status, _, _, err := c.request(c.client, "GET", leaderPath, nil, nil)
+	if err != nil || status != http.StatusOK {
+		log.WithFields(
+			log.Fields{"endpoints": c.endpoints,
+				"status": status,
+				"error":  err},
+		).Error("Failed to reach Consul cluster ")
+		return nil
+	}
+
+	// get swarm info from docker client
+	nodeID, _, isManager, err := dockerOps.GetSwarmInfo()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"error": err},
+		).Error("Failed to get swarm Info from docker client ")
+		return nil
+	}
+	if !isManager {
+		log.WithFields(
+			log.Fields{"nodeID": nodeID},
+		).Info("Swarm node role: worker. Return from NewKvStore ")
+		return c
+	}
+
+	log.WithFields(
+		log.Fields{"nodeID": nodeID, "endpoints": c.endpoints},
+	).Info("Swarm node role: manager, watching Consul cluster ")
+	go c.consulWatcher()
+	go kvstore.ServiceAndVolumeGC(dockerOps, c.volStates)
+	return c
+}
+
+// consulURL returns the base URL of a consul agent given as host:port or URL
+func consulURL(endpoint string, secure bool) string {
+	if strings.Contains(endpoint, "://") {
+		return strings.TrimSuffix(endpoint, "/")
+	}
+	if secure {
+		return "https://" + endpoint
+	}
+	return "http://" + endpoint
+}
+
+// request sends a request to the first reachable endpoint, and returns the status,
+// body and consul index of the response
+func (c *ConsulKVS) request(client *http.Client, method string, path string,
+	query url.Values, body []byte) (int, []byte, uint64, error) {
+	var err error
+	for _, endpoint := range c.endpoints {
+		u := endpoint + path
+		if len(query) > 0 {
+			u += "?" + query.Encode()
+		}
+		req, reqErr := http.NewRequest(method, u, bytes.NewReader(body))
+		if reqErr != nil {
+			return 0, nil, 0, reqErr
+		}
+		resp, respErr := client.Do(req)
+		if respErr != nil {
+			// try the next agent
+			err = respErr
+			continue
+		}
+		data, readErr := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if readErr != nil {
+			return 0, nil, 0, readErr
+		}
+		index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		return resp.StatusCode, data, index, nil
+	}
+	return 0, nil, 0, err
+}
+
+// keyPath returns the path of key in the KV API
+func keyPath(key string) string {
+	return kvPath + (&url.URL{Path: key}).EscapedPath()
+}
+
+// get reads key, nil if it does not exist
+func (c *ConsulKVS) get(key string) (*consulPair, error) {
+	pairs, _, err := c.getPairs(c.client, key, nil)
+	if err != nil || len(pairs) == 0 {
+		return nil, err
+	}
+	return &pairs[0], nil
+}
+
+// getPairs reads key, or all keys with prefix key with query recurse, and returns
+// them with the consul index
+func (c *ConsulKVS) getPairs(client *http.Client, key string, query url.Values) ([]consulPair, uint64, error) {
+	status, data, index, err := c.request(client, "GET", keyPath(key), query, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == http.StatusNotFound {
+		return nil, index, nil
+	}
+	if status != http.StatusOK {
+		return nil, 0, fmt.Errorf("Consul returned %d for %s: %s", status, key, data)
+	}
+	var pairs []consulPair
+	if err := json.Unmarshal(data, &pairs); err != nil {
+		return nil, 0, err
+	}
+	return pairs, index, nil
+}
+
+// cas puts val in key if it was not modified since index, or does not exist if index is 0
+func (c *ConsulKVS) cas(key string, val string, index uint64) (bool, error) {
+	query := url.Values{"cas": []string{strconv.FormatUint(index, 10)}}
+	status, data, _, err := c.request(c.client, "PUT", keyPath(key), query, []byte(val))
+	if err != nil {
+		return false, err
+	}
+	if status != http.StatusOK {
+		return false, fmt.Errorf("Consul returned %d for %s: %s", status, key, data)
+	}
+	return strings.TrimSpace(string(data)) == "true", nil
+}
+
+// txn runs ops in a single transaction
+func (c *ConsulKVS) txn(ops []consulTxnOp) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	status, data, _, err := c.request(c.client, "PUT", txnPath, nil, body)
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("Consul transaction failed with %d: %s", status, data)
+	}
+	return nil
+}
+
+// consulWatcher function watches all the changes to global refcounts in the KV store
+func (c *ConsulKVS) consulWatcher() {
+	// TODO: when the manager is demoted to worker, the watcher should be cancelled
+	var index uint64
+	var prev map[string]string
+	for {
+		query := url.Values{"recurse": []string{""}}
+		if index > 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", fmt.Sprintf("%ds", int(watchWait.Seconds())))
+		}
+		pairs, newIndex, err := c.getPairs(c.watchClient, kvstore.VolPrefixGRef, query)
+		if err != nil {
+			log.WithFields(
+				log.Fields{"error": err},
+			).Warning("Watcher on global refcount failed, retrying ")
+			time.Sleep(checkSleepDuration)
+			continue
+		}
+		if newIndex < index {
+			// index went backwards, e.g. on cluster restore, start over
+			newIndex = 0
+		}
+		index = newIndex
+
+		cur := make(map[string]string)
+		for _, pair := range pairs {
+			cur[pair.Key] = string(pair.Value)
+		}
+		if prev != nil {
+			for _, change := range grefChanges(prev, cur) {
+				log.WithFields(
+					log.Fields{"key": change.key},
+				).Infof("Watcher on global refcount returns event ")
+				kvstore.HandleGRefChange(c, c.dockerOps, change.key, change.prevVal, change.newVal)
+			}
+		}
+		prev = cur
+	}
+}
+
+// grefChanges returns the keys of cur which changed from prev, ordered by key.
+// New keys are not changes, as they are only created with the volume.
+func grefChanges(prev map[string]string, cur map[string]string) []grefChange {
+	var changes []grefChange
+	for key, val := range cur {
+		if prevVal, existed := prev[key]; existed && prevVal != val {
+			changes = append(changes, grefChange{key: key, prevVal: prevVal, newVal: val})
+		}
+	}
+	sort.Sort(grefChangesByKey(changes))
+	return changes
+}
+
+// grefChangesByKey sorts changes of global refcounts by key
+type grefChangesByKey []grefChange
+
+func (g grefChangesByKey) Len() int           { return len(g) }
+func (g grefChangesByKey) Swap(i, j int)      { g[i], g[j] = g[j], g[i] }
+func (g grefChangesByKey) Less(i, j int) bool { return g[i].key < g[j].key }
+
+// volStates returns the state keys of all volumes with their values, nil on error
+func (c *ConsulKVS) volStates() map[string]string {
+	pairs, _, err := c.getPairs(c.client, kvstore.VolPrefixState, url.Values{"recurse": []string{""}})
+	if err != nil {
+		log.WithFields(
+			log.Fields{"error": err},
+		).Warning("Failed to read volume states from Consul ")
+		return nil
+	}
+	states := make(map[string]string)
+	for _, pair := range pairs {
+		states[pair.Key] = string(pair.Value)
+	}
+	return states
+}
+
+// WriteMetaData - Update or Create metadata in KV store
+func (c *ConsulKVS) WriteMetaData(entries []kvstore.KvPair) error {
+	var ops []consulTxnOp
+	for _, elem := range entries {
+		ops = append(ops, consulTxnOp{KV: consulTxnKV{Verb: "set", Key: elem.Key, Value: []byte(elem.Value)}})
+	}
+	if err := c.txn(ops); err != nil {
+		msg := fmt.Sprintf("Failed to write metadata. Reason: %v", err)
+		log.Warning(msg)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// ReadMetaData - Read metadata in KV store
+func (c *ConsulKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
+	var entries []kvstore.KvPair
+	for _, key := range keys {
+		pair, err := c.get(key)
+		if err != nil {
+			log.Warningf("Metadata read failed: %v", err)
+			return nil, err
+		}
+		if pair != nil {
+			entries = append(entries, kvstore.KvPair{Key: key, Value: string(pair.Value)})
+		}
+	}
+
+	if len(entries) == 0 {
+		// Volume does not exist
+		return nil, kvstore.ErrVolumeDoesNotExist
+	} else if len(entries) < len(keys) {
+		// The volume is being created or deleted meanwhile
+		return nil, fmt.Errorf("Failed to get volume. Couldn't find all keys!")
+	}
+	return entries, nil
+}
+
+// DeleteMetaData - Delete volume metadata in KV store
+func (c *ConsulKVS) DeleteMetaData(name string) error {
+	var ops []consulTxnOp
+	for _, prefix := range []string{kvstore.VolPrefixState, kvstore.VolPrefixGRef, kvstore.VolPrefixInfo} {
+		ops = append(ops, consulTxnOp{KV: consulTxnKV{Verb: "delete", Key: prefix + name}})
+	}
+	if err := c.txn(ops); err != nil {
+		msg := fmt.Sprintf("Failed to delete metadata for volume %s. Reason: %v", name, err)
+		log.Warning(msg)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// CompareAndPut function: compare the value of the key with oldVal
+// if equal, replace with newVal and return true; or else, return false.
+func (c *ConsulKVS) CompareAndPut(key string, oldVal string, newVal string) bool {
+	succeeded, _, err := c.compareAndPutOrFetch(key, oldVal, newVal)
+	if err != nil {
+		log.WithFields(
+			log.Fields{"Key": key,
+				"Value to compare": oldVal,
+				"Value to replace": newVal,
+				"Error":            err},
+		).Errorf("Failed to compare and put ")
+		return false
+	}
+	return succeeded
+}
+
+// compareAndPutOrFetch - Compare and put, or get the current value of the key
+func (c *ConsulKVS) compareAndPutOrFetch(key string, oldVal string, newVal string) (bool, string, error) {
+	pair, err := c.get(key)
+	if err != nil {
+		return false, "", err
+	}
+	if pair == nil {
+		return false, "", fmt.Errorf("no key found for %s", key)
+	}
+	if string(pair.Value) != oldVal {
+		return false, string(pair.Value), nil
+	}
+	succeeded, err := c.cas(key, newVal, pair.ModifyIndex)
+	return succeeded, string(pair.Value), err
+}
+
+// CompareAndPutStateOrBusywait function: compare the volume state with oldVal
+// if equal, replace with newVal and return true; or else, return false;
+// waits if volume is in a state from where it can reach the ready state
+func (c *ConsulKVS) CompareAndPutStateOrBusywait(key string, oldVal string, newVal string) bool {
+	ticker := time.NewTicker(checkSleepDuration)
+	defer ticker.Stop()
+	timer := time.NewTimer(2 * requestTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Retry
+			log.Infof("Attempting to change volume state to %s", newVal)
+			succeeded, curVal, err := c.compareAndPutOrFetch(key, oldVal, newVal)
+			if err != nil {
+				return false
+			}
+			if succeeded {
+				return true
+			}
+			// Did we encounter states other than Unmounting or Creating?
+			if curVal != string(kvstore.VolStateUnmounting) &&
+				curVal != string(kvstore.VolStateCreating) {
+				log.Infof("Volume not in proper state for the operation: %s", curVal)
+				return false
+			}
+		case <-timer.C:
+			// Time out
+			log.Warningf("Operation to change state from %s to %s timed out!",
+				oldVal, newVal)
+			return false
+		}
+	}
+}
+
+// List function lists all the different portion of keys with the given prefix
+func (c *ConsulKVS) List(prefix string) ([]string, error) {
+	status, data, _, err := c.request(c.client, "GET", keyPath(prefix),
+		url.Values{"keys": []string{""}}, nil)
+	if err == nil && status != http.StatusOK && status != http.StatusNotFound {
+		err = fmt.Errorf("Consul returned %d: %s", status, data)
+	}
+	if err != nil {
+		log.WithFields(
+			log.Fields{"error": err,
+				"prefix": prefix},
+		).Error("Failed to list all keys with prefix from Consul ")
+		return nil, err
+	}
+
+	var keys []string
+	if status == http.StatusNotFound {
+		return keys, nil
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], prefix)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys, nil
+}
+
+// AtomicIncr - Increase a key value by 1
+func (c *ConsulKVS) AtomicIncr(key string) error {
+	return c.atomicAdd(key, 1)
+}
+
+// AtomicDecr - Decrease a key value by 1
+func (c *ConsulKVS) AtomicDecr(key string) error {
+	return c.atomicAdd(key, -1)
+}
+
+// atomicAdd adds delta to the number in key, retrying on concurrent changes
+func (c *ConsulKVS) atomicAdd(key string, delta int) error {
+	timer := time.NewTimer(requestTimeout)
+	defer timer.Stop()
+
+	for {
+		pair, err := c.get(key)
+		if err != nil {
+			log.WithFields(
+				log.Fields{"key": key,
+					"error": err},
+			).Error("Failed to Get key-value from Consul ")
+			return err
+		}
+		if pair == nil {
+			return fmt.Errorf("atomicAdd: no key found for %s", key)
+		}
+
+		num, _ := strconv.Atoi(string(pair.Value))
+		if num+delta < 0 {
+			return fmt.Errorf("Cannot decrease a value equal to 0")
+		}
+		succeeded, err := c.cas(key, strconv.Itoa(num+delta), pair.ModifyIndex)
+		if err != nil {
+			return err
+		}
+		if succeeded {
+			return nil
+		}
+
+		select {
+		case <-time.After(checkSleepDuration):
+		case <-timer.C:
+			return fmt.Errorf("Timeout reached; atomicAdd is not complete")
+		}
+	}
+}
+
+// BlockingWaitAndGet - Blocking wait until a key value becomes equal to a specific value
+// then read the value of another key
+func (c *ConsulKVS) BlockingWaitAndGet(key string, value string, newKey string) (string, error) {
+	ticker := time.NewTicker(checkSleepDuration)
+	defer ticker.Stop()
+	// This call is used to block and wait for long
+	// running functions. Larger timeout is justified.
+	timer := time.NewTimer(8 * requestTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pair, err := c.get(key)
+			if err != nil {
+				log.WithFields(
+					log.Fields{"key": key,
+						"value":   value,
+						"new key": newKey,
+						"error":   err},
+				).Error("Failed to compare and get from Consul ")
+				return "", err
+			}
+			if pair == nil || string(pair.Value) != value {
+				continue
+			}
+
+			newPair, err := c.get(newKey)
+			if err != nil {
+				return "", err
+			}
+			if newPair == nil {
+				return "", fmt.Errorf("BlockingWaitAndGet: no key found for %s", newKey)
+			}
+			return string(newPair.Value), nil
+		case <-timer.C:
+			return "", fmt.Errorf("Timeout reached; BlockingWait is not complete")
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consulops
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore"
+)
+
+// fakeConsul serves the KV and transaction APIs of Consul from memory
+type fakeConsul struct {
+	mtx       sync.Mutex
+	index     uint64
+	kv        map[string]consulPair
+	conflicts int // cas requests to fail as if the key was modified meanwhile
+}
+
+// startFakeConsul returns a ConsulKVS talking to a fakeConsul holding keys
+func startFakeConsul(keys map[string]string) (*ConsulKVS, *fakeConsul, func()) {
+	f := &fakeConsul{kv: make(map[string]consulPair)}
+	for key, val := range keys {
+		f.set(key, []byte(val))
+	}
+	srv := httptest.NewServer(f)
+	c := &ConsulKVS{endpoints: []string{srv.URL}, client: &http.Client{Timeout: requestTimeout}}
+	return c, f, srv.Close
+}
+
+// set puts val in key, caller holds f.mtx unless f is not served yet
+func (f *fakeConsul) set(key string, val []byte) {
+	f.index++
+	f.kv[key] = consulPair{Key: key, Value: val, ModifyIndex: f.index}
+}
+
+func (f *fakeConsul) value(key string) string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return string(f.kv[key].Value)
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+
+	if r.URL.Path == txnPath {
+		var ops []consulTxnOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, op := range ops {
+			if op.KV.Verb != "set" && op.KV.Verb != "delete" {
+				// Transactions are all or nothing
+				http.Error(w, "unknown verb "+op.KV.Verb, http.StatusConflict)
+				return
+			}
+		}
+		for _, op := range ops {
+			if op.KV.Verb == "set" {
+				f.set(op.KV.Key, op.KV.Value)
+			} else {
+				delete(f.kv, op.KV.Key)
+			}
+		}
+		w.Write([]byte("{}"))
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, kvPath)
+	query := r.URL.Query()
+	if r.Method == "PUT" {
+		index, _ := strconv.ParseUint(query.Get("cas"), 10, 64)
+		pair, exists := f.kv[key]
+		if f.conflicts > 0 || (exists && pair.ModifyIndex != index) || (!exists && index != 0) {
+			if f.conflicts > 0 {
+				f.conflicts--
+			}
+			w.Write([]byte("false"))
+			return
+		}
+		val, _ := ioutil.ReadAll(r.Body)
+		f.set(key, val)
+		w.Write([]byte("true"))
+		return
+	}
+
+	_, recurse := query["recurse"]
+	_, keysOnly := query["keys"]
+	var pairs []consulPair
+	for k, pair := range f.kv {
+		if k == key || ((recurse || keysOnly) && strings.HasPrefix(k, key)) {
+			pairs = append(pairs, pair)
+		}
+	}
+	if len(pairs) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	if keysOnly {
+		var keys []string
+		for _, pair := range pairs {
+			keys = append(keys, pair.Key)
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+	json.NewEncoder(w).Encode(pairs)
+}
+
+func TestConsulURL(t *testing.T) {
+	assert.Equal(t, "http://consul1:8500", consulURL("consul1:8500", false))
+	assert.Equal(t, "https://consul1:8501", consulURL("consul1:8501", true))
+	assert.Equal(t, "https://consul1:8501", consulURL("https://consul1:8501/", false))
+}
+
+func TestGRefChanges(t *testing.T) {
+	prev := map[string]string{"SVOLS_gref_a": "0", "SVOLS_gref_b": "1", "SVOLS_gref_c": "2", "SVOLS_gref_gone": "1"}
+	cur := map[string]string{"SVOLS_gref_a": "1", "SVOLS_gref_b": "0", "SVOLS_gref_c": "2", "SVOLS_gref_new": "0"}
+	assert.Equal(t, []grefChange{
+		{key: "SVOLS_gref_a", prevVal: "0", newVal: "1"},
+		{key: "SVOLS_gref_b", prevVal: "1", newVal: "0"},
+	}, grefChanges(prev, cur))
+	assert.Empty(t, grefChanges(cur, cur))
+}
+
+func TestCas(t *testing.T) {
+	c, f, stop := startFakeConsul(map[string]string{"SVOLS_stat_vol1": "Ready"})
+	defer stop()
+
+	pair, err := c.get("SVOLS_stat_vol1")
+	if !assert.Nil(t, err) || !assert.NotNil(t, pair) {
+		return
+	}
+	succeeded, err := c.cas("SVOLS_stat_vol1", "Mounted", pair.ModifyIndex+1)
+	assert.Nil(t, err)
+	assert.False(t, succeeded, "Put with a stale index should fail")
+	succeeded, err = c.cas("SVOLS_stat_vol1", "Mounted", pair.ModifyIndex)
+	assert.Nil(t, err)
+	assert.True(t, succeeded)
+	assert.Equal(t, "Mounted", f.value("SVOLS_stat_vol1"))
+
+	// Index 0 puts only keys which don't exist
+	succeeded, err = c.cas("SVOLS_stat_vol1", "Ready", 0)
+	assert.Nil(t, err)
+	assert.False(t, succeeded)
+	succeeded, err = c.cas("SVOLS_stat_vol 2@datastore1", "Ready", 0)
+	assert.Nil(t, err)
+	assert.True(t, succeeded)
+	assert.Equal(t, "Ready", f.value("SVOLS_stat_vol 2@datastore1"), "Keys should be escaped in the path")
+
+	pair, err = c.get("SVOLS_stat_none")
+	assert.Nil(t, err)
+	assert.Nil(t, pair, "Missing key should be nil")
+}
+
+func TestCompareAndPutOrFetch(t *testing.T) {
+	c, f, stop := startFakeConsul(map[string]string{"SVOLS_stat_vol1": "Ready"})
+	defer stop()
+
+	succeeded, cur, err := c.compareAndPutOrFetch("SVOLS_stat_vol1", "Mounted", "Unmounting")
+	assert.Nil(t, err)
+	assert.False(t, succeeded)
+	assert.Equal(t, "Ready", cur, "Current value expected when it doesn't match")
+
+	succeeded, _, err = c.compareAndPutOrFetch("SVOLS_stat_vol1", "Ready", "Mounting")
+	assert.Nil(t, err)
+	assert.True(t, succeeded)
+	assert.Equal(t, "Mounting", f.value("SVOLS_stat_vol1"))
+
+	_, _, err = c.compareAndPutOrFetch("SVOLS_stat_none", "Ready", "Mounting")
+	assert.NotNil(t, err, "Missing key should fail")
+	assert.False(t, c.CompareAndPut("SVOLS_stat_none", "Ready", "Mounting"))
+}
+
+func TestAtomicAdd(t *testing.T) {
+	c, f, stop := startFakeConsul(map[string]string{"SVOLS_gref_vol1": "0"})
+	defer stop()
+
+	assert.Nil(t, c.AtomicIncr("SVOLS_gref_vol1"))
+	assert.Equal(t, "1", f.value("SVOLS_gref_vol1"))
+
+	// Retried when the key is modified meanwhile
+	f.mtx.Lock()
+	f.conflicts = 1
+	f.mtx.Unlock()
+	assert.Nil(t, c.AtomicIncr("SVOLS_gref_vol1"))
+	assert.Equal(t, "2", f.value("SVOLS_gref_vol1"))
+
+	assert.Nil(t, c.AtomicDecr("SVOLS_gref_vol1"))
+	assert.Nil(t, c.AtomicDecr("SVOLS_gref_vol1"))
+	assert.NotNil(t, c.AtomicDecr("SVOLS_gref_vol1"), "Refcount should not go below 0")
+	assert.Equal(t, "0", f.value("SVOLS_gref_vol1"))
+	assert.NotNil(t, c.AtomicIncr("SVOLS_gref_none"), "Missing key should fail")
+}
+
+func TestTxn(t *testing.T) {
+	c, f, stop := startFakeConsul(map[string]string{"SVOLS_stat_vol1": "Ready"})
+	defer stop()
+
+	assert.Nil(t, c.txn([]consulTxnOp{
+		{KV: consulTxnKV{Verb: "set", Key: "SVOLS_gref_vol1", Value: []byte("0")}},
+		{KV: consulTxnKV{Verb: "delete", Key: "SVOLS_stat_vol1"}},
+	}))
+	assert.Equal(t, "0", f.value("SVOLS_gref_vol1"))
+	assert.Equal(t, "", f.value("SVOLS_stat_vol1"))
+
+	err := c.txn([]consulTxnOp{
+		{KV: consulTxnKV{Verb: "set", Key: "SVOLS_stat_vol1", Value: []byte("Ready")}},
+		{KV: consulTxnKV{Verb: "cas", Key: "SVOLS_gref_vol1"}},
+	})
+	assert.NotNil(t, err, "Failed transaction should be reported")
+	assert.Equal(t, "", f.value("SVOLS_stat_vol1"), "Failed transaction should change nothing")
+}
+
+func TestReadMetaData(t *testing.T) {
+	c, _, stop := startFakeConsul(nil)
+	defer stop()
+	keys := []string{kvstore.VolPrefixState + "vol1", kvstore.VolPrefixGRef + "vol1", kvstore.VolPrefixInfo + "vol1"}
+
+	_, err := c.ReadMetaData(keys)
+	assert.Equal(t, kvstore.ErrVolumeDoesNotExist, err)
+
+	assert.Nil(t, c.WriteMetaData([]kvstore.KvPair{
+		{Key: keys[0], Value: string(kvstore.VolStateCreating)},
+		{Key: keys[1], Value: "0"},
+	}))
+	_, err = c.ReadMetaData(keys)
+	assert.NotNil(t, err, "Volume with missing keys should fail")
+
+	assert.Nil(t, c.WriteMetaData([]kvstore.KvPair{{Key: keys[2], Value: "{}"}}))
+	entries, err := c.ReadMetaData(keys)
+	if assert.Nil(t, err) && assert.Len(t, entries, 3) {
+		assert.Equal(t, string(kvstore.VolStateCreating), entries[0].Value)
+		assert.Equal(t, "0", entries[1].Value)
+		assert.Equal(t, "{}", entries[2].Value)
+	}
+
+	names, err := c.List(kvstore.VolPrefixState)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vol1"}, names)
+
+	assert.Nil(t, c.DeleteMetaData("vol1"))
+	_, err = c.ReadMetaData(keys)
+	assert.Equal(t, kvstore.ErrVolumeDoesNotExist, err)
+}
@@ -13,12 +13,15 @@
 // limitations under the License.
 
 // ETCD implementation for KV Store interface
+//
+// The etcd cluster is either started by the plugin on the swarm managers, or an
+// existing one given by its endpoints.
 
 package etcdops
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -45,10 +48,7 @@ import (
    requestTimeout:             After how long should an etcd request timeout
    checkSleepDuration:         How long to wait in any busy waiting situation
                                before checking again
-   gcTicker:                   ticker for garbage collector to run a collection
    etcdClientCreateError:      Error indicating failure to create etcd client
-   etcdSingleRef:              if global refcount 0 -> 1, start SMB server
-   etcdNoRef:                  if global refcount 1 -> 0, shut down SMB server
 */
 const (
 	etcdClientPort           = ":2379"
@@ -60,25 +60,15 @@ const (
 	etcdClusterStateExisting = "existing"
 	requestTimeout           = 5 * time.Second
 	checkSleepDuration       = time.Second
-	gcTicker                 = 30 * time.Second
 	etcdClientCreateError    = "Failed to create etcd client"
-	etcdSingleRef            = "1"
-	etcdNoRef                = "0"
 )
 
 type EtcdKVS struct {
 	dockerOps *dockerops.DockerOps
 	nodeID    string
 	nodeAddr  string
-}
-
-// sharedVolConnectivityData - Contains metadata of shared volumes
-type sharedVolConnectivityData struct {
-	Port        int      `json:"port,omitempty"`
-	ServiceName string   `json:"serviceName,omitempty"`
-	Username    string   `json:"username,omitempty"`
-	Password    string   `json:"password,omitempty"`
-	ClientList  []string `json:"clientList,omitempty"`
+	endpoints []string    // endpoints of an external etcd cluster, empty for the one on swarm managers
+	tlsConfig *tls.Config // TLS configuration for the external etcd cluster, nil for plain connections
 }
 
 // NewKvStore function: start or join ETCD cluster depending on the role of the node
@@ -157,6 +147,49 @@ func NewKvStore(dockerOps *dockerops.DockerOps) *EtcdKVS {
 	return e
 }
 
+// NewExternalKvStore function: use the existing ETCD cluster at endpoints.
+// Swarm managers watch global refcounts to run the file services of volumes.
+func NewExternalKvStore(dockerOps *dockerops.DockerOps, endpoints []string, tlsConfig *tls.Config) *EtcdKVS {
+	if len(endpoints) == 0 {
+		log.Error("No endpoints given for external ETCD cluster ")
+		return nil
+	}
+
+	// get swarm info from docker client
+	nodeID, addr, isManager, err := dockerOps.GetSwarmInfo()
+	if err != nil {
+		log.WithFields(
+			log.Fields{"error": err},
+		).Error("Failed to get swarm Info from docker client ")
+		return nil
+	}
+
+	e := &EtcdKVS{
+		dockerOps: dockerOps,
+		nodeID:    nodeID,
+		nodeAddr:  addr,
+		endpoints: endpoints,
+		tlsConfig: tlsConfig,
+	}
+
+	if !isManager {
+		log.WithFields(
+			log.Fields{"nodeID": nodeID},
+		).Info("Swarm node role: worker. Return from NewExternalKvStore ")
+		return e
+	}
+
+	cli := e.createEtcdClient()
+	if cli == nil {
+		return nil
+	}
+	log.WithFields(
+		log.Fields{"nodeID": nodeID, "endpoints": endpoints},
+	).Info("Swarm node role: manager, watching external ETCD cluster ")
+	e.startWatchers(cli)
+	return e
+}
+
 // startEtcdCluster function is called by swarm leader to start a ETCD cluster
 func (e *EtcdKVS) startEtcdCluster() error {
 	nodeID := e.nodeID
@@ -313,8 +346,7 @@ func (e *EtcdKVS) checkLocalEtcd() error {
 						"error": err},
 				).Warningf("Failed to get ETCD client, retry before timeout ")
 			} else {
-				go e.etcdWatcher(cli)
-				go e.serviceAndVolumeGC(cli)
+				e.startWatchers(cli)
 				return nil
 			}
 		case <-timer.C:
@@ -335,61 +367,13 @@ func (e *EtcdKVS) etcdWatcher(cli *etcdClient.Client) {
 	}
 }
 
-// serviceAndVolumeGC: garbage collector for orphan services or volumes
-func (e *EtcdKVS) serviceAndVolumeGC(cli *etcdClient.Client) {
-	ticker := time.NewTicker(gcTicker)
-	quit := make(chan struct{})
-
-	for {
-		select {
-		case <-ticker.C:
-			// find all the vShared volume services
-			volumesToVerify, err := e.dockerOps.ListVolumesFromServices()
-			if err != nil {
-				log.Warningf("Failed to get vShared volumes according to docker services")
-			} else {
-				e.cleanOrphanServiceAndVolume(volumesToVerify, true)
-			}
-
-			// find all the internal volumes for vShared volume
-			volumesToVerify, err = e.dockerOps.ListVolumesFromInternalVol()
-			if err != nil {
-				log.Warningf("Failed to get internal volumes from docker")
-			} else {
-				e.cleanOrphanServiceAndVolume(volumesToVerify, false)
-			}
-		case <-quit:
-			ticker.Stop()
-			return
-		}
-	}
-}
-
-// trimVolName: trim the volume name if there is special split characters existing in the name
-func trimVolName(volName string) string {
-	// Currently we only take @ as the split character
-	// TODO: need to take care of volumes with same name but on different datastores
-	s := strings.Split(volName, "@")
-	return s[0]
-}
-
-// cleanOrphanServiceAndVolume: stop orphan services and delete orphan internal volumes
-func (e *EtcdKVS) cleanOrphanServiceAndVolume(volumesToVerify []string, stopService bool) {
-	volStates := e.kvMapFromPrefix(string(kvstore.VolPrefixState))
-	for _, volName := range volumesToVerify {
-		volName = trimVolName(volName)
-		state, found := volStates[string(kvstore.VolPrefixState)+volName]
-		if !found ||
-			state == string(kvstore.VolStateDeleting) {
-			if stopService {
-				log.Warningf("The service for vShared volume %s needs to be shutdown.", volName)
-				e.dockerOps.StopSMBServer(volName)
-			}
-
-			log.Warningf("The internal volume of vShared volume %s needs to be removed.", volName)
-			e.dockerOps.DeleteInternalVolume(volName)
-		}
-	}
+// startWatchers function starts the watcher for volume global refcounts and the garbage
+// collector for orphan services or volumes
+func (e *EtcdKVS) startWatchers(cli *etcdClient.Client) {
+	go e.etcdWatcher(cli)
+	go kvstore.ServiceAndVolumeGC(e.dockerOps, func() map[string]string {
+		return e.kvMapFromPrefix(string(kvstore.VolPrefixState))
+	})
 }
 
 // etcdEventHandler function handles the returned event from etcd watcher of global refcount changes
@@ -398,135 +382,12 @@ func (e *EtcdKVS) etcdEventHandler(ev *etcdClient.Event) {
 		log.Fields{"type": ev.Type},
 	).Infof("Watcher on global refcount returns event ")
 
-	nested := func(key string, fromState kvstore.VolStatus,
-		toState kvstore.VolStatus, interimState kvstore.VolStatus,
-		fn func(string) (int, string, bool)) {
-
-		// watcher observes global refcount critical change
-		// transactional edit state first
-		volName := strings.TrimPrefix(key, kvstore.VolPrefixGRef)
-		succeeded := e.CompareAndPutStateOrBusywait(kvstore.VolPrefixState+volName,
-			string(fromState), string(interimState))
-		if !succeeded {
-			// this handler doesn't get the right to start/stop server
-			return
-		}
-
-		port, servName, succeeded := fn(volName)
-		if succeeded {
-			// Either starting or stopping SMB
-			// server succeeded.
-			// Update volume metadata to reflect
-			// port number and file service name.
-			var entries []kvstore.KvPair
-			var writeEntries []kvstore.KvPair
-			var volRecord sharedVolConnectivityData
-
-			// Port, Server name, Client list, Samba
-			// username/password are in the same key.
-			// Must fetch this key to know the value
-			// of other fields before rewriting them.
-			keys := []string{
-				kvstore.VolPrefixInfo + volName,
-			}
-			entries, err := e.ReadMetaData(keys)
-			if err != nil {
-				// Failed to fetch existing metadata on the volume
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to read volume metadata before updating port information: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
-			if err != nil {
-				// Failed to unmarshal record from JSON
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to unmarshal JSON for reading existing metadata: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			// Rewrite the port number and service name
-			// then marshal the data structure to JSON again.
-			volRecord.Port = port
-			volRecord.ServiceName = servName
-			byteRecord, err := json.Marshal(volRecord)
-			if err != nil {
-				// Failed to marshal record as JSON
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to marshal JSON for writing metadata: %v",
-					err)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-			writeEntries = append(writeEntries, kvstore.KvPair{
-				Key:   kvstore.VolPrefixInfo + volName,
-				Value: string(byteRecord)})
-
-			log.Infof("Updating port and file service name for %s", volName)
-			err = e.WriteMetaData(writeEntries)
-			if err != nil {
-				// Failed to write metadata.
-				// Set volume state to error as we cannot
-				// proceed
-				log.Warningf("Failed to write metadata for volume %s",
-					volName)
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-				return
-			}
-
-			// server start/stop succeed. Set desired state on volume.
-			stateUpdateResult := e.CompareAndPut(kvstore.VolPrefixState+volName,
-				string(interimState),
-				string(toState))
-			if stateUpdateResult == false {
-				// Could not set desired state on volume
-				// set to state Error
-				e.CompareAndPut(kvstore.VolPrefixState+volName,
-					string(interimState),
-					string(kvstore.VolStateError))
-			}
-		} else {
-			// failed to start/stop server, set to state Error
-			e.CompareAndPut(kvstore.VolPrefixState+volName,
-				string(interimState),
-				string(kvstore.VolStateError))
-		}
-		return
-	}
-
 	// What we want to monitor are PUT requests on global refcount
 	// Not delete, not get, not anything else
-	if ev.Type == etcdClient.EventTypePut {
-		if string(ev.Kv.Value) == etcdSingleRef &&
-			ev.PrevKv != nil &&
-			string(ev.PrevKv.Value) == etcdNoRef {
-			// Refcount went 0 -> 1
-			nested(string(ev.Kv.Key), kvstore.VolStateReady,
-				kvstore.VolStateMounted, kvstore.VolStateMounting,
-				e.dockerOps.StartSMBServer)
-		} else if string(ev.Kv.Value) == etcdNoRef &&
-			ev.PrevKv != nil &&
-			string(ev.PrevKv.Value) == etcdSingleRef {
-			// Refcount went 1 -> 0
-			nested(string(ev.Kv.Key), kvstore.VolStateMounted,
-				kvstore.VolStateReady, kvstore.VolStateUnmounting,
-				e.dockerOps.StopSMBServer)
-		}
+	if ev.Type == etcdClient.EventTypePut && ev.PrevKv != nil {
+		kvstore.HandleGRefChange(e, e.dockerOps, string(ev.Kv.Key),
+			string(ev.PrevKv.Value), string(ev.Kv.Value))
 	}
-	return
 }
 
 // CompareAndPut function: compare the value of the kay with oldVal
@@ -631,8 +492,25 @@ func (e *EtcdKVS) CompareAndPutStateOrBusywait(key string, oldVal string, newVal
 	}
 }
 
-// createEtcdClient function creates an ETCD client according to swarm manager info
+// createEtcdClient function creates an ETCD client for the external cluster,
+// or according to swarm manager info
 func (e *EtcdKVS) createEtcdClient() *etcdClient.Client {
+	if len(e.endpoints) > 0 {
+		etcd, err := etcdClient.New(etcdClient.Config{
+			Endpoints:   e.endpoints,
+			DialTimeout: requestTimeout,
+			TLS:         e.tlsConfig,
+		})
+		if err != nil {
+			log.WithFields(
+				log.Fields{"endpoints": e.endpoints,
+					"error": err},
+			).Error("Failed to create ETCD Client ")
+			return nil
+		}
+		return etcd
+	}
+
 	managers, err := e.dockerOps.GetSwarmManagers()
 	if err != nil {
 		log.WithFields(
@@ -814,7 +692,7 @@ func (e *EtcdKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
 
 	if missedCount == len(keys) {
 		// Volume does not exist
-		return nil, errors.New(kvstore.VolumeDoesNotExistError)
+		return nil, kvstore.ErrVolumeDoesNotExist
 	} else if missedCount > 0 {
 		// This should not happen
 		// There is a volume but we couldn't read all its keys
@@ -0,0 +1,259 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// File services of shared volumes
+//
+// Each KV store backend watches the global refcounts of volumes, and calls
+// HandleGRefChange to start the file service of a volume on its first mount
+// and stop it on its last unmount. Backends also run ServiceAndVolumeGC to
+// clean up services and internal volumes left over by deleted volumes.
+
+package kvstore
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+/*
+   gcTicker:     ticker for garbage collector to run a collection
+   grefSingle:   if global refcount 0 -> 1, start SMB server
+   grefNone:     if global refcount 1 -> 0, shut down SMB server
+*/
+const (
+	gcTicker   = 30 * time.Second
+	grefSingle = "1"
+	grefNone   = "0"
+)
+
+// VolumeServices runs the file services and internal volumes of shared volumes
+type VolumeServices interface {
+	// StartSMBServer - Start the file service of a volume, returns its port and service name
+	StartSMBServer(volName string) (int, string, bool)
+
+	// StopSMBServer - Stop the file service of a volume
+	StopSMBServer(volName string) (int, string, bool)
+
+	// ListVolumesFromServices - List the volumes file services run for
+	ListVolumesFromServices() ([]string, error)
+
+	// ListVolumesFromInternalVol - List the volumes internal volumes exist for
+	ListVolumesFromInternalVol() ([]string, error)
+
+	// DeleteInternalVolume - Delete the internal volume of a volume
+	DeleteInternalVolume(volName string)
+}
+
+// sharedVolConnectivityData - Contains metadata of shared volumes
+type sharedVolConnectivityData struct {
+	Port        int      `json:"port,omitempty"`
+	ServiceName string   `json:"serviceName,omitempty"`
+	Username    string   `json:"username,omitempty"`
+	Password    string   `json:"password,omitempty"`
+	ClientList  []string `json:"clientList,omitempty"`
+}
+
+// HandleGRefChange handles a change of the global refcount key from prevVal to newVal
+func HandleGRefChange(kvs KvStore, services VolumeServices, key string, prevVal string, newVal string) {
+	if newVal == grefSingle && prevVal == grefNone {
+		// Refcount went 0 -> 1
+		changeFileService(kvs, key, VolStateReady, VolStateMounted, VolStateMounting,
+			services.StartSMBServer)
+	} else if newVal == grefNone && prevVal == grefSingle {
+		// Refcount went 1 -> 0
+		changeFileService(kvs, key, VolStateMounted, VolStateReady, VolStateUnmounting,
+			services.StopSMBServer)
+	}
+}
+
+// changeFileService starts or stops the file service of the volume of global refcount key
+// with fn, moving the volume from fromState to toState through interimState
+func changeFileService(kvs KvStore, key string, fromState VolStatus,
+	toState VolStatus, interimState VolStatus,
+	fn func(string) (int, string, bool)) {
+
+	// watcher observes global refcount critical change
+	// transactional edit state first
+	volName := strings.TrimPrefix(key, VolPrefixGRef)
+	succeeded := kvs.CompareAndPutStateOrBusywait(VolPrefixState+volName,
+		string(fromState), string(interimState))
+	if !succeeded {
+		// this handler doesn't get the right to start/stop server
+		return
+	}
+
+	port, servName, succeeded := fn(volName)
+	if !succeeded {
+		// failed to start/stop server, set to state Error
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+		return
+	}
+
+	// Either starting or stopping SMB
+	// server succeeded.
+	// Update volume metadata to reflect
+	// port number and file service name.
+	var writeEntries []KvPair
+	var volRecord sharedVolConnectivityData
+
+	// Port, Server name, Client list, Samba
+	// username/password are in the same key.
+	// Must fetch this key to know the value
+	// of other fields before rewriting them.
+	keys := []string{
+		VolPrefixInfo + volName,
+	}
+	entries, err := kvs.ReadMetaData(keys)
+	if err != nil {
+		// Failed to fetch existing metadata on the volume
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to read volume metadata before updating port information: %v",
+			err)
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+		return
+	}
+	err = json.Unmarshal([]byte(entries[0].Value), &volRecord)
+	if err != nil {
+		// Failed to unmarshal record from JSON
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to unmarshal JSON for reading existing metadata: %v",
+			err)
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+		return
+	}
+	// Rewrite the port number and service name
+	// then marshal the data structure to JSON again.
+	volRecord.Port = port
+	volRecord.ServiceName = servName
+	byteRecord, err := json.Marshal(volRecord)
+	if err != nil {
+		// Failed to marshal record as JSON
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to marshal JSON for writing metadata: %v",
+			err)
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+		return
+	}
+	writeEntries = append(writeEntries, KvPair{
+		Key:   VolPrefixInfo + volName,
+		Value: string(byteRecord)})
+
+	log.Infof("Updating port and file service name for %s", volName)
+	err = kvs.WriteMetaData(writeEntries)
+	if err != nil {
+		// Failed to write metadata.
+		// Set volume state to error as we cannot
+		// proceed
+		log.Warningf("Failed to write metadata for volume %s",
+			volName)
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+		return
+	}
+
+	// server start/stop succeed. Set desired state on volume.
+	stateUpdateResult := kvs.CompareAndPut(VolPrefixState+volName,
+		string(interimState),
+		string(toState))
+	if stateUpdateResult == false {
+		// Could not set desired state on volume
+		// set to state Error
+		kvs.CompareAndPut(VolPrefixState+volName,
+			string(interimState),
+			string(VolStateError))
+	}
+}
+
+// ServiceAndVolumeGC: garbage collector for orphan services or volumes.
+// volStates returns the state keys of all volumes with their values, nil on error.
+func ServiceAndVolumeGC(services VolumeServices, volStates func() map[string]string) {
+	ticker := time.NewTicker(gcTicker)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		states := volStates()
+		if states == nil {
+			log.Warningf("Failed to get vShared volume states from KV store")
+			continue
+		}
+
+		// find all the vShared volume services
+		volumesToVerify, err := services.ListVolumesFromServices()
+		if err != nil {
+			log.Warningf("Failed to get vShared volumes according to docker services")
+		} else {
+			cleanOrphanServiceAndVolume(services, states, volumesToVerify, true)
+		}
+
+		// find all the internal volumes for vShared volume
+		volumesToVerify, err = services.ListVolumesFromInternalVol()
+		if err != nil {
+			log.Warningf("Failed to get internal volumes from docker")
+		} else {
+			cleanOrphanServiceAndVolume(services, states, volumesToVerify, false)
+		}
+	}
+}
+
+// volStateOf: find the state of a vShared volume listed as volName
+// Docker lists the internal volume of a vShared volume created without datastore with the
+// datastore in its name, so the name without datastore is tried if volName has no state.
+// The datastore of a volume created without one is not kept in its state, so vol@ds2 matches
+// the state of vol whatever datastore vol is on: an orphan may be kept, a volume in use is
+// never removed.
+func volStateOf(volStates map[string]string, volName string) (string, bool) {
+	if state, found := volStates[string(VolPrefixState)+volName]; found {
+		return state, true
+	}
+	// Currently we only take @ as the split character
+	s := strings.Split(volName, "@")
+	if len(s) < 2 {
+		return "", false
+	}
+	state, found := volStates[string(VolPrefixState)+s[0]]
+	return state, found
+}
+
+// cleanOrphanServiceAndVolume: stop orphan services and delete orphan internal volumes
+func cleanOrphanServiceAndVolume(services VolumeServices, volStates map[string]string,
+	volumesToVerify []string, stopService bool) {
+	for _, volName := range volumesToVerify {
+		state, found := volStateOf(volStates, volName)
+		if !found ||
+			state == string(VolStateDeleting) {
+			if stopService {
+				log.Warningf("The service for vShared volume %s needs to be shutdown.", volName)
+				services.StopSMBServer(volName)
+			}
+
+			log.Warningf("The internal volume of vShared volume %s needs to be removed.", volName)
+			services.DeleteInternalVolume(volName)
+		}
+	}
+}
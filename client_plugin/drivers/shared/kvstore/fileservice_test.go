@@ -0,0 +1,51 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvstore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVolStateOf(t *testing.T) {
+	volStates := map[string]string{
+		string(VolPrefixState) + "vol@ds1": string(VolStateReady),
+		string(VolPrefixState) + "vol@ds2": string(VolStateDeleting),
+		string(VolPrefixState) + "short":   string(VolStateReady),
+	}
+	tests := []struct {
+		volName string
+		state   string
+		found   bool
+	}{
+		// volumes with the same name on two datastores have their own states
+		{"vol@ds1", string(VolStateReady), true},
+		{"vol@ds2", string(VolStateDeleting), true},
+		{"vol@ds3", "", false},
+		{"vol", "", false},
+		// short name, and internal volume of a volume created without datastore
+		{"short", string(VolStateReady), true},
+		{"short@ds1", string(VolStateReady), true},
+		{"short@ds2", string(VolStateReady), true},
+		{"other", "", false},
+		{"other@ds1", "", false},
+	}
+	for _, test := range tests {
+		state, found := volStateOf(volStates, test.volName)
+		assert.Equal(t, test.found, found, test.volName)
+		assert.Equal(t, test.state, state, test.volName)
+	}
+}
@@ -18,6 +18,8 @@
 
 package kvstore
 
+import "errors"
+
 // VolStatus: Datatype for keeping status of a shared volume
 type VolStatus string
 
@@ -59,6 +61,16 @@ const (
 	VolumeDoesNotExistError           = "No such volume"
 )
 
+// KV store backends, selected with KvStore in the plugin config
+const (
+	BackendEtcd         = "etcd"          // etcd started on the swarm managers by the plugin
+	BackendExternalEtcd = "external-etcd" // existing etcd v3 cluster
+	BackendConsul       = "consul"        // existing Consul cluster
+)
+
+// ErrVolumeDoesNotExist is returned by ReadMetaData when none of the keys exist
+var ErrVolumeDoesNotExist = errors.New(VolumeDoesNotExistError)
+
 // KvPair : Key Value pair holder
 type KvPair struct {
 	Key   string
@@ -0,0 +1,245 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// In-memory implementation for KV Store interface
+//
+// Keys live in the process only, so volumes are not shared between hosts.
+// Meant for unit tests, it can't be selected in the plugin config.
+
+package memops
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore"
+)
+
+/*
+   requestTimeout:     After how long should a request waiting on a key timeout
+*/
+const (
+	requestTimeout = 5 * time.Second
+)
+
+// MemKVS - in-memory KV store
+type MemKVS struct {
+	services kvstore.VolumeServices // runs file services on global refcount changes, nil for none
+	mtx      *sync.Mutex            // protects kvs and changed
+	kvs      map[string]string
+	changed  chan struct{} // closed and replaced on each change
+}
+
+// NewKvStore function: create an empty in-memory KV store. File services are
+// started and stopped with services on global refcount changes, and orphan ones
+// cleaned up, unless services is nil.
+func NewKvStore(services kvstore.VolumeServices) *MemKVS {
+	m := &MemKVS{
+		services: services,
+		mtx:      &sync.Mutex{},
+		kvs:      make(map[string]string),
+		changed:  make(chan struct{}),
+	}
+	if services != nil {
+		go kvstore.ServiceAndVolumeGC(services, m.volStates)
+	}
+	return m
+}
+
+// put sets key to val, the caller holds m.mtx
+func (m *MemKVS) put(key string, val string) {
+	prevVal, existed := m.kvs[key]
+	m.kvs[key] = val
+	close(m.changed)
+	m.changed = make(chan struct{})
+
+	if m.services != nil && existed && strings.HasPrefix(key, kvstore.VolPrefixGRef) {
+		go kvstore.HandleGRefChange(m, m.services, key, prevVal, val)
+	}
+}
+
+// WriteMetaData - Update or Create metadata in KV store
+func (m *MemKVS) WriteMetaData(entries []kvstore.KvPair) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, elem := range entries {
+		m.put(elem.Key, elem.Value)
+	}
+	return nil
+}
+
+// ReadMetaData - Read metadata in KV store
+func (m *MemKVS) ReadMetaData(keys []string) ([]kvstore.KvPair, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var entries []kvstore.KvPair
+	for _, key := range keys {
+		if val, exists := m.kvs[key]; exists {
+			entries = append(entries, kvstore.KvPair{Key: key, Value: val})
+		}
+	}
+	if len(entries) == 0 {
+		return nil, kvstore.ErrVolumeDoesNotExist
+	} else if len(entries) < len(keys) {
+		return nil, fmt.Errorf("Failed to get volume. Couldn't find all keys!")
+	}
+	return entries, nil
+}
+
+// DeleteMetaData - Delete volume metadata in KV store
+func (m *MemKVS) DeleteMetaData(name string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for _, prefix := range []string{kvstore.VolPrefixState, kvstore.VolPrefixGRef, kvstore.VolPrefixInfo} {
+		delete(m.kvs, prefix+name)
+	}
+	close(m.changed)
+	m.changed = make(chan struct{})
+	return nil
+}
+
+// CompareAndPut function: compare the value of the key with oldVal
+// if equal, replace with newVal and return true; or else, return false.
+func (m *MemKVS) CompareAndPut(key string, oldVal string, newVal string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if val, exists := m.kvs[key]; !exists || val != oldVal {
+		return false
+	}
+	m.put(key, newVal)
+	return true
+}
+
+// CompareAndPutStateOrBusywait function: compare the volume state with oldVal
+// if equal, replace with newVal and return true; or else, return false;
+// waits if volume is in a state from where it can reach the ready state
+func (m *MemKVS) CompareAndPutStateOrBusywait(key string, oldVal string, newVal string) bool {
+	timer := time.NewTimer(2 * requestTimeout)
+	defer timer.Stop()
+
+	for {
+		m.mtx.Lock()
+		val, exists := m.kvs[key]
+		if exists && val == oldVal {
+			m.put(key, newVal)
+			m.mtx.Unlock()
+			return true
+		}
+		changed := m.changed
+		m.mtx.Unlock()
+
+		// Did we encounter states other than Unmounting or Creating?
+		if val != string(kvstore.VolStateUnmounting) && val != string(kvstore.VolStateCreating) {
+			return false
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// List function lists all the different portion of keys with the given prefix
+func (m *MemKVS) List(prefix string) ([]string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var keys []string
+	for key := range m.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, strings.TrimPrefix(key, prefix))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	return keys, nil
+}
+
+// AtomicIncr - Increase a key value by 1
+func (m *MemKVS) AtomicIncr(key string) error {
+	return m.add(key, 1)
+}
+
+// AtomicDecr - Decrease a key value by 1
+func (m *MemKVS) AtomicDecr(key string) error {
+	return m.add(key, -1)
+}
+
+// add adds delta to the number in key
+func (m *MemKVS) add(key string, delta int) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	val, exists := m.kvs[key]
+	if !exists {
+		return fmt.Errorf("no key found for %s", key)
+	}
+	num, _ := strconv.Atoi(val)
+	if num+delta < 0 {
+		return fmt.Errorf("Cannot decrease a value equal to 0")
+	}
+	m.put(key, strconv.Itoa(num+delta))
+	return nil
+}
+
+// BlockingWaitAndGet - Blocking wait until a key value becomes equal to a specific value
+// then read the value of another key
+func (m *MemKVS) BlockingWaitAndGet(key string, value string, newKey string) (string, error) {
+	// This call is used to block and wait for long
+	// running functions. Larger timeout is justified.
+	timer := time.NewTimer(8 * requestTimeout)
+	defer timer.Stop()
+
+	for {
+		m.mtx.Lock()
+		if m.kvs[key] == value {
+			newVal, exists := m.kvs[newKey]
+			m.mtx.Unlock()
+			if !exists {
+				return "", fmt.Errorf("BlockingWaitAndGet: no key found for %s", newKey)
+			}
+			return newVal, nil
+		}
+		changed := m.changed
+		m.mtx.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return "", fmt.Errorf("Timeout reached; BlockingWait is not complete")
+		}
+	}
+}
+
+// volStates returns the state keys of all volumes with their values
+func (m *MemKVS) volStates() map[string]string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	states := make(map[string]string)
+	for key, val := range m.kvs {
+		if strings.HasPrefix(key, kvstore.VolPrefixState) {
+			states[key] = val
+		}
+	}
+	return states
+}
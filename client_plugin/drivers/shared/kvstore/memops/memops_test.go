@@ -0,0 +1,116 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package memops
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore"
+)
+
+// fakeServices runs file services on ports counting from 30000
+type fakeServices struct {
+	started map[string]int
+}
+
+func (f *fakeServices) StartSMBServer(volName string) (int, string, bool) {
+	f.started[volName] = 30000 + len(f.started)
+	return f.started[volName], "vSharedServer" + volName, true
+}
+
+func (f *fakeServices) StopSMBServer(volName string) (int, string, bool) {
+	delete(f.started, volName)
+	return 0, "", true
+}
+
+func (f *fakeServices) ListVolumesFromServices() ([]string, error)    { return nil, nil }
+func (f *fakeServices) ListVolumesFromInternalVol() ([]string, error) { return nil, nil }
+func (f *fakeServices) DeleteInternalVolume(volName string)           {}
+
+func TestMetaData(t *testing.T) {
+	m := NewKvStore(nil)
+	_, err := m.ReadMetaData([]string{kvstore.VolPrefixState + "vol"})
+	assert.Equal(t, kvstore.ErrVolumeDoesNotExist, err)
+
+	assert.Nil(t, m.WriteMetaData([]kvstore.KvPair{
+		{Key: kvstore.VolPrefixState + "vol", Value: string(kvstore.VolStateCreating)},
+		{Key: kvstore.VolPrefixGRef + "vol", Value: "0"},
+		{Key: kvstore.VolPrefixInfo + "vol", Value: "{}"},
+		{Key: kvstore.VolPrefixState + "other", Value: string(kvstore.VolStateReady)},
+	}))
+	entries, err := m.ReadMetaData([]string{kvstore.VolPrefixState + "vol", kvstore.VolPrefixGRef + "vol"})
+	assert.Nil(t, err)
+	assert.Equal(t, string(kvstore.VolStateCreating), entries[0].Value)
+	assert.Equal(t, "0", entries[1].Value)
+	_, err = m.ReadMetaData([]string{kvstore.VolPrefixState + "vol", kvstore.VolPrefixState + "none"})
+	assert.NotNil(t, err)
+
+	names, err := m.List(kvstore.VolPrefixState)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"vol", "other"}, names)
+
+	assert.False(t, m.CompareAndPut(kvstore.VolPrefixState+"vol", string(kvstore.VolStateMounted), "x"))
+	assert.True(t, m.CompareAndPut(kvstore.VolPrefixState+"vol", string(kvstore.VolStateCreating),
+		string(kvstore.VolStateReady)))
+
+	assert.Nil(t, m.AtomicIncr(kvstore.VolPrefixGRef+"vol"))
+	assert.Nil(t, m.AtomicDecr(kvstore.VolPrefixGRef+"vol"))
+	assert.NotNil(t, m.AtomicDecr(kvstore.VolPrefixGRef+"vol"))
+	assert.NotNil(t, m.AtomicIncr(kvstore.VolPrefixGRef+"none"))
+
+	assert.Nil(t, m.DeleteMetaData("vol"))
+	_, err = m.ReadMetaData([]string{kvstore.VolPrefixState + "vol"})
+	assert.Equal(t, kvstore.ErrVolumeDoesNotExist, err)
+}
+
+func TestBusywait(t *testing.T) {
+	m := NewKvStore(nil)
+	key := kvstore.VolPrefixState + "vol"
+	m.WriteMetaData([]kvstore.KvPair{{Key: key, Value: string(kvstore.VolStateCreating)}})
+
+	// Waits for the volume to get out of Creating
+	go m.CompareAndPut(key, string(kvstore.VolStateCreating), string(kvstore.VolStateReady))
+	assert.True(t, m.CompareAndPutStateOrBusywait(key, string(kvstore.VolStateReady),
+		string(kvstore.VolStateDeleting)))
+
+	// Doesn't wait on other states
+	assert.False(t, m.CompareAndPutStateOrBusywait(key, string(kvstore.VolStateReady),
+		string(kvstore.VolStateDeleting)))
+}
+
+func TestFileService(t *testing.T) {
+	services := &fakeServices{started: make(map[string]int)}
+	m := NewKvStore(services)
+	m.WriteMetaData([]kvstore.KvPair{
+		{Key: kvstore.VolPrefixState + "vol", Value: string(kvstore.VolStateReady)},
+		{Key: kvstore.VolPrefixGRef + "vol", Value: "0"},
+		{Key: kvstore.VolPrefixInfo + "vol", Value: "{}"},
+	})
+
+	// First mount starts the file service
+	assert.Nil(t, m.AtomicIncr(kvstore.VolPrefixGRef+"vol"))
+	info, err := m.BlockingWaitAndGet(kvstore.VolPrefixState+"vol", string(kvstore.VolStateMounted),
+		kvstore.VolPrefixInfo+"vol")
+	assert.Nil(t, err)
+	assert.Equal(t, `{"port":30000,"serviceName":"vSharedServervol"}`, info)
+
+	// Last unmount stops it
+	assert.Nil(t, m.AtomicDecr(kvstore.VolPrefixGRef+"vol"))
+	_, err = m.BlockingWaitAndGet(kvstore.VolPrefixState+"vol", string(kvstore.VolStateReady),
+		kvstore.VolPrefixInfo+"vol")
+	assert.Nil(t, err)
+	assert.Empty(t, services.started)
+}
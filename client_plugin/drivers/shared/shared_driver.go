@@ -35,6 +35,7 @@ import (
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/dockerops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore/consulops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/shared/kvstore/etcdops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/utils"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
@@ -103,7 +104,6 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 
 	d.RefCounts = refcount.NewRefCountsMap()
 	d.RefCounts.Init(&d, mountDir, cfg.Driver)
-	d.MountIDtoName = make(map[string]string)
 	d.MountRoot = mountDir
 
 	// Read flag from CLI. If not provided, use cfg value
@@ -127,13 +127,13 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	go d.dockerOps.LoadFileServerImage()
 	log.Infof("Started loading file server image")
 
-	// initialize built-in etcd cluster
-	etcdKVS := etcdops.NewKvStore(d.dockerOps)
-	if etcdKVS == nil {
-		log.Errorf("Failed to create new KV store")
+	// initialize the KV store, starting the built-in etcd cluster by default
+	kvStore, err := newKvStore(cfg, d.dockerOps)
+	if err != nil {
+		log.WithFields(log.Fields{"kvstore": cfg.KvStore, "error": err}).Error("Failed to create new KV store ")
 		return nil
 	}
-	d.kvStore = etcdKVS
+	d.kvStore = kvStore
 
 	log.WithFields(log.Fields{
 		"version": version,
@@ -142,6 +142,33 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	return &d
 }
 
+// newKvStore creates the KV store backend selected in cfg
+func newKvStore(cfg config.Config, dockerOps *dockerops.DockerOps) (kvstore.KvStore, error) {
+	tlsConfig, err := kvstore.TLSConfig(cfg.KvStoreCertFile, cfg.KvStoreKeyFile, cfg.KvStoreCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.KvStore {
+	case kvstore.BackendEtcd:
+		if etcdKVS := etcdops.NewKvStore(dockerOps); etcdKVS != nil {
+			return etcdKVS, nil
+		}
+	case kvstore.BackendExternalEtcd:
+		if etcdKVS := etcdops.NewExternalKvStore(dockerOps, cfg.KvStoreEndpoints, tlsConfig); etcdKVS != nil {
+			return etcdKVS, nil
+		}
+	case kvstore.BackendConsul:
+		if consulKVS := consulops.NewKvStore(dockerOps, cfg.KvStoreEndpoints, tlsConfig); consulKVS != nil {
+			return consulKVS, nil
+		}
+	default:
+		return nil, fmt.Errorf("Unknown KV store %s, valid ones are %s, %s and %s", cfg.KvStore,
+			kvstore.BackendEtcd, kvstore.BackendExternalEtcd, kvstore.BackendConsul)
+	}
+	return nil, fmt.Errorf("Failed to initialize %s KV store", cfg.KvStore)
+}
+
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 	log.Infof("VolumeDriver Get: %s", r.Name)
@@ -191,7 +218,7 @@ func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
 	// KV pairs will be returned in same order in which they were requested
 	entries, err := d.kvStore.ReadMetaData(keys)
 	if err != nil {
-		if err.Error() == kvstore.VolumeDoesNotExistError {
+		if err == kvstore.ErrVolumeDoesNotExist {
 			log.Infof("Volume not found: %s", name)
 			return statusMap, err
 		}
@@ -427,7 +454,7 @@ func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 
 // processMount -  process a mount request
 func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
-	d.MountIDtoName[r.ID] = r.Name
+	d.RefCounts.AddMountID(r.ID, r.Name)
 
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
@@ -445,7 +472,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		return volume.Response{Mountpoint: d.GetMountPoint(r.Name)}
 	}
 
-	mountpoint, err := d.MountVolume(r.Name, "", "", false, true)
+	mountpoint, err := d.MountVolume(r.Name, "", "", false, true, nil)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name,
@@ -464,7 +491,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 }
 
 // MountVolume - Request attach and then mounts the volume.
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, volumeMeta map[string]interface{}) (string, error) {
 	mountpoint := d.GetMountPoint(name)
 	// First, make sure  that mountpoint exists.
 	err := fs.Mkdir(mountpoint)
@@ -606,9 +633,8 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 
 // processUnMount -  process a unmount request
 func (d *VolumeDriver) processUnmount(r volume.UnmountRequest) volume.Response {
-	if fullVolName, exist := d.MountIDtoName[r.ID]; exist {
+	if fullVolName, exist := d.RefCounts.RemoveMountID(r.ID); exist {
 		r.Name = fullVolName
-		delete(d.MountIDtoName, r.ID) //cleanup the map
 	} else {
 		msg := fmt.Sprintf("Unable to find volume %v.", r.Name)
 		return volume.Response{Err: msg}
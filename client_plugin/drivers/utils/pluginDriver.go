@@ -27,9 +27,8 @@ import (
 
 // PluginDriver - helper struct to hold common utilities for driver interface
 type PluginDriver struct {
-	RefCounts     *refcount.RefCountsMap
-	MountIDtoName map[string]string // map of mountID -> full volume name
-	MountRoot     string
+	RefCounts *refcount.RefCountsMap // refcounts, and the full volume name by mount ID
+	MountRoot string
 }
 
 // GetMountPoint returns the mount point based on MountRoot and volume name
@@ -0,0 +1,244 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Idempotent create.
+//
+// A create retried after Docker timed out, or after the plugin crashed, finds
+// the volume created already. If the existing volume has the requested options
+// the create succeeds, and the filesystem is created when the earlier create
+// didn't get to it. Only options differing from those of the volume fail the create.
+
+package vmdk
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+)
+
+const (
+	defaultSize = "100mb" // size of volumes created without the size option
+	capacityKey = "capacity"
+	sizeKey     = "size"
+)
+
+// statusOptions are the create options ESX service returns in the volume status,
+// with the value of volumes created without the option
+var statusOptions = map[string]string{
+	"diskformat":               "thin",
+	"attach-as":                "independent_persistent",
+	"access":                   "read-write",
+	"fstype":                   "",
+	"vsan-policy-name":         "",
+	"mkfs-opts":                "",
+	"mount-opts":               "",
+	"clone-from":               "None",
+	"from-snapshot":            "None",
+	plugin_utils.VolumeModeKey: plugin_utils.VolumeModeFilesystem,
+	plugin_utils.EncryptionKey: "",
+	iopsLimitKey:               "",
+	bpsLimitKey:                "",
+}
+
+// formatCapacity formats size in bytes as ESX service does in the volume status
+func formatCapacity(size uint64) string {
+	switch {
+	case size < 1<<10:
+		return strconv.FormatUint(size, 10)
+	case size < 1<<20:
+		return fmt.Sprintf("%dKB", size>>10)
+	case size < 1<<30:
+		return fmt.Sprintf("%dMB", size>>20)
+	}
+	return fmt.Sprintf("%dGB", size>>30)
+}
+
+// sizeCapacity returns the capacity in the volume status of a volume of size, as in the size option
+func sizeCapacity(size string) (string, error) {
+	units := map[string]uint{"mb": 20, "gb": 30, "tb": 40}
+	size = strings.ToLower(size)
+	if len(size) > 2 {
+		if shift, exists := units[size[len(size)-2:]]; exists {
+			if value, err := strconv.ParseUint(size[:len(size)-2], 10, 64); err == nil {
+				return formatCapacity(value << shift), nil
+			}
+		}
+	}
+	return "", fmt.Errorf("Invalid size %q", size)
+}
+
+// checkCreatedOptions returns an error if the create options opts differ from the options
+// in status of the existing volume. Copies keep the options of the source, so only
+// options given for a copy are compared.
+func checkCreatedOptions(name string, opts map[string]string, status map[string]interface{}) error {
+	conflict := func(option string, existing interface{}, requested interface{}) error {
+		return fmt.Errorf("Volume %s already exists with %s %v, not %v", name, option, existing, requested)
+	}
+	copied := isCopy(opts)
+
+	options := make([]string, 0, len(statusOptions))
+	for option := range statusOptions {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+	for _, option := range options {
+		requested, given := opts[option]
+		if !given && copied {
+			continue
+		}
+		if !given {
+			requested = statusOptions[option]
+		}
+		existing, exists := status[option].(string)
+		if !exists {
+			existing = statusOptions[option]
+		}
+		if existing != requested {
+			return conflict(option, existing, requested)
+		}
+	}
+
+	if size, given := opts[sizeKey]; given || !copied {
+		if !given {
+			size = defaultSize
+		}
+		requested, err := sizeCapacity(size)
+		if err != nil {
+			return err
+		}
+		capacity, _ := status[capacityKey].(map[string]interface{})
+		if existing, _ := capacity[sizeKey].(string); !strings.EqualFold(existing, requested) {
+			return conflict(sizeKey, existing, requested)
+		}
+	}
+
+	if labels, given := opts[labelsKey]; given || !copied {
+		requested, err := parseLabels(labels)
+		if err != nil {
+			return err
+		}
+		existing := make(map[string]string)
+		statusLabels, _ := status[labelsKey].(map[string]interface{})
+		for key, value := range statusLabels {
+			existing[key] = fmt.Sprint(value)
+		}
+		if !reflect.DeepEqual(existing, requested) {
+			return conflict(labelsKey, existing, requested)
+		}
+	}
+	return nil
+}
+
+// adoptVolume makes the create of volume r.Name which exists already succeed, if the volume
+// has the requested options. Creates the filesystem of the volume if it has none.
+func (d *VolumeDriver) adoptVolume(r volume.Request, progress func(step string)) error {
+	status, err := d.GetVolume(r.Name)
+	if err != nil {
+		return err
+	}
+	if err = checkCreatedOptions(r.Name, r.Options, status); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"name": r.Name}).Info("Volume exists with the requested options ")
+
+	// Copies have the filesystem of the source, block-mode volumes have none
+	encrypted := r.Options[plugin_utils.EncryptionKey] == plugin_utils.EncryptionLuks
+	blockMode := r.Options[plugin_utils.VolumeModeKey] == plugin_utils.VolumeModeBlock
+	if isCopy(r.Options) || (blockMode && !encrypted) {
+		return nil
+	}
+	if d.GetRefCount(d.fullName(r.Name)) != 0 {
+		// In use on this host, so it has a filesystem
+		return nil
+	}
+
+	progress(stepAttach)
+	waitCtx, errWait := fs.DevAttachWaitPrep()
+	if errWait != nil {
+		log.WithFields(log.Fields{"name": r.Name,
+			"error": errWait}).Warning("Failed to initialize wait context, continuing however.. ")
+	}
+	volDev, err := d.ops.AttachContext(d.ctx, r.Name, nil)
+	if err != nil {
+		if status["status"] == "attached" {
+			log.WithFields(log.Fields{"name": r.Name, "error": err}).Warning(
+				"Volume is attached to another VM, not checking its filesystem ")
+			return nil
+		}
+		return err
+	}
+	if errWait != nil {
+		fs.DevAttachWaitFallback()
+	} else if err = fs.DevAttachWait(waitCtx, volDev); err != nil {
+		d.detach(r.Name)
+		return err
+	}
+
+	progress(stepMkfs)
+	if err = d.finishFilesystem(r.Name, volDev, r.Options); err != nil {
+		d.detach(r.Name)
+		return err
+	}
+
+	progress(stepDetach)
+	return d.ops.DetachContext(d.ctx, r.Name, nil)
+}
+
+// finishFilesystem creates the filesystem on attached volDev of volume name, as in the
+// create options opts, if the volume has none. Encrypted volumes are encrypted first
+// if they are not.
+func (d *VolumeDriver) finishFilesystem(name string, volDev *fs.VolumeDevSpec, opts map[string]string) error {
+	fstype, err := fs.GetFsType(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to check filesystem, assuming it exists ")
+		return nil
+	}
+	encrypted := opts[plugin_utils.EncryptionKey] == plugin_utils.EncryptionLuks
+	switch {
+	case fstype == "" && encrypted:
+		log.WithFields(log.Fields{"name": name}).Warning("Volume is not encrypted, encrypting it ")
+		return d.mkfsEncrypted(name, volDev, opts)
+	case fstype == "":
+		log.WithFields(log.Fields{"name": name, "fstype": opts["fstype"]}).Warning("Volume has no filesystem, creating it ")
+		return fs.Mkfs(opts["fstype"], name, volDev, opts["mkfs-opts"])
+	case !encrypted || opts[plugin_utils.VolumeModeKey] == plugin_utils.VolumeModeBlock:
+		return nil
+	case fstype != fs.LuksFsType:
+		return fmt.Errorf("Volume %s has %s on it, it is not encrypted", name, fstype)
+	}
+
+	// Encrypted, the filesystem is on the opened device
+	key, err := d.volumeKey(name, opts[plugin_utils.EncryptionKeyIDKey])
+	if err != nil {
+		return err
+	}
+	mapper := fs.LuksMapperName(name)
+	device, err := fs.LuksOpen(volDev, mapper, key, false)
+	if err != nil {
+		return err
+	}
+	defer fs.LuksClose(mapper)
+	if fstype, err = fs.GetFsTypeByDevicePath(device); err != nil || fstype != "" {
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "fstype": opts["fstype"]}).Warning("Volume has no filesystem, creating it ")
+	return fs.MkfsByDevicePath(opts["fstype"], name, device, opts["mkfs-opts"])
+}
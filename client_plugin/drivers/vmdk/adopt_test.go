@@ -0,0 +1,66 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeCapacity(t *testing.T) {
+	sizes := map[string]string{"100mb": "100MB", "1GB": "1GB", "1500mb": "1GB", "2tb": "2048GB"}
+	for size, capacity := range sizes {
+		formatted, err := sizeCapacity(size)
+		assert.Nil(t, err, size)
+		assert.Equal(t, capacity, formatted, size)
+	}
+	for _, bad := range []string{"", "mb", "10", "10kb", "tenmb"} {
+		_, err := sizeCapacity(bad)
+		assert.NotNil(t, err, "Expected %q to be refused", bad)
+	}
+}
+
+func TestCheckCreatedOptions(t *testing.T) {
+	status := map[string]interface{}{
+		"capacity":   map[string]interface{}{"size": "10GB", "allocated": "150MB"},
+		"diskformat": "thin",
+		"attach-as":  "independent_persistent",
+		"access":     "read-write",
+		"fstype":     "ext4",
+		"clone-from": "None",
+		"labels":     map[string]interface{}{"app": "web"},
+		"status":     "detached",
+	}
+	opts := map[string]string{"size": "10gb", "fstype": "ext4", "labels": "app=web"}
+	assert.Nil(t, checkCreatedOptions("vol1", opts, status))
+
+	conflicts := []map[string]string{
+		{"size": "20gb", "fstype": "ext4", "labels": "app=web"},
+		{"size": "10gb", "fstype": "xfs", "labels": "app=web"},
+		{"size": "10gb", "fstype": "ext4"},
+		{"size": "10gb", "fstype": "ext4", "labels": "app=web", "access": "read-only"},
+		{"fstype": "ext4", "labels": "app=web"},
+	}
+	for _, opts := range conflicts {
+		assert.NotNil(t, checkCreatedOptions("vol1", opts, status), "Expected %v to conflict", opts)
+	}
+
+	// Copies keep the options of the source, only given ones are compared
+	status["clone-from"] = "vol0"
+	assert.Nil(t, checkCreatedOptions("vol1", map[string]string{"clone-from": "vol0"}, status))
+	assert.NotNil(t, checkCreatedOptions("vol1", map[string]string{"clone-from": "vol2"}, status))
+	assert.NotNil(t, checkCreatedOptions("vol1", map[string]string{"clone-from": "vol0", "access": "read-only"}, status))
+}
@@ -0,0 +1,266 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Asynchronous volume creation.
+//
+// With "async" option Create returns as soon as the request is validated, and the
+// volume is created, formatted and detached in background. Each create in progress
+// is kept in a task file, so it is resumed after plugin restart. ESX service
+// treats create of an existing volume as success, so a resumed create starts over.
+// Get reports the progress in the volume status, Mount waits for the create to complete.
+// A failed task is kept until the volume is removed, for Get and Mount to report the error.
+
+package vmdk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	asyncOption   = "async" // create option, handled by the plugin only
+	taskExtension = ".json"
+
+	// Steps of volume creation, as reported in the volume status
+	stepCreate = "creating"
+	stepAttach = "attaching"
+	stepMkfs   = "formatting"
+	stepDetach = "detaching"
+	stepFailed = "failed"
+
+	// Keys in the volume status
+	createStatusKey   = "create-status"
+	createProgressKey = "create-progress"
+	createErrorKey    = "create-error"
+)
+
+// createTask is the persisted state of an asynchronous create
+type createTask struct {
+	Name    string
+	Options map[string]string
+	Step    string
+	Error   string `json:",omitempty"`
+	Started time.Time
+	Updated time.Time
+}
+
+// createTasks keeps asynchronous creates in progress and the failed ones
+type createTasks struct {
+	mtx   *sync.Mutex
+	dir   string                   // task files are kept here
+	tasks map[string]*createTask   // by volume name
+	done  map[string]chan struct{} // closed when the task completes or fails
+}
+
+// newCreateTasks returns createTasks persisted in dir
+func newCreateTasks(dir string) *createTasks {
+	return &createTasks{
+		mtx:   &sync.Mutex{},
+		dir:   dir,
+		tasks: make(map[string]*createTask),
+		done:  make(map[string]chan struct{}),
+	}
+}
+
+// popAsyncOption removes the async option from create options and tells whether it is set
+func popAsyncOption(opts map[string]string) (bool, error) {
+	value, exists := opts[asyncOption]
+	if !exists {
+		return false, nil
+	}
+	delete(opts, asyncOption)
+	async, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("Invalid value %q for option %s, expected true or false", value, asyncOption)
+	}
+	return async, nil
+}
+
+func (c *createTasks) taskFile(name string) string {
+	return filepath.Join(c.dir, name+taskExtension)
+}
+
+// save writes the task file, replacing the previous one atomically
+func (c *createTasks) save(task *createTask) error {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	tmp := c.taskFile(task.Name) + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.taskFile(task.Name))
+}
+
+// load reads task files left by the previous plugin run, and returns
+// the tasks which were in progress and need to be resumed
+func (c *createTasks) load() ([]createTask, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create directory %s for create tasks: %v", c.dir, err)
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var resume []createTask
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), taskExtension) {
+			continue
+		}
+		path := filepath.Join(c.dir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		var task createTask
+		if err == nil {
+			err = json.Unmarshal(data, &task)
+		}
+		if err != nil || task.Name == "" {
+			log.WithFields(log.Fields{"file": path, "error": err}).Warning("Ignoring unreadable create task file ")
+			continue
+		}
+		c.tasks[task.Name] = &task
+		c.done[task.Name] = make(chan struct{})
+		if task.Step == stepFailed {
+			close(c.done[task.Name])
+		} else {
+			resume = append(resume, task)
+		}
+	}
+	return resume, nil
+}
+
+// start records a new create task for volume name
+func (c *createTasks) start(name string, opts map[string]string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if _, exists := c.tasks[name]; exists {
+		return fmt.Errorf("Volume %s is already being created, or its creation failed", name)
+	}
+	now := time.Now()
+	task := &createTask{Name: name, Options: opts, Step: stepCreate, Started: now, Updated: now}
+	if err := c.save(task); err != nil {
+		return fmt.Errorf("Failed to save create task for volume %s: %v", name, err)
+	}
+	c.tasks[name] = task
+	c.done[name] = make(chan struct{})
+	return nil
+}
+
+// update records the step the task of volume name is at
+func (c *createTasks) update(name string, step string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	task, exists := c.tasks[name]
+	if !exists {
+		return
+	}
+	task.Step = step
+	task.Updated = time.Now()
+	if err := c.save(task); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save create task ")
+	}
+}
+
+// fail records the failure of the task of volume name
+func (c *createTasks) fail(name string, errMsg string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	task, exists := c.tasks[name]
+	if !exists {
+		return
+	}
+	task.Step = stepFailed
+	task.Error = errMsg
+	task.Updated = time.Now()
+	if err := c.save(task); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to save create task ")
+	}
+	close(c.done[name])
+}
+
+// finish forgets the completed task of volume name
+func (c *createTasks) finish(name string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	task, exists := c.tasks[name]
+	if !exists {
+		return
+	}
+	if task.Step != stepFailed {
+		// failed tasks are over already
+		close(c.done[name])
+	}
+	delete(c.tasks, name)
+	delete(c.done, name)
+	if err := os.Remove(c.taskFile(name)); err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to remove create task file ")
+	}
+}
+
+// get returns a copy of the task of volume name, and the channel closed when the task is over
+func (c *createTasks) get(name string) (createTask, chan struct{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	task, exists := c.tasks[name]
+	if !exists {
+		return createTask{}, nil, false
+	}
+	return *task, c.done[name], true
+}
+
+// inProgress returns the volumes of the tasks which did not fail, including those
+// loaded and not resumed yet
+func (c *createTasks) inProgress() []string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var names []string
+	for name, task := range c.tasks {
+		if task.Step != stepFailed {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// status returns the progress of the task for the volume status
+func (task createTask) status() map[string]interface{} {
+	inStep := time.Since(task.Updated) / time.Second * time.Second
+	total := time.Since(task.Started) / time.Second * time.Second
+	status := map[string]interface{}{
+		createStatusKey:   task.Step,
+		createProgressKey: fmt.Sprintf("%s for %v, started %v ago", task.Step, inStep, total),
+	}
+	if task.Error != "" {
+		status[createErrorKey] = task.Error
+	}
+	return status
+}
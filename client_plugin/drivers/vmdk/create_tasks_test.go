@@ -0,0 +1,78 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateTasksPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "create-tasks")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	tasks := newCreateTasks(dir)
+	_, err = tasks.load()
+	assert.Nil(t, err)
+	assert.Nil(t, tasks.start("vol1", map[string]string{"size": "100gb"}))
+	assert.Nil(t, tasks.start("vol2", nil))
+	assert.NotNil(t, tasks.start("vol1", nil), "Second create of the same volume should fail")
+	tasks.update("vol1", stepMkfs)
+	tasks.fail("vol2", "no space")
+
+	_, done, exists := tasks.get("vol2")
+	if assert.True(t, exists) {
+		<-done // closed on failure
+	}
+
+	// After restart the task in progress is resumed, the failed one is kept
+	restarted := newCreateTasks(dir)
+	resume, err := restarted.load()
+	assert.Nil(t, err)
+	if assert.Len(t, resume, 1) {
+		assert.Equal(t, "vol1", resume[0].Name)
+		assert.Equal(t, stepMkfs, resume[0].Step)
+		assert.Equal(t, "100gb", resume[0].Options["size"])
+	}
+	assert.Equal(t, []string{"vol1"}, restarted.inProgress(), "Volume to resume should be in progress")
+	task, _, exists := restarted.get("vol2")
+	assert.True(t, exists)
+	assert.Equal(t, "no space", task.status()[createErrorKey])
+
+	restarted.finish("vol1")
+	restarted.finish("vol2")
+	_, _, exists = restarted.get("vol1")
+	assert.False(t, exists)
+	resume, err = newCreateTasks(dir).load()
+	assert.Nil(t, err)
+	assert.Empty(t, resume)
+}
+
+func TestPopAsyncOption(t *testing.T) {
+	opts := map[string]string{"async": "true", "size": "1gb"}
+	async, err := popAsyncOption(opts)
+	assert.Nil(t, err)
+	assert.True(t, async)
+	assert.Equal(t, map[string]string{"size": "1gb"}, opts)
+
+	_, err = popAsyncOption(map[string]string{"async": "soon"})
+	assert.NotNil(t, err)
+}
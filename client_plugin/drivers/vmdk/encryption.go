@@ -0,0 +1,109 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Volumes encrypted in the guest.
+//
+// A volume created with "encryption=luks" is formatted with LUKS before the
+// filesystem is created, and opened with the key of the volume on each mount.
+// The filesystem is mounted from, or the block-mode volume exposed as, the
+// opened device-mapper device, which is closed on unmount. Keys come from the
+// key provider in the config, and never leave the guest. They are looked up by
+// the name of the volume without datastore, which is kept as the key identity
+// in the volume metadata so clones and snapshots use the key of their source.
+
+package vmdk
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+)
+
+// volumeKey returns the key of encrypted volume name by its key identity id, by the volume
+// name if id is empty
+func (d *VolumeDriver) volumeKey(name string, id string) ([]byte, error) {
+	if d.keys == nil {
+		return nil, errors.New("No key provider configured for encrypted volumes")
+	}
+	if id == "" {
+		// Keys are by volume name, whether or not the datastore is given
+		id = strings.Split(name, "@")[0]
+	}
+	return d.keys.Key(id)
+}
+
+// checkEncryption validates the encryption option, and that the new volume can be encrypted
+// on this host. Copies keep the encryption of the source.
+func (d *VolumeDriver) checkEncryption(name string, opts map[string]string) error {
+	if _, exists := opts[plugin_utils.EncryptionKeyIDKey]; exists {
+		return fmt.Errorf("Option %s cannot be set, keys are looked up by the volume name",
+			plugin_utils.EncryptionKeyIDKey)
+	}
+	encryption, exists := opts[plugin_utils.EncryptionKey]
+	if !exists {
+		return nil
+	}
+	if isCopy(opts) {
+		return fmt.Errorf("Option %s cannot be used with %s, copies keep the encryption of the source",
+			plugin_utils.EncryptionKey, strings.Join(copyOptions, ", "))
+	}
+	if encryption != plugin_utils.EncryptionLuks {
+		return fmt.Errorf("Invalid value %q for option %s, valid value is %s", encryption,
+			plugin_utils.EncryptionKey, plugin_utils.EncryptionLuks)
+	}
+	if err := fs.VerifyLuksSupport(); err != nil {
+		return err
+	}
+	// Fail now rather than after the volume is created
+	_, err := d.volumeKey(name, "")
+	return err
+}
+
+// mkfsEncrypted encrypts the attached volDev of new volume name, and creates
+// the filesystem on the opened device unless the volume is block-mode.
+func (d *VolumeDriver) mkfsEncrypted(name string, volDev *fs.VolumeDevSpec, opts map[string]string) error {
+	key, err := d.volumeKey(name, opts[plugin_utils.EncryptionKeyIDKey])
+	if err != nil {
+		return err
+	}
+	if err = fs.LuksFormat(volDev, key); err != nil {
+		return err
+	}
+	if opts[plugin_utils.VolumeModeKey] == plugin_utils.VolumeModeBlock {
+		return nil
+	}
+
+	mapper := fs.LuksMapperName(name)
+	device, err := fs.LuksOpen(volDev, mapper, key, false)
+	if err != nil {
+		return err
+	}
+	defer fs.LuksClose(mapper)
+	return fs.MkfsByDevicePath(opts["fstype"], name, device, opts["mkfs-opts"])
+}
+
+// closeEncrypted closes the device-mapper device of volume name if it is open
+func (d *VolumeDriver) closeEncrypted(name string) {
+	mapper := fs.LuksMapperName(name)
+	if !fs.LuksIsOpen(mapper) {
+		return
+	}
+	if err := fs.LuksClose(mapper); err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to close encrypted volume ")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/keyprovider"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+)
+
+func TestVolumeKey(t *testing.T) {
+	d := &VolumeDriver{}
+	_, err := d.volumeKey("vol1", "")
+	assert.NotNil(t, err, "No key expected without key provider")
+
+	d.keys, _ = keyprovider.New(keyprovider.EnvProvider, "")
+	os.Setenv(keyprovider.EnvKeyVar, "secret")
+	defer os.Unsetenv(keyprovider.EnvKeyVar)
+	key, err := d.volumeKey("vol1@datastore1", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(key))
+}
+
+func TestVolumeKeyIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "vol1"), []byte("secret1"), 0600))
+
+	d := &VolumeDriver{}
+	d.keys, _ = keyprovider.New(keyprovider.FileProvider, dir)
+	_, err = d.volumeKey("clone1", "")
+	assert.NotNil(t, err, "Copies have no key of their own")
+	key, err := d.volumeKey("clone1@datastore1", "vol1")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret1", string(key), "Copies use the key of their source")
+}
+
+func TestCheckEncryption(t *testing.T) {
+	d := &VolumeDriver{}
+	assert.Nil(t, d.checkEncryption("vol1", map[string]string{}), "Unencrypted volumes need no key")
+
+	for _, opts := range []map[string]string{
+		{plugin_utils.EncryptionKey: "aes"},
+		{plugin_utils.EncryptionKey: plugin_utils.EncryptionLuks, "clone-from": "vol2"},
+		{plugin_utils.EncryptionKeyIDKey: "vol2"},
+		{plugin_utils.EncryptionKey: plugin_utils.EncryptionLuks}, // no key provider
+	} {
+		assert.NotNil(t, d.checkEncryption("vol1", opts), "Options %v should be refused", opts)
+	}
+}
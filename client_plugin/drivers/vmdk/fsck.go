@@ -0,0 +1,93 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Filesystem check before mount.
+//
+// A volume detached uncleanly, e.g. on ESX host crash, may come back with a damaged
+// filesystem. With FsckPolicy check-only or auto-repair the filesystem is checked
+// after attach, and the mount is refused if errors are left, instead of failing with
+// an opaque mount error or mounting an inconsistent filesystem. Read-only volumes
+// are only checked. The last check is reported in the volume status.
+
+package vmdk
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	// Keys in the volume status
+	fsckResultKey  = "fsck-result"
+	fsckPolicyKey  = "fsck-policy"
+	fsckLastRunKey = "fsck-last-run"
+	fsckErrorKey   = "fsck-error"
+)
+
+// fsckResult is the outcome of the last filesystem check of a volume
+type fsckResult struct {
+	policy  string
+	result  string
+	lastRun time.Time
+	err     error
+}
+
+// status returns the check for the volume status
+func (r fsckResult) status() map[string]interface{} {
+	status := map[string]interface{}{
+		fsckResultKey:  r.result,
+		fsckPolicyKey:  r.policy,
+		fsckLastRunKey: r.lastRun.Format(time.RFC3339),
+	}
+	if r.err != nil {
+		status[fsckErrorKey] = r.err.Error()
+	}
+	return status
+}
+
+// validFsckPolicy returns policy if it is valid, FsckNone otherwise
+func validFsckPolicy(policy string) string {
+	for _, valid := range fs.FsckPolicies {
+		if policy == valid {
+			return policy
+		}
+	}
+	log.WithFields(log.Fields{"policy": policy, "valid": fs.FsckPolicies}).Error(
+		"Invalid FsckPolicy, filesystems won't be checked before mount ")
+	return fs.FsckNone
+}
+
+// checkFs runs fsck on the attached volume name as the fsck policy says and records the result.
+// Returns an error if the volume must not be mounted.
+func (d *VolumeDriver) checkFs(name string, isReadOnly bool, fsck func(policy string) (string, error)) error {
+	policy := d.fsckPolicy
+	if policy == fs.FsckNone {
+		return nil
+	}
+	if isReadOnly && policy == fs.FsckAutoRepair {
+		policy = fs.FsckCheckOnly
+	}
+
+	result, err := fsck(policy)
+	d.status.set(opFsck, name, fsckResult{policy: policy, result: result, lastRun: time.Now(), err: err})
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "policy": policy, "error": err}).Error("Filesystem check failed ")
+		return fmt.Errorf("Refusing to mount volume %s, filesystem check failed: %v", name, err)
+	}
+	log.WithFields(log.Fields{"name": name, "policy": policy, "result": result}).Info("Filesystem checked ")
+	return nil
+}
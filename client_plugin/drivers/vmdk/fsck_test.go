@@ -0,0 +1,59 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+func TestCheckFs(t *testing.T) {
+	d := &VolumeDriver{fsckPolicy: fs.FsckNone, status: newStatusStore()}
+	called := false
+	fsck := func(policy string) (string, error) {
+		called = true
+		return fs.FsckPassed, nil
+	}
+	assert.Nil(t, d.checkFs("vol1", false, fsck))
+	assert.False(t, called, "No check expected with policy none")
+	assert.Empty(t, d.status.status("vol1"))
+
+	// Read-only volumes are never repaired
+	d.fsckPolicy = fs.FsckAutoRepair
+	err := d.checkFs("vol1", true, func(policy string) (string, error) {
+		assert.Equal(t, fs.FsckCheckOnly, policy)
+		return fs.FsckFailed, errors.New("bad superblock")
+	})
+	assert.NotNil(t, err, "Mount should be refused when the check fails")
+	status := d.status.status("vol1")
+	assert.Equal(t, fs.FsckFailed, status[fsckResultKey])
+	assert.Equal(t, fs.FsckCheckOnly, status[fsckPolicyKey])
+	assert.Equal(t, "bad superblock", status[fsckErrorKey])
+
+	assert.Nil(t, d.checkFs("vol1", false, func(policy string) (string, error) {
+		assert.Equal(t, fs.FsckAutoRepair, policy)
+		return fs.FsckRepaired, nil
+	}))
+	assert.Equal(t, fs.FsckRepaired, d.status.status("vol1")[fsckResultKey])
+	assert.NotContains(t, d.status.status("vol1"), fsckErrorKey)
+}
+
+func TestValidFsckPolicy(t *testing.T) {
+	assert.Equal(t, fs.FsckCheckOnly, validFsckPolicy(fs.FsckCheckOnly))
+	assert.Equal(t, fs.FsckNone, validFsckPolicy("always"))
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// I/O limits of volumes.
+//
+// A volume created with "iops-limit" or "bps-limit" has its device throttled in
+// IoCgroup on each mount, so containers using it can't starve other volumes on
+// the datastore. Limits are read from the volume metadata, so changed limits take
+// effect on the next mount. A failure to set the limits doesn't fail the mount,
+// it is reported in the volume status with the limits in effect.
+
+package vmdk
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	// Volume options and metadata keys
+	iopsLimitKey = "iops-limit"
+	bpsLimitKey  = "bps-limit"
+
+	// Keys in the volume status
+	ioLimitsIopsKey  = "io-limits-iops"
+	ioLimitsBpsKey   = "io-limits-bps"
+	ioLimitsErrorKey = "io-limits-error"
+)
+
+// ioLimitsResult is the outcome of setting the I/O limits of a mounted volume
+type ioLimitsResult struct {
+	limits fs.IoLimits
+	err    error
+}
+
+// status returns the limits in effect for the volume status
+func (r ioLimitsResult) status() map[string]interface{} {
+	if r.err != nil {
+		return map[string]interface{}{ioLimitsErrorKey: r.err.Error()}
+	}
+	return map[string]interface{}{
+		ioLimitsIopsKey: r.limits.Iops,
+		ioLimitsBpsKey:  r.limits.Bps,
+	}
+}
+
+// ioLimitsOf returns the I/O limits in the volume metadata
+func ioLimitsOf(volumeMeta map[string]interface{}) (fs.IoLimits, error) {
+	iops, _ := volumeMeta[iopsLimitKey].(string)
+	bps, _ := volumeMeta[bpsLimitKey].(string)
+	return fs.ParseIoLimits(iops, bps)
+}
+
+// limitIo sets the I/O limits in volumeMeta for mounted volume name with setLimits.
+// Failures are logged and reported in the volume status.
+func (d *VolumeDriver) limitIo(name string, volumeMeta map[string]interface{}, setLimits func(fs.IoLimits) error) {
+	limits, err := ioLimitsOf(volumeMeta)
+	if err == nil && !limits.IsSet() {
+		return
+	}
+	if err == nil {
+		err = setLimits(limits)
+	}
+	d.status.set(opIoLimits, name, ioLimitsResult{limits: limits, err: err})
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to set I/O limits, mounting without ")
+		return
+	}
+	log.WithFields(log.Fields{"name": name, "iops": limits.Iops, "bps": limits.Bps}).Info("I/O limits set ")
+}
+
+// unlimitIo removes the I/O limits of volume name before unmount, so they don't
+// apply to another disk getting the same device number.
+func (d *VolumeDriver) unlimitIo(name string) {
+	if result, exists := d.status.remove(opIoLimits, name); !exists || result.(ioLimitsResult).err != nil {
+		// No limits were set
+		return
+	}
+	var devices map[string]string
+	var err error
+	if fs.HasBlockDevice(d.GetMountPoint(name)) {
+		devices, err = fs.GetBlockDevices(d.MountRoot)
+	} else {
+		devices, err = fs.GetMountInfo(d.MountRoot)
+	}
+	if device, mounted := devices[name]; err == nil && mounted {
+		err = fs.SetIoLimitsByDevicePath(device, d.ioCgroup, fs.IoLimits{})
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to remove I/O limits ")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+func TestLimitIo(t *testing.T) {
+	d := &VolumeDriver{status: newStatusStore()}
+	called := false
+	setLimits := func(limits fs.IoLimits) error {
+		called = true
+		return nil
+	}
+	d.limitIo("vol1", map[string]interface{}{}, setLimits)
+	assert.False(t, called, "No limits expected without iops-limit and bps-limit")
+	assert.Empty(t, d.status.status("vol1"))
+
+	meta := map[string]interface{}{iopsLimitKey: "500", bpsLimitKey: "1mb"}
+	d.limitIo("vol1", meta, func(limits fs.IoLimits) error {
+		assert.Equal(t, fs.IoLimits{Iops: 500, Bps: 1024 * 1024}, limits)
+		return nil
+	})
+	status := d.status.status("vol1")
+	assert.Equal(t, uint64(500), status[ioLimitsIopsKey])
+	assert.Equal(t, uint64(1024*1024), status[ioLimitsBpsKey])
+
+	d.limitIo("vol2", meta, func(limits fs.IoLimits) error {
+		return errors.New("no io controller")
+	})
+	assert.Equal(t, "no io controller", d.status.status("vol2")[ioLimitsErrorKey])
+	result, _ := d.status.remove(opIoLimits, "vol2")
+	assert.NotNil(t, result.(ioLimitsResult).err, "Volume without limits set should have none to remove")
+	result, _ = d.status.remove(opIoLimits, "vol1")
+	assert.Nil(t, result.(ioLimitsResult).err)
+	assert.Empty(t, d.status.status("vol1"))
+}
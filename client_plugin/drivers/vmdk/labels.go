@@ -0,0 +1,142 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Volume labels.
+//
+// Docker keeps the labels given on create to itself, so volumes are labeled with
+// the "labels" option, e.g. "labels=app=web,team=infra". Labels are stored in the
+// volume metadata on ESX, so they are seen from all hosts, and returned in the
+// volume status. ListVolumesByLabels lists the volumes matching a selector.
+
+package vmdk
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const (
+	// Volume option, metadata key and list attribute
+	labelsKey = "labels"
+)
+
+var (
+	// Keys and values as accepted by ESX service
+	labelKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[A-Za-z0-9._/-]*$`)
+)
+
+// parseLabels parses labels given as comma separated key=value pairs, no labels if empty
+func parseLabels(labels string) (map[string]string, error) {
+	parsed := make(map[string]string)
+	if labels == "" {
+		return parsed, nil
+	}
+	for _, label := range strings.Split(labels, ",") {
+		pair := strings.SplitN(label, "=", 2)
+		if len(pair) != 2 || !labelKeyPattern.MatchString(pair[0]) || !labelValuePattern.MatchString(pair[1]) {
+			return nil, fmt.Errorf("Invalid label %q in option %s, valid labels are comma separated "+
+				"key=value pairs, e.g. app=web,team=infra", label, labelsKey)
+		}
+		parsed[pair[0]] = pair[1]
+	}
+	return parsed, nil
+}
+
+// labelRequirement is a condition on a label of a selector
+type labelRequirement struct {
+	key    string
+	value  string
+	equals bool // the label has value, or has not if false
+	exists bool // the label is set, or not if false, whatever its value
+	any    bool // only whether the label is set matters
+}
+
+// labelSelector selects the volumes with labels matching all its requirements
+type labelSelector []labelRequirement
+
+// parseLabelSelector parses comma separated requirements, each one of
+// key=value, key!=value, key (label set) or !key (label not set).
+// An empty selector selects all volumes.
+func parseLabelSelector(selector string) (labelSelector, error) {
+	var parsed labelSelector
+	if selector == "" {
+		return parsed, nil
+	}
+	for _, term := range strings.Split(selector, ",") {
+		var req labelRequirement
+		if pair := strings.SplitN(term, "!=", 2); len(pair) == 2 {
+			req = labelRequirement{key: pair[0], value: pair[1], equals: false}
+		} else if pair = strings.SplitN(term, "=", 2); len(pair) == 2 {
+			req = labelRequirement{key: pair[0], value: pair[1], equals: true}
+		} else if strings.HasPrefix(term, "!") {
+			req = labelRequirement{key: term[1:], exists: false, any: true}
+		} else {
+			req = labelRequirement{key: term, exists: true, any: true}
+		}
+		if !labelKeyPattern.MatchString(req.key) || !labelValuePattern.MatchString(req.value) {
+			return nil, fmt.Errorf("Invalid label selector %q, valid requirements are comma separated "+
+				"key=value, key!=value, key or !key", term)
+		}
+		parsed = append(parsed, req)
+	}
+	return parsed, nil
+}
+
+// matches tells whether labels meet all requirements of the selector
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, req := range s {
+		value, exists := labels[req.key]
+		if req.any {
+			if exists != req.exists {
+				return false
+			}
+		} else if (exists && value == req.value) != req.equals {
+			return false
+		}
+	}
+	return true
+}
+
+// ListVolumesByLabels lists the volumes with labels matching selector, with their labels in the status.
+func (d *VolumeDriver) ListVolumesByLabels(selector string) ([]*volume.Volume, error) {
+	sel, err := parseLabelSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := d.ops.ListContext(d.ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
+		return nil, err
+	}
+	selected := make([]*volume.Volume, 0, len(volumes))
+	for _, vol := range volumes {
+		labels, err := parseLabels(vol.Attributes[labelsKey])
+		if err != nil {
+			log.WithFields(log.Fields{"name": vol.Name, "error": err}).Warning("Ignoring volume with invalid labels ")
+			continue
+		}
+		if !sel.matches(labels) {
+			continue
+		}
+		selected = append(selected, &volume.Volume{Name: normalizeVolumeName(vol.Name),
+			Mountpoint: d.GetMountPoint(vol.Name),
+			Status:     map[string]interface{}{labelsKey: labels}})
+	}
+	return selected, nil
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels("")
+	assert.Nil(t, err)
+	assert.Empty(t, labels)
+
+	labels, err = parseLabels("app=web,team=infra,com.example/tier=")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"app": "web", "team": "infra", "com.example/tier": ""}, labels)
+
+	for _, bad := range []string{"app", "app=web,", "=web", "app=a=b", "app=web app"} {
+		_, err = parseLabels(bad)
+		assert.NotNil(t, err, "Expected %q to be refused", bad)
+	}
+}
+
+func TestLabelSelector(t *testing.T) {
+	labels := map[string]string{"app": "web", "team": "infra"}
+	matching := []string{"", "app=web", "app=web,team=infra", "app!=db", "owner!=bob", "team", "!owner"}
+	for _, selector := range matching {
+		sel, err := parseLabelSelector(selector)
+		assert.Nil(t, err, selector)
+		assert.True(t, sel.matches(labels), "Expected %q to match", selector)
+	}
+	notMatching := []string{"app=db", "app=web,team=db", "app!=web", "owner", "!team", "owner="}
+	for _, selector := range notMatching {
+		sel, err := parseLabelSelector(selector)
+		assert.Nil(t, err, selector)
+		assert.False(t, sel.matches(labels), "Expected %q not to match", selector)
+	}
+	for _, bad := range []string{"app=web,", "=web", "!", "app=a b"} {
+		_, err := parseLabelSelector(bad)
+		assert.NotNil(t, err, "Expected %q to be refused", bad)
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Placement of volumes named without a datastore.
+//
+// ESX creates volumes named without "@datastore" on the default datastore of the
+// vmgroup. With PlacementPolicy most-free, round-robin or labels the plugin picks
+// the datastore instead, and creates the volume with the datastore in its name.
+// Docker keeps using the name it was given, so the placed name is recorded, and
+// volumes not found on the default datastore are looked up on all datastores,
+// e.g. on other hosts. The decision is logged and reported in the volume status.
+
+package vmdk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+)
+
+const (
+	// Placement policies
+	placementNone       = "none"        // ESX picks the datastore
+	placementMostFree   = "most-free"   // datastore with the most free space
+	placementRoundRobin = "round-robin" // each datastore in turn
+	placementLabels     = "labels"      // datastore by volume label
+
+	// Keys in the volume status
+	placementDatastoreKey = "placement-datastore"
+	placementPolicyKey    = "placement-policy"
+	placementReasonKey    = "placement-reason"
+)
+
+var placementPolicies = []string{placementNone, placementMostFree, placementRoundRobin, placementLabels}
+
+// placement is the datastore a volume named without one is on
+type placement struct {
+	datastore string
+	policy    string // empty if the volume was found there, not placed on this host
+	reason    string
+}
+
+// datastoresByName sorts datastores by name
+type datastoresByName []vmdkops.DatastoreData
+
+func (d datastoresByName) Len() int           { return len(d) }
+func (d datastoresByName) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d datastoresByName) Less(i, j int) bool { return d[i].Name < d[j].Name }
+
+// placements keeps the placement of volumes by the name without datastore
+type placements struct {
+	mtx     *sync.Mutex
+	results map[string]placement
+	next    int // next datastore of round-robin
+}
+
+func newPlacements() *placements {
+	return &placements{
+		mtx:     &sync.Mutex{},
+		results: make(map[string]placement),
+	}
+}
+
+func (p *placements) set(name string, result placement) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.results[name] = result
+}
+
+func (p *placements) get(name string) (placement, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	result, exists := p.results[name]
+	return result, exists
+}
+
+func (p *placements) remove(name string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	delete(p.results, name)
+}
+
+// nextIndex returns the index of the next datastore of round-robin among count
+func (p *placements) nextIndex(count int) int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	index := p.next % count
+	p.next = index + 1
+	return index
+}
+
+// shortName returns the name Docker knows placed volume fullName by, fullName if it wasn't placed
+func (p *placements) shortName(fullName string) string {
+	parts := strings.SplitN(fullName, "@", 2)
+	if len(parts) != 2 {
+		return fullName
+	}
+	if result, exists := p.get(parts[0]); exists && result.datastore == parts[1] {
+		return parts[0]
+	}
+	return fullName
+}
+
+// status returns the placement of volume name for the volume status, nil if it wasn't placed
+func (p *placements) status(name string) map[string]interface{} {
+	result, exists := p.get(name)
+	if !exists {
+		return nil
+	}
+	status := map[string]interface{}{placementDatastoreKey: result.datastore}
+	if result.policy != "" {
+		status[placementPolicyKey] = result.policy
+		status[placementReasonKey] = result.reason
+	}
+	return status
+}
+
+// validPlacementPolicy returns policy if it is valid, placementNone otherwise
+func validPlacementPolicy(policy string) string {
+	for _, valid := range placementPolicies {
+		if policy == valid {
+			return policy
+		}
+	}
+	log.WithFields(log.Fields{"policy": policy, "valid": placementPolicies}).Error(
+		"Invalid PlacementPolicy, volumes will be created on the default datastore ")
+	return placementNone
+}
+
+// placedName returns name with the datastore volume name is placed on, name if it wasn't placed
+func (d *VolumeDriver) placedName(name string) string {
+	if result, exists := d.placements.get(name); exists {
+		return name + "@" + result.datastore
+	}
+	return name
+}
+
+// findPlaced looks for volume name, named without datastore, on all datastores.
+// Records the placement if exactly one datastore has it.
+func (d *VolumeDriver) findPlaced(name string) bool {
+	volumes, err := d.ops.ListContext(d.ctx)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to look for volume on all datastores ")
+		return false
+	}
+	prefix := name + "@"
+	var found []string
+	for _, vol := range volumes {
+		if strings.HasPrefix(vol.Name, prefix) {
+			found = append(found, vol.Name[len(prefix):])
+		}
+	}
+	if len(found) != 1 {
+		if len(found) > 1 {
+			log.WithFields(log.Fields{"name": name, "datastores": found}).Warning(
+				"Volume found on several datastores, use the name with datastore ")
+		}
+		return false
+	}
+	log.WithFields(log.Fields{"name": name, "datastore": found[0]}).Info("Volume found on datastore ")
+	d.placements.set(name, placement{datastore: found[0]})
+	return true
+}
+
+// withPlacedName runs f with the placed name of volume name, and again if the volume
+// isn't found and then is found on another datastore
+func (d *VolumeDriver) withPlacedName(name string, f func(name string) error) error {
+	err := f(d.placedName(name))
+	if vmdkops.KindOf(err) != vmdkops.ErrNotFound || d.placementPolicy == placementNone ||
+		plugin_utils.IsFullVolName(name) {
+		return err
+	}
+	if _, placed := d.placements.get(name); placed || !d.findPlaced(name) {
+		return err
+	}
+	return f(d.placedName(name))
+}
+
+// labelDatastore returns the datastore of the first label in placementLabels, in order, the volume has
+func labelDatastore(placementLabels map[string]string, labels map[string]string) (string, string) {
+	keys := make([]string, 0, len(placementLabels))
+	for label := range placementLabels {
+		keys = append(keys, label)
+	}
+	sort.Strings(keys)
+	for _, label := range keys {
+		pair := strings.SplitN(label, "=", 2)
+		if value, exists := labels[pair[0]]; exists && len(pair) == 2 && value == pair[1] {
+			return placementLabels[label], "label " + label
+		}
+	}
+	return "", ""
+}
+
+// chooseDatastore picks one of candidates as policy most-free or round-robin says.
+// next returns the index of the next datastore of round-robin.
+func chooseDatastore(policy string, candidates []vmdkops.DatastoreData, next func(count int) int) (string, string) {
+	if policy == placementRoundRobin {
+		index := next(len(candidates))
+		return candidates[index].Name, fmt.Sprintf("round-robin, datastore %d of %d", index+1, len(candidates))
+	}
+	best := candidates[0]
+	for _, datastore := range candidates[1:] {
+		if datastore.Free > best.Free {
+			best = datastore
+		}
+	}
+	return best.Name, fmt.Sprintf("most free space, %d of %d bytes free", best.Free, best.Capacity)
+}
+
+// pickDatastore returns the datastore for a new volume with create options opts
+// as the placement policy says, and the reason. No datastore if none fits.
+func (d *VolumeDriver) pickDatastore(opts map[string]string) (string, string, error) {
+	if d.placementPolicy == placementLabels {
+		labels, err := parseLabels(opts[labelsKey])
+		if err != nil {
+			return "", "", err
+		}
+		datastore, reason := labelDatastore(d.placementLabels, labels)
+		return datastore, reason, nil
+	}
+
+	info, err := d.ops.ServerInfoContext(d.ctx)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.HasCapability(vmdkops.CapListDatastores) {
+		return "", "", fmt.Errorf("PlacementPolicy %s is not supported by ESX service (protocol version %s), "+
+			"please upgrade the vDVS driver on ESX", d.placementPolicy, info.Version)
+	}
+	datastores, err := d.ops.ListDatastoresContext(d.ctx)
+	if err != nil {
+		return "", "", err
+	}
+	// Round-robin goes through PlacementDatastores in order, or all datastores by name
+	sort.Sort(datastoresByName(datastores))
+	candidates := datastores
+	if len(d.placementDatastores) > 0 {
+		candidates = nil
+		for _, name := range d.placementDatastores {
+			for _, datastore := range datastores {
+				if datastore.Name == name {
+					candidates = append(candidates, datastore)
+				}
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", "", fmt.Errorf("No datastore in PlacementDatastores %v can be used for volumes",
+			d.placementDatastores)
+	}
+	datastore, reason := chooseDatastore(d.placementPolicy, candidates, d.placements.nextIndex)
+	return datastore, reason, nil
+}
+
+// placeVolume adds the datastore picked by the placement policy to the name of new volume r.Name
+// named without datastore. A volume which exists already keeps its datastore.
+func (d *VolumeDriver) placeVolume(r *volume.Request) error {
+	if d.placementPolicy == placementNone || plugin_utils.IsFullVolName(r.Name) {
+		return nil
+	}
+	if _, err := d.GetVolume(r.Name); err == nil {
+		r.Name = d.placedName(r.Name)
+		return nil
+	}
+
+	datastore, reason, err := d.pickDatastore(r.Options)
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "policy": d.placementPolicy, "error": err}).Error(
+			"Failed to pick datastore ")
+		return err
+	}
+	if datastore == "" {
+		log.WithFields(log.Fields{"name": r.Name, "policy": d.placementPolicy}).Info(
+			"No datastore picked, creating volume on the default datastore ")
+		return nil
+	}
+	log.WithFields(log.Fields{"name": r.Name, "datastore": datastore, "policy": d.placementPolicy,
+		"reason": reason}).Info("Volume placed ")
+	d.placements.set(r.Name, placement{datastore: datastore, policy: d.placementPolicy, reason: reason})
+	r.Name = d.placedName(r.Name)
+	return nil
+}
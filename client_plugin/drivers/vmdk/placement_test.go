@@ -0,0 +1,68 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+func TestChooseDatastore(t *testing.T) {
+	candidates := []vmdkops.DatastoreData{
+		{Name: "ds1", Capacity: 100, Free: 10},
+		{Name: "ds2", Capacity: 100, Free: 50},
+		{Name: "ds3", Capacity: 200, Free: 40},
+	}
+	datastore, _ := chooseDatastore(placementMostFree, candidates, nil)
+	assert.Equal(t, "ds2", datastore)
+
+	p := newPlacements()
+	var picked []string
+	for i := 0; i < 4; i++ {
+		datastore, _ = chooseDatastore(placementRoundRobin, candidates, p.nextIndex)
+		picked = append(picked, datastore)
+	}
+	assert.Equal(t, []string{"ds1", "ds2", "ds3", "ds1"}, picked)
+}
+
+func TestLabelDatastore(t *testing.T) {
+	placementLabels := map[string]string{"tier=gold": "ssd1", "tier=bronze": "hdd1", "team=db": "ssd2"}
+	datastore, reason := labelDatastore(placementLabels, map[string]string{"tier": "gold", "team": "db"})
+	assert.Equal(t, "ssd2", datastore, "labels are matched in order")
+	assert.Equal(t, "label team=db", reason)
+
+	datastore, _ = labelDatastore(placementLabels, map[string]string{"tier": "bronze"})
+	assert.Equal(t, "hdd1", datastore)
+
+	datastore, _ = labelDatastore(placementLabels, map[string]string{"tier": "silver"})
+	assert.Equal(t, "", datastore)
+}
+
+func TestPlacementNames(t *testing.T) {
+	d := &VolumeDriver{placementPolicy: placementMostFree, placements: newPlacements()}
+	assert.Equal(t, "vol1", d.placedName("vol1"))
+	assert.Nil(t, d.placements.status("vol1"))
+
+	d.placements.set("vol1", placement{datastore: "ds2", policy: placementMostFree, reason: "most free space"})
+	assert.Equal(t, "vol1@ds2", d.placedName("vol1"))
+	assert.Equal(t, "vol1", d.placements.shortName("vol1@ds2"))
+	assert.Equal(t, "vol1@ds3", d.placements.shortName("vol1@ds3"))
+	assert.Equal(t, "ds2", d.placements.status("vol1")[placementDatastoreKey])
+
+	assert.Equal(t, placementNone, validPlacementPolicy("fastest"))
+	assert.Equal(t, placementRoundRobin, validPlacementPolicy(placementRoundRobin))
+}
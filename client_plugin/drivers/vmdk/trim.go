@@ -0,0 +1,130 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Space reclamation for thin volumes.
+//
+// Blocks freed by deleting files stay allocated in a thin VMDK until the filesystem
+// discards them. Volumes mounted on this host are trimmed every TrimIntervalSec,
+// and on demand with ReclaimVolume. Volumes mounted with "mount-opts=discard"
+// discard blocks as files are deleted. The last trim is reported in the volume status.
+
+package vmdk
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
+)
+
+const (
+	// Keys in the volume status
+	trimBytesKey   = "trim-bytes"
+	trimLastRunKey = "trim-last-run"
+	trimErrorKey   = "trim-error"
+)
+
+// trimResult is the outcome of the last trim of a volume
+type trimResult struct {
+	bytes   uint64
+	lastRun time.Time
+	err     error
+}
+
+// status returns the trim for the volume status
+func (r trimResult) status() map[string]interface{} {
+	status := map[string]interface{}{
+		trimBytesKey:   r.bytes,
+		trimLastRunKey: r.lastRun.Format(time.RFC3339),
+	}
+	if r.err != nil {
+		status[trimErrorKey] = r.err.Error()
+	}
+	return status
+}
+
+// trimVolume trims the filesystem of volume name mounted on this host. Unmounts of
+// the volume wait for the trim, an unmount in the middle would fail with the volume
+// busy. Other volumes are mounted and unmounted meanwhile.
+func (d *VolumeDriver) trimVolume(name string) error {
+	mountpoint := d.GetMountPoint(name)
+	if err := d.startTrim(name, mountpoint); err != nil {
+		return err
+	}
+
+	trimmed, err := fs.Trim(mountpoint)
+	d.status.finish(opTrim, name, trimResult{bytes: trimmed, lastRun: time.Now(), err: err})
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to trim volume ")
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "bytes": trimmed}).Info("Volume trimmed ")
+	return nil
+}
+
+// startTrim checks volume name is mounted at mountpoint with a filesystem, and records
+// its trim in progress, so an unmount starting from now on waits for the trim
+func (d *VolumeDriver) startTrim(name string, mountpoint string) error {
+	d.RefCounts.StateMtx.Lock()
+	defer d.RefCounts.StateMtx.Unlock()
+
+	if fs.HasBlockDevice(mountpoint) {
+		return fmt.Errorf("Volume %s is a block-mode volume, it has no filesystem to trim", name)
+	}
+	mounts, err := fs.GetMountInfo(d.MountRoot)
+	if err != nil {
+		return err
+	}
+	if _, mounted := mounts[name]; !mounted {
+		return fmt.Errorf("Volume %s is not mounted on this host, only mounted volumes can be trimmed", name)
+	}
+	if !d.status.start(opTrim, name) {
+		return fmt.Errorf("Volume %s is being trimmed already", name)
+	}
+	return nil
+}
+
+// ReclaimVolume releases the unused space of a volume mounted on this host.
+func (d *VolumeDriver) ReclaimVolume(name string) error {
+	log.WithFields(log.Fields{"name": name}).Info("Reclaiming unused space of volume ")
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return err
+	}
+	return d.trimVolume(volumeInfo.VolumeName)
+}
+
+// trimLoop trims the volumes mounted on this host every interval, until plugin shutdown
+func (d *VolumeDriver) trimLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		mounts, err := fs.GetMountInfo(d.MountRoot)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warning("Failed to get mounted volumes to trim ")
+			continue
+		}
+		for name := range mounts {
+			// Failures are logged and reported in the volume status
+			d.trimVolume(name)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrimResultStatus(t *testing.T) {
+	lastRun := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	status := trimResult{bytes: 4096, lastRun: lastRun}.status()
+	assert.Equal(t, uint64(4096), status[trimBytesKey])
+	assert.Equal(t, "2017-06-01T12:00:00Z", status[trimLastRunKey])
+	assert.NotContains(t, status, trimErrorKey)
+
+	status = trimResult{lastRun: lastRun, err: errors.New("not supported")}.status()
+	assert.Equal(t, "not supported", status[trimErrorKey])
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Filesystem usage of volumes.
+//
+// ESX only knows the capacity of a volume, not how full its filesystem is. For
+// volumes mounted on this host the usage of the filesystem is added to the volume
+// status. With UsageWarnPercent set, the usage of mounted volumes is checked every
+// UsageCheckIntervalSec, and a warning is logged when a volume gets fuller than
+// that, and again once it is back under.
+
+package vmdk
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	// Keys in the volume status
+	usedBytesKey   = "used-bytes"
+	freeBytesKey   = "free-bytes"
+	usedInodesKey  = "inodes-used"
+	freeInodesKey  = "inodes-free"
+	percentFullKey = "percent-full"
+)
+
+// usageStatus returns the filesystem usage of volume name for the volume status,
+// nil if the volume has no filesystem mounted on this host.
+func (d *VolumeDriver) usageStatus(name string, mounts map[string]string) map[string]interface{} {
+	if _, mounted := mounts[name]; !mounted {
+		return nil
+	}
+	usage, err := fs.GetFsUsage(d.GetMountPoint(name))
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Warning("Failed to get filesystem usage ")
+		return nil
+	}
+	return map[string]interface{}{
+		usedBytesKey:   usage.UsedBytes,
+		freeBytesKey:   usage.FreeBytes,
+		usedInodesKey:  usage.UsedInodes,
+		freeInodesKey:  usage.FreeInodes,
+		percentFullKey: usage.PercentFull,
+	}
+}
+
+// usageAlerts keeps the volumes fuller than the warning threshold
+type usageAlerts struct {
+	mtx   *sync.Mutex
+	above map[string]bool
+}
+
+func newUsageAlerts() *usageAlerts {
+	return &usageAlerts{
+		mtx:   &sync.Mutex{},
+		above: make(map[string]bool),
+	}
+}
+
+// update records whether volume name is above the threshold, and returns whether it changed
+func (u *usageAlerts) update(name string, above bool) bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	if u.above[name] == above {
+		return false
+	}
+	if above {
+		u.above[name] = true
+	} else {
+		delete(u.above, name)
+	}
+	return true
+}
+
+// names returns the volumes above the threshold
+func (u *usageAlerts) names() map[string]bool {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+	names := make(map[string]bool)
+	for name := range u.above {
+		names[name] = true
+	}
+	return names
+}
+
+// checkUsage logs when volume name crosses the warning threshold percent
+func (d *VolumeDriver) checkUsage(name string, usage fs.FsUsage, percent uint64) {
+	above := usage.PercentFull >= percent
+	if !d.usageAlerts.update(name, above) {
+		return
+	}
+	fields := log.Fields{"name": name, "percent-full": usage.PercentFull, "threshold": percent,
+		"free-bytes": usage.FreeBytes}
+	if above {
+		log.WithFields(fields).Warning("Volume is getting full ")
+	} else {
+		log.WithFields(fields).Info("Volume is no longer getting full ")
+	}
+}
+
+// usageLoop checks the usage of the volumes mounted on this host every interval, until plugin shutdown
+func (d *VolumeDriver) usageLoop(percent uint64, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.ctx.Done():
+			return
+		}
+		mounts, err := fs.GetMountInfo(d.MountRoot)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Warning("Failed to get mounted volumes to check usage ")
+			continue
+		}
+		for name := range mounts {
+			usage, err := fs.GetFsUsage(d.GetMountPoint(name))
+			if err != nil {
+				continue
+			}
+			d.checkUsage(name, usage, percent)
+		}
+		// Forget unmounted volumes, a volume mounted again is warned about again
+		for name := range d.usageAlerts.names() {
+			if _, mounted := mounts[name]; !mounted {
+				d.usageAlerts.update(name, false)
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+func TestUsageStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mounts")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "vol1@datastore1"), 0755))
+
+	d := &VolumeDriver{}
+	d.MountRoot = dir
+	assert.Nil(t, d.usageStatus("vol1@datastore1", map[string]string{}), "No usage expected for unmounted volume")
+
+	status := d.usageStatus("vol1@datastore1", map[string]string{"vol1@datastore1": "/dev/sdb"})
+	for _, key := range []string{usedBytesKey, freeBytesKey, usedInodesKey, freeInodesKey, percentFullKey} {
+		assert.Contains(t, status, key)
+	}
+}
+
+func TestCheckUsage(t *testing.T) {
+	d := &VolumeDriver{usageAlerts: newUsageAlerts()}
+	d.checkUsage("vol1", fs.FsUsage{PercentFull: 50}, 90)
+	assert.Empty(t, d.usageAlerts.names())
+
+	d.checkUsage("vol1", fs.FsUsage{PercentFull: 95}, 90)
+	assert.Equal(t, map[string]bool{"vol1": true}, d.usageAlerts.names())
+	assert.False(t, d.usageAlerts.update("vol1", true), "Volume still above threshold should not be warned again")
+
+	d.checkUsage("vol1", fs.FsUsage{PercentFull: 80}, 90)
+	assert.Empty(t, d.usageAlerts.names())
+}
@@ -25,9 +25,12 @@ package vmdk
 //
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
@@ -35,17 +38,55 @@ import (
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/keyprovider"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/refcount"
 )
 
-const version = "vSphere Volume Driver v0.5"
+const (
+	version = "vSphere Volume Driver v0.5"
+
+	// snapshotCreatedKey is the creation time in the attributes of snapshots listed by ESX service
+	snapshotCreatedKey = "created"
+)
+
+// optionCapabilities maps create options to the ESX service capability they need
+var optionCapabilities = map[string]string{
+	"clone-from":       vmdkops.CapClone,
+	"vsan-policy-name": vmdkops.CapVsanPolicy,
+	"access":           vmdkops.CapAccessModes,
+	"snapshot-of":      vmdkops.CapSnapshot,
+	"from-snapshot":    vmdkops.CapSnapshot,
+	"mkfs-opts":        vmdkops.CapFsOptions,
+	"mount-opts":       vmdkops.CapFsOptions,
+	"volume-mode":      vmdkops.CapBlockMode,
+	"encryption":       vmdkops.CapEncryption,
+	"encryption-key":   vmdkops.CapEncryption,
+	iopsLimitKey:       vmdkops.CapIoLimits,
+	bpsLimitKey:        vmdkops.CapIoLimits,
+	labelsKey:          vmdkops.CapLabels,
+}
 
 // VolumeDriver - VMDK driver struct
 type VolumeDriver struct {
 	utils.PluginDriver
-	useMockEsx bool
-	ops        vmdkops.VmdkOps
+	useMockEsx          bool
+	ops                 vmdkops.VmdkOps
+	ctx                 context.Context      // passed to all requests to ESX
+	cancel              context.CancelFunc   // cancels ctx on plugin shutdown
+	maxFreeze           time.Duration        // max time to keep a filesystem frozen while copying a volume
+	creates             *createTasks         // asynchronous creates in progress
+	createWait          time.Duration        // max time for Mount to wait for an asynchronous create
+	status              *statusStore         // trims, filesystem checks and I/O limits of volumes mounted on this host
+	fsckPolicy          string               // filesystem check before mount
+	fsckTimeout         time.Duration        // max time for the filesystem check
+	keys                keyprovider.Provider // keys of encrypted volumes
+	ioCgroup            string               // cgroup the I/O limits of volumes are set in
+	usageAlerts         *usageAlerts         // volumes mounted on this host fuller than UsageWarnPercent
+	placementPolicy     string               // datastore of volumes named without one
+	placementDatastores []string             // datastores volumes are placed on, all if empty
+	placementLabels     map[string]string    // datastore of volumes by label, for placementLabels
+	placements          *placements          // datastore of volumes named without one, by name
 }
 
 // NewVolumeDriver creates Driver which to real ESX (useMockEsx=False) or a mock
@@ -55,6 +96,7 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	// Read command line flags
 	port := flag.Int("port", config.DefaultPort, "Default port to connect to ESX service")
 	useMockEsx := flag.Bool("mock_esx", false, "Mock the ESX service")
+	useGoVsock := flag.Bool("go_vsock", false, "Talk to the ESX service over vSocket without vmci_client library")
 	flag.Parse()
 
 	vmdkops.EsxPort = *port
@@ -62,39 +104,138 @@ func NewVolumeDriver(cfg config.Config, mountDir string) *VolumeDriver {
 	if *useMockEsx {
 		d = &VolumeDriver{
 			useMockEsx: true,
-			ops:        vmdkops.VmdkOps{Cmd: vmdkops.NewMockCmd()},
+			ops:        vmdkops.NewVmdkOps(vmdkops.NewMockCmd()),
 		}
 	} else {
+		// Requests to ESX are ordered per volume. Calls to vmci_client are
+		// serialized, as it picks its client port without locking, but a request
+		// waiting for a retry does not hold back the others.
+		var esxCmd vmdkops.VmdkCmdRunner = vmdkops.EsxVmdkCmd{Mtx: &sync.Mutex{}}
+		if *useGoVsock {
+			esxCmd = vmdkops.NewVsockCmd(*port)
+		}
 		d = &VolumeDriver{
 			useMockEsx: false,
-			ops: vmdkops.VmdkOps{
-				Cmd: vmdkops.EsxVmdkCmd{
-					Mtx: &sync.Mutex{},
-				},
-			},
+			ops:        vmdkops.NewVmdkOps(vmdkops.NewCmdPipeline(esxCmd, cfg.MaxEsxRequests)),
 		}
 	}
 
+	d.ops.Timeouts = esxTimeouts(cfg.EsxTimeoutsSec)
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	d.maxFreeze = time.Duration(cfg.MaxFreezeSec) * time.Second
+	d.createWait = time.Duration(cfg.AsyncCreateWaitSec) * time.Second
+
 	d.MountRoot = mountDir
+	// Unmounts wait for trims and remove I/O limits, and refcounts recovery may unmount volumes
+	// and looks for volumes being created
+	d.status = newStatusStore()
+	d.creates = newCreateTasks(config.CreateTasksDir)
+	tasks, err := d.creates.load()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to load asynchronous create tasks ")
+	}
 	d.RefCounts = refcount.NewRefCountsMap()
+	d.RefCounts.SetOrphanPolicy(cfg.OrphanDetachMode, cfg.OrphanAllowList)
 	d.RefCounts.Init(d, mountDir, cfg.Driver)
-	d.MountIDtoName = make(map[string]string)
+
+	// Resume asynchronous creates interrupted by plugin restart
+	for _, task := range tasks {
+		log.WithFields(log.Fields{"name": task.Name, "step": task.Step}).Info("Resuming asynchronous create ")
+		go d.runCreateTask(task.Name, task.Options)
+	}
+
+	if cfg.TrimIntervalSec > 0 {
+		go d.trimLoop(time.Duration(cfg.TrimIntervalSec) * time.Second)
+	}
+
+	d.fsckPolicy = validFsckPolicy(cfg.FsckPolicy)
+	d.fsckTimeout = time.Duration(cfg.FsckTimeoutSec) * time.Second
+
+	if d.keys, err = keyprovider.New(cfg.KeyProvider, cfg.KeyDir); err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid KeyProvider, encrypted volumes can't be used ")
+	}
+
+	d.ioCgroup = cfg.IoCgroup
+
+	d.usageAlerts = newUsageAlerts()
+	if cfg.UsageWarnPercent > 0 {
+		go d.usageLoop(uint64(cfg.UsageWarnPercent), time.Duration(cfg.UsageCheckIntervalSec)*time.Second)
+	}
+
+	if cfg.RefCountAuditIntervalSec > 0 {
+		go d.RefCounts.AuditLoop(d, time.Duration(cfg.RefCountAuditIntervalSec)*time.Second,
+			refcount.ValidAuditMode(cfg.RefCountAuditMode))
+	}
+	if cfg.RefCountEventAuditDelaySec > 0 {
+		go d.RefCounts.EventsLoop(d, time.Duration(cfg.RefCountEventAuditDelaySec)*time.Second,
+			refcount.ValidAuditMode(cfg.RefCountAuditMode))
+	}
+
+	d.placements = newPlacements()
+	d.placementPolicy = validPlacementPolicy(cfg.PlacementPolicy)
+	d.placementDatastores = cfg.PlacementDatastores
+	d.placementLabels = cfg.PlacementLabels
 
 	log.WithFields(log.Fields{
-		"version":  version,
-		"port":     vmdkops.EsxPort,
-		"mock_esx": *useMockEsx,
+		"version":          version,
+		"port":             vmdkops.EsxPort,
+		"mock_esx":         *useMockEsx,
+		"go_vsock":         *useGoVsock,
+		"max_esx_requests": cfg.MaxEsxRequests,
 	}).Info("Docker VMDK plugin started ")
 
 	return d
 }
 
+// esxTimeouts converts timeouts from the config to durations.
+// config.EsxTimeoutDefaultKey and vmdkops.DefaultTimeoutKey are the same.
+func esxTimeouts(timeoutsSec map[string]int) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for cmd, sec := range timeoutsSec {
+		timeouts[cmd] = time.Duration(sec) * time.Second
+	}
+	return timeouts
+}
+
+// Cancel aborts requests to ESX in progress, called on plugin shutdown
+func (d *VolumeDriver) Cancel() {
+	log.Info("Cancelling requests to ESX in progress ")
+	d.cancel()
+}
+
 // Get info about a single volume
 func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 	status, err := d.GetVolume(r.Name)
+	if task, _, exists := d.creates.get(d.placedName(r.Name)); exists {
+		// ESX may not know the volume until the create completes
+		if vmdkops.KindOf(err) == vmdkops.ErrNotFound {
+			status, err = make(map[string]interface{}), nil
+		}
+		if err == nil {
+			for key, value := range task.status() {
+				status[key] = value
+			}
+		}
+	}
 	if err != nil {
 		return volume.Response{Err: err.Error()}
 	}
+	// Trims, filesystem checks and I/O limits are recorded by the full volume name
+	datastore, _ := status["datastore"].(string)
+	if volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, datastore, d); err == nil {
+		for key, value := range d.status.status(volumeInfo.VolumeName) {
+			status[key] = value
+		}
+		for key, value := range d.placements.status(r.Name) {
+			status[key] = value
+		}
+		// ESX knows the capacity, the filesystem knows how full it is
+		if mounts, err := fs.GetMountInfo(d.MountRoot); err == nil {
+			for key, value := range d.usageStatus(volumeInfo.VolumeName, mounts) {
+				status[key] = value
+			}
+		}
+	}
 	mountpoint := d.GetMountPoint(r.Name)
 	return volume.Response{Volume: &volume.Volume{Name: r.Name,
 		Mountpoint: mountpoint,
@@ -103,11 +244,16 @@ func (d *VolumeDriver) Get(r volume.Request) volume.Response {
 
 // List volumes known to the driver
 func (d *VolumeDriver) List(r volume.Request) volume.Response {
-	volumes, err := d.ops.List()
+	volumes, err := d.ops.ListContext(d.ctx)
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Failed to get volume list ")
 		return volume.Response{Err: err.Error()}
 	}
+	// Filesystem usage is reported for volumes mounted on this host
+	mounts, err := fs.GetMountInfo(d.MountRoot)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning("Failed to get mounted volumes ")
+	}
 	responseVolumes := make([]*volume.Volume, 0, len(volumes))
 	for _, vol := range volumes {
 		// Paths are case-insensitive on Windows, so Docker only supports
@@ -115,28 +261,61 @@ func (d *VolumeDriver) List(r volume.Request) volume.Response {
 		// volname@Local2, which causes the `docker volume ls` command to hang.
 		// So, we explicitly convert volume names using the platform specific
 		// normalizeVolumeName func.
-		responseVol := volume.Volume{Name: normalizeVolumeName(vol.Name),
-			Mountpoint: d.GetMountPoint(vol.Name)}
+		// Volumes placed on a datastore are listed by the name Docker knows them by.
+		responseVol := volume.Volume{Name: normalizeVolumeName(d.placements.shortName(vol.Name)),
+			Mountpoint: d.GetMountPoint(vol.Name),
+			Status:     d.usageStatus(vol.Name, mounts)}
 		responseVolumes = append(responseVolumes, &responseVol)
 	}
 	return volume.Response{Volumes: responseVolumes}
 }
 
 // GetVolume - return volume meta-data.
+// Volumes named without datastore are looked up on the datastore they are placed on.
 func (d *VolumeDriver) GetVolume(name string) (map[string]interface{}, error) {
-	mdata, err := d.ops.Get(name)
-	if err != nil {
+	var mdata map[string]interface{}
+	err := d.withPlacedName(name, func(name string) error {
+		var err error
+		mdata, err = d.ops.GetContext(d.ctx, name)
+		return err
+	})
+	if vmdkops.KindOf(err) == vmdkops.ErrNotFound {
+		// Docker asks all drivers about volumes it does not know about
+		log.WithFields(log.Fields{"name": name}).Info("Volume not found ")
+	} else if err != nil {
 		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to get volume meta-data ")
 	}
 	return mdata, err
 }
 
+// fullName returns the full name of volume name, which its refcount and mount point are kept by.
+// name if the volume isn't found.
+func (d *VolumeDriver) fullName(name string) string {
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return name
+	}
+	return volumeInfo.VolumeName
+}
+
 // MountVolume - Request attach and then mounts the volume.
 // Actual mount - send attach to ESX and do the in-guest magic
+// "mount-opts" in volumeMeta are applied, and an encrypted volume is opened first.
+// With fstype fs.FstypeBlock the device is exposed in the mount point instead of mounted.
 // Returns mount point and  error (or nil)
-func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool) (string, error) {
+func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isReadOnly bool, skipAttach bool, volumeMeta map[string]interface{}) (string, error) {
 	mountpoint := d.GetMountPoint(name)
 
+	var key []byte
+	encrypted := plugin_utils.IsEncrypted(volumeMeta)
+	if encrypted {
+		var err error
+		if key, err = d.volumeKey(name, plugin_utils.EncryptionKeyID(volumeMeta)); err != nil {
+			log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to get key of encrypted volume ")
+			return mountpoint, err
+		}
+	}
+
 	// First, make sure  that mountpoint exists.
 	err := fs.Mkdir(mountpoint)
 	if err != nil {
@@ -156,7 +335,7 @@ func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isRead
 	}
 
 	if d.useMockEsx {
-		dev, err := d.ops.RawAttach(name, nil)
+		dev, err := d.ops.RawAttachContext(d.ctx, name, nil)
 		if err != nil {
 			log.WithFields(
 				log.Fields{"name": name,
@@ -164,10 +343,44 @@ func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isRead
 			).Error("Failed to attach volume ")
 			return mountpoint, err
 		}
-		return mountpoint, fs.MountByDevicePath(mountpoint, fstype, string(dev[:]), false)
+		return mountpoint, d.mountDevice(name, fstype, mountpoint, string(dev[:]), false, volumeMeta)
+	}
+
+	// mount-opts are missing for volumes created without them
+	mountOpts, _ := volumeMeta["mount-opts"].(string)
+	mount := func(volDev *fs.VolumeDevSpec, isReadOnly bool) error {
+		if encrypted {
+			mapper := fs.LuksMapperName(name)
+			device, err := fs.LuksOpen(volDev, mapper, key, isReadOnly)
+			if err != nil {
+				return err
+			}
+			if err = d.mountDevice(name, fstype, mountpoint, device, isReadOnly, volumeMeta); err != nil {
+				fs.LuksClose(mapper)
+			}
+			return err
+		}
+		var err error
+		if fstype == fs.FstypeBlock {
+			err = fs.ExposeBlockDevice(mountpoint, volDev, isReadOnly)
+		} else {
+			err = d.checkFs(name, isReadOnly, func(policy string) (string, error) {
+				return fs.Fsck(fstype, volDev, policy, d.fsckTimeout)
+			})
+			if err == nil {
+				err = fs.Mount(mountpoint, fstype, volDev, isReadOnly, mountOpts)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		d.limitIo(name, volumeMeta, func(limits fs.IoLimits) error {
+			return fs.SetIoLimits(volDev, d.ioCgroup, limits)
+		})
+		return nil
 	}
 
-	volDev, err := d.ops.Attach(name, nil)
+	volDev, err := d.ops.AttachContext(d.ctx, name, nil)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": name,
@@ -178,27 +391,60 @@ func (d *VolumeDriver) MountVolume(name string, fstype string, id string, isRead
 
 	if errWait != nil {
 		fs.DevAttachWaitFallback()
-		return mountpoint, fs.Mount(mountpoint, fstype, volDev, false)
+		return mountpoint, mount(volDev, false)
 	}
 
 	fs.DevAttachWait(waitCtx, volDev)
 
 	// May have timed out waiting for the attach to complete,
 	// attempt the mount anyway.
-	return mountpoint, fs.Mount(mountpoint, fstype, volDev, isReadOnly)
+	return mountpoint, mount(volDev, isReadOnly)
+}
+
+// mountDevice mounts the filesystem on device at mountpoint after the filesystem check,
+// or exposes device there with fstype fs.FstypeBlock, and sets the I/O limits of the volume.
+func (d *VolumeDriver) mountDevice(name string, fstype string, mountpoint string, device string, isReadOnly bool, volumeMeta map[string]interface{}) error {
+	var err error
+	if fstype == fs.FstypeBlock {
+		err = fs.ExposeBlockDeviceByDevicePath(mountpoint, device, isReadOnly)
+	} else {
+		err = d.checkFs(name, isReadOnly, func(policy string) (string, error) {
+			return fs.FsckByDevicePath(fstype, device, policy, d.fsckTimeout)
+		})
+		if err == nil {
+			mountOpts, _ := volumeMeta["mount-opts"].(string)
+			err = fs.MountByDevicePath(mountpoint, fstype, device, isReadOnly, mountOpts)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	d.limitIo(name, volumeMeta, func(limits fs.IoLimits) error {
+		return fs.SetIoLimitsByDevicePath(device, d.ioCgroup, limits)
+	})
+	return nil
 }
 
-// UnmountVolume - Unmounts the volume and then requests detach
+// UnmountVolume - Unmounts the volume, or removes the device of a block-mode volume,
+// closes the volume if encrypted and then requests detach
 func (d *VolumeDriver) UnmountVolume(name string) error {
+	d.status.wait(opTrim, name)
 	mountpoint := d.GetMountPoint(name)
-	err := fs.Unmount(mountpoint)
+	d.unlimitIo(name)
+	var err error
+	if fs.HasBlockDevice(mountpoint) {
+		err = fs.RemoveBlockDevice(mountpoint)
+	} else {
+		err = fs.Unmount(mountpoint)
+	}
 	if err != nil {
 		log.WithFields(
 			log.Fields{"mountpoint": mountpoint, "error": err},
 		).Error("Failed to unmount volume. Now trying to detach... ")
 		// Do not return error. Continue with detach.
 	}
-	return d.ops.Detach(name, nil)
+	d.closeEncrypted(name)
+	return d.ops.DetachContext(d.ctx, name, nil)
 }
 
 // private function that does the job of mounting volume in conjunction with refcounting
@@ -209,7 +455,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		return volume.Response{Err: err.Error()}
 	}
 	r.Name = volumeInfo.VolumeName
-	d.MountIDtoName[r.ID] = r.Name
+	d.RefCounts.AddMountID(r.ID, r.Name)
 
 	// If the volume is already mounted , just increase the refcount.
 	// Note: for new keys, GO maps return zero value, so no need for if_exists.
@@ -252,8 +498,8 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		isReadOnly = true
 	}
 
-	// Check file system type.
-	value, exists = volumeMeta["fstype"].(string)
+	// Check file system type, block-mode volumes have none.
+	value, exists = plugin_utils.MountFstype(volumeMeta)
 	if !exists {
 		msg := fmt.Sprintf("Invalid filesystem type for %s, assuming type as %s.",
 			r.Name, fstype)
@@ -263,7 +509,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 	}
 	fstype = value
 
-	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false)
+	mountpoint, err := d.MountVolume(r.Name, fstype, "", isReadOnly, false, volumeMeta)
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name, "error": err.Error()},
@@ -272,7 +518,7 @@ func (d *VolumeDriver) processMount(r volume.MountRequest) volume.Response {
 		refcnt, _ := d.DecrRefCount(r.Name)
 		if refcnt == 0 {
 			log.Infof("Detaching %s - it is not used anymore", r.Name)
-			d.ops.Detach(r.Name, nil) // try to detach before failing the request for volume
+			d.ops.DetachContext(d.ctx, r.Name, nil) // try to detach before failing the request for volume
 		}
 		return volume.Response{Err: err.Error()}
 	}
@@ -287,14 +533,31 @@ func (d *VolumeDriver) prepareCreateOptions(r *volume.Request) error {
 		r.Options = make(map[string]string)
 	}
 
-	// Use default fstype if both fstype and clone-from are not specified.
+	blockMode, err := checkVolumeMode(r.Options)
+	if err != nil {
+		return err
+	}
+
+	// Use default fstype if none of fstype, clone-from and the snapshot options are specified,
+	// copies keep the filesystem of the source. Block-mode volumes have no filesystem.
 	_, fstypeRes := r.Options["fstype"]
-	_, cloneFromRes := r.Options["clone-from"]
-	if !fstypeRes && !cloneFromRes {
+	if !fstypeRes && !isCopy(r.Options) && !blockMode {
 		log.WithFields(log.Fields{"req": r}).Debugf("Setting fstype to %s ", fs.FstypeDefault)
 		r.Options["fstype"] = fs.FstypeDefault
 	}
 
+	// Refuse options ESX service can't handle, instead of failing somewhere on ESX
+	info, err := d.ops.ServerInfoContext(d.ctx)
+	if err != nil {
+		return err
+	}
+	for option, capability := range optionCapabilities {
+		if _, exists := r.Options[option]; exists && !info.HasCapability(capability) {
+			return fmt.Errorf("Option %s is not supported by ESX service (protocol version %s), "+
+				"please upgrade the vDVS driver on ESX", option, info.Version)
+		}
+	}
+
 	// Check whether the fstype filesystem is supported.
 	if _, fstypeRes = r.Options["fstype"]; fstypeRes {
 		err := fs.VerifyFSSupport(r.Options["fstype"])
@@ -304,12 +567,185 @@ func (d *VolumeDriver) prepareCreateOptions(r *volume.Request) error {
 			return err
 		}
 	}
+
+	if err = d.checkFsOptions(r.Options); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid filesystem options ")
+		return err
+	}
+
+	if _, err = fs.ParseIoLimits(r.Options[iopsLimitKey], r.Options[bpsLimitKey]); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid I/O limits ")
+		return err
+	}
+
+	if _, err = parseLabels(r.Options[labelsKey]); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Invalid labels ")
+		return err
+	}
+
+	if err = d.checkEncryption(r.Name, r.Options); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Cannot encrypt volume ")
+		return err
+	}
+	// Kept with the metadata, copies look up the key of the volume they were copied from
+	if r.Options[plugin_utils.EncryptionKey] == plugin_utils.EncryptionLuks {
+		r.Options[plugin_utils.EncryptionKeyIDKey] = strings.Split(r.Name, "@")[0]
+	}
 	return nil
 }
 
+// copyOptions are the create options making the volume a copy of an existing one
+var copyOptions = []string{"clone-from", "snapshot-of", "from-snapshot"}
+
+// isCopy tells whether the create options copy an existing volume
+func isCopy(opts map[string]string) bool {
+	for _, option := range copyOptions {
+		if _, exists := opts[option]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVolumeMode validates the volume-mode option and tells whether the new volume is block-mode.
+// Filesystem options are refused for block-mode volumes, copies keep the volume mode of the source.
+func checkVolumeMode(opts map[string]string) (bool, error) {
+	mode, exists := opts[plugin_utils.VolumeModeKey]
+	if !exists {
+		return false, nil
+	}
+	if isCopy(opts) {
+		return false, fmt.Errorf("Option %s cannot be used with %s, copies keep the volume mode of the source",
+			plugin_utils.VolumeModeKey, strings.Join(copyOptions, ", "))
+	}
+	switch mode {
+	case plugin_utils.VolumeModeFilesystem:
+		return false, nil
+	case plugin_utils.VolumeModeBlock:
+		for _, option := range []string{"fstype", "mkfs-opts", "mount-opts"} {
+			if _, exists = opts[option]; exists {
+				return false, fmt.Errorf("Option %s cannot be used with %s=%s, the volume has no filesystem",
+					option, plugin_utils.VolumeModeKey, mode)
+			}
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("Invalid value %q for option %s, valid values are %s and %s", mode,
+		plugin_utils.VolumeModeKey, plugin_utils.VolumeModeFilesystem, plugin_utils.VolumeModeBlock)
+}
+
+// checkFsOptions validates mkfs-opts and mount-opts against the fstype of the new volume.
+// Copies keep the filesystem of the source, so mkfs-opts are refused for them
+// and mount-opts are checked against the fstype of the source.
+func (d *VolumeDriver) checkFsOptions(opts map[string]string) error {
+	mkfsOpts, mkfsRes := opts["mkfs-opts"]
+	mountOpts, mountRes := opts["mount-opts"]
+	if mkfsRes && isCopy(opts) {
+		return fmt.Errorf("Option mkfs-opts cannot be used with %s, copies keep the filesystem of the source",
+			strings.Join(copyOptions, ", "))
+	}
+
+	fstype, fstypeRes := opts["fstype"]
+	if mountRes && !fstypeRes {
+		var src string
+		for _, option := range copyOptions {
+			if value, exists := opts[option]; exists {
+				src = value
+			}
+		}
+		srcMeta, err := d.GetVolume(src)
+		if err != nil {
+			return fmt.Errorf("Failed to get filesystem type of %s: %v", src, err)
+		}
+		if fstype, fstypeRes = plugin_utils.MountFstype(srcMeta); !fstypeRes {
+			fstype = fs.FstypeDefault
+		}
+		if fstype == fs.FstypeBlock {
+			return fmt.Errorf("Option mount-opts cannot be used with a copy of block-mode volume %s", src)
+		}
+	}
+
+	if err := fs.ValidateMkfsOptions(fstype, mkfsOpts); err != nil {
+		return err
+	}
+	return fs.ValidateMountOptions(fstype, mountOpts)
+}
+
+// quiesce freezes the filesystem of the volume if it is mounted on this host, so a copy
+// of the volume made before the returned thaw function is called is consistent.
+// The filesystem is thawed after d.maxFreeze even if the copy takes longer, not to
+// block writers in containers for too long.
+func (d *VolumeDriver) quiesce(name string) func() {
+	noop := func() {}
+
+	d.RefCounts.StateMtx.Lock()
+	defer d.RefCounts.StateMtx.Unlock()
+
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil || d.GetRefCount(volumeInfo.VolumeName) == 0 {
+		// Not mounted here, or does not exist and copying it fails anyway
+		return noop
+	}
+	mountpoint := d.GetMountPoint(volumeInfo.VolumeName)
+	if fs.HasBlockDevice(mountpoint) {
+		// No filesystem to freeze, consistency is up to the user of the device
+		log.WithFields(log.Fields{"name": name}).Warning("Copying block-mode volume in use, the copy may be inconsistent ")
+		return noop
+	}
+	err = fs.FreezeFs(mountpoint)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name,
+			"error": err}).Warning("Copying volume without freezing, the copy may be inconsistent ")
+		return noop
+	}
+	log.WithFields(log.Fields{"name": name, "mountpoint": mountpoint}).Info("Filesystem frozen ")
+
+	var once sync.Once
+	thaw := func() {
+		once.Do(func() {
+			if err := fs.ThawFs(mountpoint); err != nil {
+				log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to thaw filesystem ")
+				return
+			}
+			log.WithFields(log.Fields{"name": name, "mountpoint": mountpoint}).Info("Filesystem thawed ")
+		})
+	}
+	timer := time.AfterFunc(d.maxFreeze, func() {
+		log.WithFields(log.Fields{"name": name, "max_freeze": d.maxFreeze}).Warning(
+			"Copying volume takes too long, thawing filesystem, the copy may be inconsistent ")
+		thaw()
+	})
+	return func() {
+		timer.Stop()
+		thaw()
+	}
+}
+
+// snapshotOf creates a snapshot of an existing volume, named as the new volume.
+func (d *VolumeDriver) snapshotOf(ctx context.Context, r volume.Request) volume.Response {
+	src := r.Options["snapshot-of"]
+	delete(r.Options, "snapshot-of")
+	thaw := d.quiesce(src)
+	defer thaw()
+	errSnapshot := d.ops.CreateSnapshotContext(ctx, src, r.Name, r.Options)
+	if errSnapshot != nil {
+		log.WithFields(log.Fields{"name": r.Name, "snapshot-of": src,
+			"error": errSnapshot}).Error("Snapshot volume failed ")
+		return volume.Response{Err: errSnapshot.Error()}
+	}
+	return volume.Response{Err: ""}
+}
+
 // cloneFrom clones an existing volume.
-func (d *VolumeDriver) cloneFrom(r volume.Request) volume.Response {
-	errClone := d.ops.Create(r.Name, r.Options)
+func (d *VolumeDriver) cloneFrom(ctx context.Context, r volume.Request) volume.Response {
+	if src, exists := r.Options["clone-from"]; exists {
+		thaw := d.quiesce(src)
+		defer thaw()
+	}
+	errClone := d.ops.CreateContext(ctx, r.Name, r.Options)
+	if vmdkops.KindOf(errClone) == vmdkops.ErrAlreadyExists {
+		errClone = d.adoptVolume(r, func(step string) {})
+	}
 	if errClone != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errClone}).Error("Clone volume failed ")
 		return volume.Response{Err: errClone.Error()}
@@ -319,7 +755,7 @@ func (d *VolumeDriver) cloneFrom(r volume.Request) volume.Response {
 
 // detach detaches a volume, or prints a warning log on failure.
 func (d *VolumeDriver) detach(name string) error {
-	errDetach := d.ops.Detach(name, nil)
+	errDetach := d.ops.DetachContext(d.ctx, name, nil)
 	if errDetach != nil {
 		log.WithFields(log.Fields{"name": name, "error": errDetach}).Warning("Detach volume failed ")
 	}
@@ -328,7 +764,7 @@ func (d *VolumeDriver) detach(name string) error {
 
 // remove removes a volume, or prints a warning log on failure.
 func (d *VolumeDriver) remove(name string) error {
-	errRemove := d.ops.Remove(name, nil)
+	errRemove := d.ops.RemoveContext(d.ctx, name, nil)
 	if errRemove != nil {
 		log.WithFields(log.Fields{"name": name, "error": errRemove}).Warning("Remove volume failed ")
 	}
@@ -352,21 +788,113 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to prepare options ")
 		return volume.Response{Err: err.Error()}
 	}
+	async, err := popAsyncOption(r.Options)
+	if err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if err = d.placeVolume(&r); err != nil {
+		return volume.Response{Err: err.Error()}
+	}
+	if async {
+		return d.createAsync(r)
+	}
+	if _, _, exists := d.creates.get(r.Name); exists {
+		// Don't adopt the volume while it is created in background
+		return volume.Response{Err: fmt.Sprintf("Volume %s is already being created, or its creation failed", r.Name)}
+	}
+	return d.create(d.ctx, r, func(step string) {})
+}
 
-	// If cloning a existent volume, create and return
-	if _, result := r.Options["clone-from"]; result {
-		return d.cloneFrom(r)
+// createAsync starts creating the volume in background
+func (d *VolumeDriver) createAsync(r volume.Request) volume.Response {
+	err := d.creates.start(r.Name, r.Options)
+	if err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Failed to start asynchronous create ")
+		return volume.Response{Err: err.Error()}
+	}
+	log.WithFields(log.Fields{"name": r.Name}).Info("Creating volume asynchronously ")
+	go d.runCreateTask(r.Name, r.Options)
+	return volume.Response{Err: ""}
+}
+
+// runCreateTask creates the volume and records the progress in its create task
+func (d *VolumeDriver) runCreateTask(name string, opts map[string]string) {
+	r := volume.Request{Name: name, Options: make(map[string]string)}
+	for k, v := range opts {
+		r.Options[k] = v
 	}
+	// Copies of large volumes may take longer than the create timeout, nobody is waiting here
+	res := d.create(vmdkops.WithoutTimeout(d.ctx), r, func(step string) { d.creates.update(name, step) })
+	if res.Err != "" {
+		d.creates.fail(name, res.Err)
+		return
+	}
+	d.creates.finish(name)
+	log.WithFields(log.Fields{"name": name}).Info("Asynchronous create completed ")
+}
 
-	errCreate := d.ops.Create(r.Name, r.Options)
+// waitCreated waits for an asynchronous create of the volume to complete
+func (d *VolumeDriver) waitCreated(name string) error {
+	task, done, exists := d.creates.get(name)
+	if !exists {
+		return nil
+	}
+	select {
+	case <-done:
+	case <-time.After(d.createWait):
+		task, _, _ = d.creates.get(name)
+		return fmt.Errorf("Volume %s is still being created (%s), try again later", name, task.Step)
+	case <-d.ctx.Done():
+		return fmt.Errorf("Plugin is shutting down, volume %s is still being created", name)
+	}
+	if task, _, exists = d.creates.get(name); exists && task.Step == stepFailed {
+		return fmt.Errorf("Failed to create volume %s: %s", name, task.Error)
+	}
+	return nil
+}
+
+// create creates a volume, reporting the steps of volume creation to progress.
+// The volume is created on ESX with ctx.
+func (d *VolumeDriver) create(ctx context.Context, r volume.Request, progress func(step string)) volume.Response {
+	// Refcount recovery leaves the volume attached meanwhile, it is attached to create its filesystem
+	if !d.status.start(opCreate, r.Name) {
+		return volume.Response{Err: fmt.Sprintf("Volume %s is already being created", r.Name)}
+	}
+	defer d.status.finish(opCreate, r.Name, nil)
+	progress(stepCreate)
+
+	// If snapshotting or cloning a existent volume, create and return
+	if _, result := r.Options["snapshot-of"]; result {
+		return d.snapshotOf(ctx, r)
+	}
+	if isCopy(r.Options) {
+		return d.cloneFrom(ctx, r)
+	}
+
+	errCreate := d.ops.CreateContext(ctx, r.Name, r.Options)
+	if vmdkops.KindOf(errCreate) == vmdkops.ErrAlreadyExists {
+		// Create retried, or the volume was left half-created
+		if errAdopt := d.adoptVolume(r, progress); errAdopt != nil {
+			log.WithFields(log.Fields{"name": r.Name, "error": errAdopt}).Error("Create volume failed ")
+			return volume.Response{Err: errAdopt.Error()}
+		}
+		return volume.Response{Err: ""}
+	}
 	if errCreate != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errCreate}).Error("Create volume failed ")
 		return volume.Response{Err: errCreate.Error()}
 	}
 
+	encrypted := r.Options[plugin_utils.EncryptionKey] == plugin_utils.EncryptionLuks
+	if r.Options[plugin_utils.VolumeModeKey] == plugin_utils.VolumeModeBlock && !encrypted {
+		log.WithFields(log.Fields{"name": r.Name}).Info("Block-mode volume created ")
+		return volume.Response{Err: ""}
+	}
+
 	// Handle filesystem creation
 	log.WithFields(log.Fields{"name": r.Name,
 		"fstype": r.Options["fstype"]}).Info("Attaching volume and creating filesystem ")
+	progress(stepAttach)
 
 	waitCtx, errWait := fs.DevAttachWaitPrep()
 	if errWait != nil {
@@ -374,7 +902,7 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 			"error": errWait}).Warning("Failed to initialize wait context, continuing however.. ")
 	}
 
-	volDev, errAttach := d.ops.Attach(r.Name, nil)
+	volDev, errAttach := d.ops.AttachContext(d.ctx, r.Name, nil)
 	if errAttach != nil {
 		log.WithFields(log.Fields{"name": r.Name,
 			"error": errAttach}).Error("Attach volume failed, removing the volume ")
@@ -396,7 +924,13 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		}
 	}
 
-	errMkfs := fs.Mkfs(r.Options["fstype"], r.Name, volDev)
+	progress(stepMkfs)
+	var errMkfs error
+	if encrypted {
+		errMkfs = d.mkfsEncrypted(r.Name, volDev, r.Options)
+	} else {
+		errMkfs = fs.Mkfs(r.Options["fstype"], r.Name, volDev, r.Options["mkfs-opts"])
+	}
 	if errMkfs != nil {
 		log.WithFields(log.Fields{"name": r.Name,
 			"error": errMkfs}).Error("Create filesystem failed, removing the volume ")
@@ -404,7 +938,8 @@ func (d *VolumeDriver) Create(r volume.Request) volume.Response {
 		return volume.Response{Err: errMkfs.Error()}
 	}
 
-	errDetach := d.ops.Detach(r.Name, nil)
+	progress(stepDetach)
+	errDetach := d.ops.DetachContext(d.ctx, r.Name, nil)
 	if errDetach != nil {
 		log.WithFields(log.Fields{"name": r.Name, "error": errDetach}).Error("Detach volume failed ")
 		return volume.Response{Err: errDetach.Error()}
@@ -428,14 +963,35 @@ func (d *VolumeDriver) Remove(r volume.Request) volume.Response {
 	}
 
 	// Docker is supposed to block 'remove' command if the volume is used.
-	if d.GetRefCount(r.Name) != 0 {
+	// Refcounts are kept by full name, the volume may be on any datastore.
+	if refcnt := d.GetRefCount(d.fullName(r.Name)); refcnt != 0 {
 		msg := fmt.Sprintf("Remove failure - volume is still mounted. "+
-			" volume=%s, refcount=%d", r.Name, d.GetRefCount(r.Name))
+			" volume=%s, refcount=%d", r.Name, refcnt)
 		log.Error(msg)
 		return volume.Response{Err: msg}
 	}
 
-	err := d.ops.Remove(r.Name, r.Options)
+	// A volume being created asynchronously is removed once the create completes
+	if task, _, exists := d.creates.get(d.placedName(r.Name)); exists {
+		if task.Step != stepFailed {
+			return volume.Response{Err: fmt.Sprintf("Volume %s is still being created (%s)", r.Name, task.Step)}
+		}
+		d.creates.finish(d.placedName(r.Name))
+	}
+
+	err := d.withPlacedName(r.Name, func(name string) error {
+		return d.ops.RemoveContext(d.ctx, name, r.Options)
+	})
+	// Only trust "not found" reported as such, a message merely mentioning it may
+	// be about something else than the volume, which would then be leaked.
+	if err == nil || vmdkops.ReportedKindOf(err) == vmdkops.ErrNotFound {
+		d.placements.remove(r.Name)
+	}
+	if vmdkops.ReportedKindOf(err) == vmdkops.ErrNotFound {
+		// Already removed on ESX side, let Docker forget about it too
+		log.WithFields(log.Fields{"name": r.Name}).Warning("Volume not found on ESX, assuming removed ")
+		return volume.Response{Err: ""}
+	}
 	if err != nil {
 		log.WithFields(
 			log.Fields{"name": r.Name,
@@ -463,12 +1019,18 @@ func (d *VolumeDriver) Path(r volume.Request) volume.Response {
 func (d *VolumeDriver) Mount(r volume.MountRequest) volume.Response {
 	log.WithFields(log.Fields{"name": r.Name}).Info("Mounting volume ")
 
+	// Wait for asynchronous create before taking the lock, not to block other volumes
+	if err := d.waitCreated(d.placedName(r.Name)); err != nil {
+		log.WithFields(log.Fields{"name": r.Name, "error": err}).Error("Volume is not ready ")
+		return volume.Response{Err: err.Error()}
+	}
+
 	// lock the state
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
 
-	// checked by refcounting thread until refmap initialized
-	// useless after that
+	// checked by refcounting thread until refmap initialized,
+	// and by refcount audits after that
 	d.RefCounts.MarkDirty()
 
 	return d.processMount(r)
@@ -483,17 +1045,18 @@ func (d *VolumeDriver) Unmount(r volume.UnmountRequest) volume.Response {
 	d.RefCounts.StateMtx.Lock()
 	defer d.RefCounts.StateMtx.Unlock()
 
+	// checked by refcounting thread and refcount audits
+	d.RefCounts.MarkDirty()
+
 	if d.RefCounts.IsInitialized() != true {
 		// if refcounting hasn't been succesful,
 		// no refcounting, no unmount. All unmounts are delayed
 		// until we succesfully populate the refcount map
-		d.RefCounts.MarkDirty()
 		return volume.Response{Err: ""}
 	}
 
-	if fullVolName, exist := d.MountIDtoName[r.ID]; exist {
+	if fullVolName, exist := d.RefCounts.RemoveMountID(r.ID); exist {
 		r.Name = fullVolName
-		delete(d.MountIDtoName, r.ID) //cleanup the map
 	} else {
 		volumeInfo, err := plugin_utils.GetVolumeInfo(r.Name, "", d)
 		if err != nil {
@@ -536,7 +1099,179 @@ func (d *VolumeDriver) Capabilities(r volume.Request) volume.Response {
 	return volume.Response{Capabilities: volume.Capability{Scope: "global"}}
 }
 
-// DetachVolume - detach a volume from the VM
+// DetachVolume - detach a volume from the VM, closing it first if encrypted
 func (d *VolumeDriver) DetachVolume(name string) error {
-	return d.ops.Detach(name, nil)
+	d.closeEncrypted(name)
+	return d.ops.DetachContext(d.ctx, name, nil)
+}
+
+// ListAttached - return the full names of the volumes attached to this VM
+func (d *VolumeDriver) ListAttached() ([]string, error) {
+	info, err := d.ops.ServerInfoContext(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !info.HasCapability(vmdkops.CapListAttached) {
+		return nil, fmt.Errorf("Listing attached volumes is not supported by ESX service (protocol version %s), "+
+			"please upgrade the vDVS driver on ESX", info.Version)
+	}
+	volumes, err := d.ops.ListAttachedContext(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(volumes))
+	for _, vol := range volumes {
+		names = append(names, vol.Name)
+	}
+	return names, nil
+}
+
+// ListInProgress - return the volumes being created on this host, or with an asynchronous create
+// to resume. They may be attached to create their filesystem.
+func (d *VolumeDriver) ListInProgress() []string {
+	return append(d.status.inProgress(opCreate), d.creates.inProgress()...)
+}
+
+// ResizeVolume grows the volume and its filesystem to size.
+// A volume in use is grown online, otherwise it is mounted for the time of the resize.
+func (d *VolumeDriver) ResizeVolume(name string, size string) error {
+	log.WithFields(log.Fields{"name": name, "size": size}).Info("Resizing volume ")
+
+	info, err := d.ops.ServerInfoContext(d.ctx)
+	if err != nil {
+		return err
+	}
+	if !info.HasCapability(vmdkops.CapResize) {
+		return fmt.Errorf("Resize is not supported by ESX service (protocol version %s), "+
+			"please upgrade the vDVS driver on ESX", info.Version)
+	}
+
+	// Do not let mounts and unmounts of the volume run in the middle
+	d.RefCounts.StateMtx.Lock()
+	defer d.RefCounts.StateMtx.Unlock()
+
+	volumeInfo, err := plugin_utils.GetVolumeInfo(name, "", d)
+	if err != nil {
+		return err
+	}
+	name = volumeInfo.VolumeName
+	volumeMeta := volumeInfo.VolumeMeta
+	if volumeMeta == nil {
+		if volumeMeta, err = d.GetVolume(name); err != nil {
+			return err
+		}
+	}
+	if access, _ := volumeMeta["access"].(string); access == "read-only" {
+		return fmt.Errorf("Cannot resize read-only volume %s", name)
+	}
+	if plugin_utils.IsEncrypted(volumeMeta) {
+		// The opened device keeps the size it had on open
+		return fmt.Errorf("Cannot resize encrypted volume %s", name)
+	}
+	fstype, exists := plugin_utils.MountFstype(volumeMeta)
+	if !exists {
+		fstype = fs.FstypeDefault
+	}
+
+	err = d.ops.ResizeContext(d.ctx, name, map[string]string{"size": size})
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to resize volume ")
+		return err
+	}
+
+	mountpoint := d.GetMountPoint(name)
+	if !plugin_utils.AlreadyMounted(name, d.MountRoot) {
+		if fstype == fs.FstypeBlock {
+			// No filesystem to grow, the device has the new size on next attach
+			log.WithFields(log.Fields{"name": name, "size": size}).Info("Volume resized ")
+			return nil
+		}
+		if _, err = d.MountVolume(name, fstype, "", false, false, volumeMeta); err != nil {
+			return fmt.Errorf("Volume %s resized, but failed to mount it to grow the filesystem: %v", name, err)
+		}
+		defer d.UnmountVolume(name)
+	}
+
+	var mounts map[string]string
+	if fstype == fs.FstypeBlock {
+		mounts, err = fs.GetBlockDevices(d.MountRoot)
+	} else {
+		mounts, err = fs.GetMountInfo(d.MountRoot)
+	}
+	if err != nil {
+		return err
+	}
+	err = fs.GrowFs(fstype, mounts[name], mountpoint)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to grow filesystem ")
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "size": size}).Info("Volume resized ")
+	return nil
+}
+
+// RevertVolume replaces the content of the volume with the content of snapshot.
+// The volume must not be in use.
+func (d *VolumeDriver) RevertVolume(name string, snapshot string) error {
+	log.WithFields(log.Fields{"name": name, "snapshot": snapshot}).Info("Reverting volume ")
+	if snapshot == "" {
+		return fmt.Errorf("Snapshot name is required to revert volume %s", name)
+	}
+
+	// Do not let the volume get mounted while reverting
+	d.RefCounts.StateMtx.Lock()
+	defer d.RefCounts.StateMtx.Unlock()
+
+	fullName := d.fullName(name)
+	if d.GetRefCount(fullName) > 0 || plugin_utils.AlreadyMounted(fullName, d.MountRoot) {
+		return fmt.Errorf("Cannot revert volume %s, it is in use", name)
+	}
+	err := d.ops.RevertSnapshotContext(d.ctx, fullName, snapshot)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "snapshot": snapshot,
+			"error": err}).Error("Failed to revert volume ")
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "snapshot": snapshot}).Info("Volume reverted ")
+	return nil
+}
+
+// ListSnapshots lists the snapshots of the volume, with their creation time in the status.
+func (d *VolumeDriver) ListSnapshots(name string) ([]*volume.Volume, error) {
+	snapshots, err := d.ops.ListSnapshotsContext(d.ctx, d.fullName(name))
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "error": err}).Error("Failed to list snapshots ")
+		return nil, err
+	}
+	volumes := make([]*volume.Volume, 0, len(snapshots))
+	for _, snap := range snapshots {
+		volumes = append(volumes, &volume.Volume{Name: normalizeVolumeName(snap.Name),
+			Mountpoint: d.GetMountPoint(snap.Name),
+			Status:     map[string]interface{}{snapshotCreatedKey: snap.Attributes[snapshotCreatedKey]}})
+	}
+	return volumes, nil
+}
+
+// RemoveSnapshot removes snapshot of the volume. The snapshot must not be in use.
+func (d *VolumeDriver) RemoveSnapshot(name string, snapshot string) error {
+	log.WithFields(log.Fields{"name": name, "snapshot": snapshot}).Info("Removing snapshot ")
+	if snapshot == "" {
+		return fmt.Errorf("Snapshot name is required to remove a snapshot of volume %s", name)
+	}
+
+	// Do not let the snapshot get mounted while removing it
+	d.RefCounts.StateMtx.Lock()
+	defer d.RefCounts.StateMtx.Unlock()
+
+	if d.GetRefCount(d.fullName(snapshot)) > 0 {
+		return fmt.Errorf("Cannot remove snapshot %s, it is in use", snapshot)
+	}
+	err := d.ops.RemoveSnapshotContext(d.ctx, d.fullName(name), snapshot)
+	if err != nil {
+		log.WithFields(log.Fields{"name": name, "snapshot": snapshot,
+			"error": err}).Error("Failed to remove snapshot ")
+		return err
+	}
+	log.WithFields(log.Fields{"name": name, "snapshot": snapshot}).Info("Snapshot removed ")
+	return nil
 }
@@ -47,3 +47,30 @@ func TestCommands(t *testing.T) {
 		assert.Nil(t, ops.Remove("anotherVolume", opts))
 	}
 }
+
+func TestSnapshots(t *testing.T) {
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.NewMockCmd()}
+	name := testparams.GetVolumeName()
+	snapshot := name + "-snap"
+	opts := map[string]string{}
+	if !assert.Nil(t, ops.Create(name, map[string]string{"size": "1gb"})) {
+		return
+	}
+	defer ops.Remove(name, opts)
+
+	if assert.Nil(t, ops.CreateSnapshot(name, snapshot, nil)) {
+		snapshots, err := ops.ListSnapshots(name)
+		assert.Nil(t, err)
+		assert.Equal(t, []vmdkops.VolumeData{{Name: snapshot}}, snapshots)
+
+		assert.Nil(t, ops.RevertSnapshot(name, snapshot))
+		if assert.Nil(t, ops.Create("restoredVolume", map[string]string{"from-snapshot": snapshot})) {
+			assert.Nil(t, ops.Remove("restoredVolume", opts))
+		}
+		assert.NotNil(t, ops.RemoveSnapshot("restoredVolume", snapshot))
+		assert.Nil(t, ops.RemoveSnapshot(name, snapshot))
+	}
+	snapshots, err := ops.ListSnapshots(name)
+	assert.Nil(t, err)
+	assert.Empty(t, snapshots)
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Concurrent command pipeline in front of a VmdkCmdRunner.
+//
+// Requests to ESX used to be fully serialized, so a slow attach (including
+// its retries) blocked every other request from this VM. CmdPipeline allows
+// up to maxInFlight requests to run in parallel, and only keeps ordering
+// where it matters:
+//   - commands changing a volume (create/attach/detach/remove...) are
+//     executed one at a time per volume, in the order they were issued
+//   - read-only commands (get/list) never wait for other commands on the
+//     same volume, only for a free slot
+
+package vmdkops
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// readOnlyCmds are the commands which do not need per-volume ordering
+var readOnlyCmds = map[string]bool{
+	"get":            true,
+	"list":           true,
+	"listSnapshots":  true,
+	"listDatastores": true,
+	"listAttached":   true,
+	handshakeCmd:     true,
+}
+
+// CmdPipeline struct - runs commands on Cmd with bounded parallelism
+type CmdPipeline struct {
+	Cmd VmdkCmdRunner // runner executing the commands
+
+	slots chan struct{}            // one token per in-flight request
+	mtx   *sync.Mutex              // protects tails
+	tails map[string]chan struct{} // per volume: closed when the last queued command completes
+}
+
+// NewCmdPipeline returns a pipeline running at most maxInFlight commands in parallel on cmd.
+func NewCmdPipeline(cmd VmdkCmdRunner, maxInFlight int) *CmdPipeline {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	return &CmdPipeline{
+		Cmd:   cmd,
+		slots: make(chan struct{}, maxInFlight),
+		mtx:   &sync.Mutex{},
+		tails: make(map[string]chan struct{}),
+	}
+}
+
+// Run waits for its turn on the volume (unless cmd is read-only) and a free slot, then runs cmd.
+func (p *CmdPipeline) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	return p.RunContext(context.Background(), cmd, name, opts)
+}
+
+// RunContext is Run giving up when ctx is done, including while waiting in the queue.
+func (p *CmdPipeline) RunContext(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	if !readOnlyCmds[cmd] {
+		done, err := p.waitTurn(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer p.endTurn(name, done)
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	return runCmd(ctx, p.Cmd, cmd, name, opts)
+}
+
+// volumeKey returns the key commands are ordered by.
+// "vol" and "vol@datastore" may be the same volume, so use the short name.
+func volumeKey(name string) string {
+	return strings.Split(name, "@")[0]
+}
+
+// waitTurn queues the caller behind the commands already issued for the volume
+// and blocks until they complete. Returns the channel to close when done.
+func (p *CmdPipeline) waitTurn(ctx context.Context, name string) (chan struct{}, error) {
+	key := volumeKey(name)
+	done := make(chan struct{})
+
+	p.mtx.Lock()
+	prev := p.tails[key]
+	p.tails[key] = done
+	p.mtx.Unlock()
+
+	if prev == nil {
+		return done, nil
+	}
+
+	log.WithFields(log.Fields{"name": name}).Debug("Waiting for previous command on volume ")
+	select {
+	case <-prev:
+		return done, nil
+	case <-ctx.Done():
+		// Commands queued behind us still have to wait for prev
+		go func() {
+			<-prev
+			p.endTurn(name, done)
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// endTurn lets the next queued command on the volume run
+func (p *CmdPipeline) endTurn(name string, done chan struct{}) {
+	key := volumeKey(name)
+
+	p.mtx.Lock()
+	if p.tails[key] == done {
+		// nobody is queued behind us
+		delete(p.tails, key)
+	}
+	p.mtx.Unlock()
+
+	close(done)
+}
@@ -0,0 +1,170 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdkops_test
+
+// Test ordering and parallelism guarantees of CmdPipeline
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+// blockingCmd blocks "attach" until released and records command order
+type blockingCmd struct {
+	mtx      *sync.Mutex
+	order    []string
+	inFlight int
+	maxSeen  int
+	release  chan struct{}
+}
+
+func (b *blockingCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	b.mtx.Lock()
+	b.order = append(b.order, cmd+" "+name)
+	b.inFlight++
+	if b.inFlight > b.maxSeen {
+		b.maxSeen = b.inFlight
+	}
+	b.mtx.Unlock()
+
+	if cmd == "attach" {
+		<-b.release
+	} else {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b.mtx.Lock()
+	b.inFlight--
+	b.mtx.Unlock()
+	return nil, nil
+}
+
+func newBlockingCmd() *blockingCmd {
+	return &blockingCmd{mtx: &sync.Mutex{}, release: make(chan struct{})}
+}
+
+func TestPipelineGetNotBlockedByAttach(t *testing.T) {
+	runner := newBlockingCmd()
+	p := vmdkops.NewCmdPipeline(runner, 4)
+
+	attached := make(chan struct{})
+	go func() {
+		p.Run("attach", "vol1", nil)
+		close(attached)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// get and list on the same volume complete while attach is in progress
+	_, err := p.Run("get", "vol1", nil)
+	assert.Nil(t, err)
+	_, err = p.Run("list", "", nil)
+	assert.Nil(t, err)
+
+	// detach on the same volume waits for attach
+	detached := make(chan struct{})
+	go func() {
+		p.Run("detach", "vol1@datastore1", nil)
+		close(detached)
+	}()
+	select {
+	case <-detached:
+		t.Fatal("detach completed before attach")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(runner.release)
+	<-attached
+	<-detached
+
+	assert.Equal(t, "attach vol1", runner.order[0])
+	assert.Equal(t, "detach vol1@datastore1", runner.order[len(runner.order)-1])
+}
+
+func TestPipelineBound(t *testing.T) {
+	runner := newBlockingCmd()
+	p := vmdkops.NewCmdPipeline(runner, 2)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"vol1", "vol2", "vol3", "vol4", "vol5"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.Run("create", name, nil)
+		}(name)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 5, len(runner.order))
+	assert.True(t, runner.maxSeen <= 2, "too many parallel requests: %d", runner.maxSeen)
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	runner := newBlockingCmd()
+	ops := vmdkops.VmdkOps{
+		Cmd:      vmdkops.NewCmdPipeline(runner, 4),
+		Timeouts: map[string]time.Duration{"attach": 20 * time.Millisecond},
+	}
+
+	// attach does not complete in time
+	_, err := ops.Attach("vol1", nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Timed out")
+	}
+
+	// detach queued behind the stuck attach is cancelled while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	detached := make(chan error)
+	go func() {
+		detached <- ops.DetachContext(ctx, "vol1", nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	err = <-detached
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Cancelled")
+	}
+
+	close(runner.release)
+	runner.mtx.Lock()
+	assert.Equal(t, []string{"attach vol1"}, runner.order)
+	runner.mtx.Unlock()
+}
+
+func TestPipelineWithoutTimeout(t *testing.T) {
+	runner := newBlockingCmd()
+	ops := vmdkops.VmdkOps{
+		Cmd:      vmdkops.NewCmdPipeline(runner, 4),
+		Timeouts: map[string]time.Duration{"attach": 20 * time.Millisecond},
+	}
+
+	attached := make(chan error)
+	go func() {
+		_, err := ops.RawAttachContext(vmdkops.WithoutTimeout(context.Background()), "vol1", nil)
+		attached <- err
+	}()
+	select {
+	case err := <-attached:
+		t.Fatalf("attach did not wait past the timeout: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(runner.release)
+	assert.Nil(t, <-attached)
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Errors returned by VmdkOps, classified by kind.
+//
+// ESX service sends an error code along with the error message in replies
+// (see err() in esx_service/vmdk_ops.py). Older servers only send the message,
+// then the kind is guessed from the message text.
+
+package vmdkops
+
+import (
+	"strings"
+)
+
+// ErrorKind tells what kind of failure an EsxError is
+type ErrorKind int
+
+const (
+	// ErrUnknown - any error not classified below
+	ErrUnknown ErrorKind = iota
+	// ErrNotFound - the volume does not exist
+	ErrNotFound
+	// ErrAlreadyExists - the volume already exists
+	ErrAlreadyExists
+	// ErrAccessDenied - the VM has no privilege for the operation (vmgroup access control)
+	ErrAccessDenied
+	// ErrQuotaExceeded - the volume size or total size exceeds the vmgroup limits
+	ErrQuotaExceeded
+	// ErrDatastoreUnavailable - the datastore does not exist or cannot be used
+	ErrDatastoreUnavailable
+	// ErrTransportFailure - the request could not be delivered to ESX service, or no reply received
+	ErrTransportFailure
+	// ErrVersionMismatch - client and server protocol versions differ
+	ErrVersionMismatch
+)
+
+// errorCodes maps error codes sent by ESX service to error kinds.
+// Keep in sync with ERR_* in esx_service/vmdk_ops.py
+var errorCodes = map[string]ErrorKind{
+	"NotFound":             ErrNotFound,
+	"AlreadyExists":        ErrAlreadyExists,
+	"AccessDenied":         ErrAccessDenied,
+	"QuotaExceeded":        ErrQuotaExceeded,
+	"DatastoreUnavailable": ErrDatastoreUnavailable,
+	"TransportFailure":     ErrTransportFailure,
+	"VersionMismatch":      ErrVersionMismatch,
+}
+
+// errorPatterns guess the kind of errors from servers not sending error codes.
+// Checked in order, the first match wins.
+var errorPatterns = []struct {
+	text string
+	kind ErrorKind
+}{
+	{"protocol version", ErrVersionMismatch},
+	{"not found", ErrNotFound},
+	{"already exists", ErrAlreadyExists},
+	{"exceeds the max volume size", ErrQuotaExceeded},
+	{"exceeds the usage quota", ErrQuotaExceeded},
+	{"privilege", ErrAccessDenied},
+	{"does not belong to any vmgroup", ErrAccessDenied},
+	{"Invalid datastore", ErrDatastoreUnavailable},
+}
+
+// String returns the error code for the kind, as sent by ESX service
+func (k ErrorKind) String() string {
+	for code, kind := range errorCodes {
+		if kind == k {
+			return code
+		}
+	}
+	return "Unknown"
+}
+
+// EsxError is an error from ESX service or from talking to it
+type EsxError struct {
+	Kind    ErrorKind
+	Msg     string
+	Guessed bool // Kind guessed from Msg, the server sent no error code
+}
+
+func (e EsxError) Error() string {
+	return e.Msg
+}
+
+// newEsxError returns an error for the message and error code received from ESX service
+func newEsxError(msg string, code string) EsxError {
+	if kind, exists := errorCodes[code]; exists {
+		return EsxError{Kind: kind, Msg: msg}
+	}
+	for _, p := range errorPatterns {
+		if strings.Contains(msg, p.text) {
+			return EsxError{Kind: p.kind, Msg: msg, Guessed: true}
+		}
+	}
+	return EsxError{Kind: ErrUnknown, Msg: msg, Guessed: true}
+}
+
+// KindOf returns the kind of err, ErrUnknown if err is not an EsxError
+func KindOf(err error) ErrorKind {
+	if e, ok := err.(EsxError); ok {
+		return e.Kind
+	}
+	return ErrUnknown
+}
+
+// ReportedKindOf returns the kind of err if it is certain, ErrUnknown if it is
+// guessed from the message of a server not sending error codes
+func ReportedKindOf(err error) ErrorKind {
+	if e, ok := err.(EsxError); ok && !e.Guessed {
+		return e.Kind
+	}
+	return ErrUnknown
+}
@@ -0,0 +1,164 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build linux windows
+
+// Protocol version negotiation with ESX service.
+//
+// Before the first request VmdkOps sends "handshake" with the protocol
+// versions the client supports. The server picks the version to use and
+// reports its capabilities. The result is cached until the server rejects the
+// version in use, e.g. after ESX service is upgraded or downgraded.
+// Servers predating the handshake reply with an error, then the client keeps
+// using clientProtocolVersion and assumes legacyCapabilities.
+
+package vmdkops
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const handshakeCmd = "handshake"
+
+// Capabilities ESX service may report on handshake
+const (
+	CapClone          = "clone"           // clone-from option on create
+	CapVsanPolicy     = "vsan-policy"     // vsan-policy-name option on create
+	CapAccessModes    = "access-modes"    // access option on create
+	CapResize         = "resize"          // resize command
+	CapSnapshot       = "snapshot"        // snapshot commands, from-snapshot option on create
+	CapFsOptions      = "fs-options"      // mkfs-opts and mount-opts options on create
+	CapBlockMode      = "block-mode"      // volume-mode option on create
+	CapEncryption     = "encryption"      // encryption option on create
+	CapIoLimits       = "io-limits"       // iops-limit and bps-limit options on create
+	CapLabels         = "labels"          // labels option on create
+	CapListDatastores = "list-datastores" // listDatastores command
+	CapListAttached   = "list-attached"   // listAttached command
+)
+
+// legacyCapabilities are assumed for servers not supporting handshake.
+// Features added after the handshake must not be listed here.
+var legacyCapabilities = []string{CapClone, CapVsanPolicy, CapAccessModes}
+
+// ServerInfo is what we learned about ESX service on handshake
+type ServerInfo struct {
+	Version      string   // protocol version to use for requests
+	Versions     []string // protocol versions supported by the server
+	Capabilities []string // features supported by the server
+	Legacy       bool     `json:"-"` // server does not support handshake
+}
+
+// HasCapability checks whether the server supports the feature
+func (s *ServerInfo) HasCapability(capability string) bool {
+	for _, c := range s.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// serverInfoCache keeps the handshake result, shared by all copies of VmdkOps
+type serverInfoCache struct {
+	mtx  *sync.Mutex
+	info *ServerInfo
+}
+
+func newServerInfoCache() *serverInfoCache {
+	return &serverInfoCache{mtx: &sync.Mutex{}}
+}
+
+// invalidate drops info from the cache, so the next request does the handshake again.
+// Does nothing if info was replaced already by another request.
+func (c *serverInfoCache) invalidate(info *ServerInfo) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.info == info {
+		c.info = nil
+	}
+}
+
+// legacyServerInfo returns ServerInfo for servers not supporting handshake
+func legacyServerInfo() *ServerInfo {
+	return &ServerInfo{
+		Version:      clientProtocolVersion,
+		Versions:     []string{clientProtocolVersion},
+		Capabilities: legacyCapabilities,
+		Legacy:       true,
+	}
+}
+
+// ServerInfoContext returns ESX service version and capabilities, doing the handshake
+// on first call. Failures to reach the server are not cached, the next call retries.
+func (v VmdkOps) ServerInfoContext(ctx context.Context) (*ServerInfo, error) {
+	if v.server == nil {
+		// VmdkOps not created by NewVmdkOps, no handshake
+		return legacyServerInfo(), nil
+	}
+
+	v.server.mtx.Lock()
+	defer v.server.mtx.Unlock()
+	if v.server.info != nil {
+		return v.server.info, nil
+	}
+
+	info, err := v.handshake(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(log.Fields{"version": info.Version, "capabilities": info.Capabilities,
+		"legacy": info.Legacy}).Info("Handshake with ESX service completed ")
+	v.server.info = info
+	return info, nil
+}
+
+// handshake negotiates the protocol version with the server
+func (v VmdkOps) handshake(ctx context.Context) (*ServerInfo, error) {
+	opts := map[string]string{"versions": strings.Join(supportedProtocolVersions, ",")}
+	str, err := v.send(ctx, handshakeCmd, "", opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		switch KindOf(err) {
+		case ErrTransportFailure, ErrVersionMismatch:
+			return nil, err
+		}
+		// Servers predating handshake reply "Unknown command", or fail even earlier on the empty volume name
+		log.WithFields(log.Fields{"error": err}).Info("ESX service does not support handshake ")
+		return legacyServerInfo(), nil
+	}
+
+	var info ServerInfo
+	if err = json.Unmarshal(str, &info); err != nil || info.Version == "" {
+		log.WithFields(log.Fields{"reply": string(str)}).Warning("Unexpected handshake reply, assuming old server ")
+		return legacyServerInfo(), nil
+	}
+	for _, version := range supportedProtocolVersions {
+		if version == info.Version {
+			return &info, nil
+		}
+	}
+	return nil, EsxError{
+		Kind: ErrVersionMismatch,
+		Msg: fmt.Sprintf("ESX service picked protocol version %s, vDVS plugin supports %v",
+			info.Version, supportedProtocolVersions),
+	}
+}
@@ -36,8 +36,19 @@ type MockVmdkCmd struct{}
 const (
 	backingRoot     = "/tmp/docker-volumes" // Files for loopback device backing stored here
 	fileSizeInBytes = 100 * 1024 * 1024     // file size for loopback block device
+	snapshotSuffix  = ".snapshot-of"        // next to the backing file of a snapshot, holds the volume name
+	optionsSuffix   = ".options"            // next to the backing file, holds the options the volume was created with
+	attachedSuffix  = ".attached"           // next to the backing file of a volume attached to the VM
+	mockDatastore   = "mockDatastore"       // the only datastore of the mock
 )
 
+// mockCapabilities are the capabilities of the mock, same as those of ESX service
+var mockCapabilities = []string{CapClone, CapVsanPolicy, CapAccessModes, CapResize, CapSnapshot,
+	CapFsOptions, CapBlockMode, CapEncryption, CapIoLimits, CapLabels, CapListDatastores, CapListAttached}
+
+// mockSuffixes are the suffixes of files kept next to backing files
+var mockSuffixes = []string{snapshotSuffix, optionsSuffix, attachedSuffix}
+
 // NewMockCmd returns a new instance of MockVmdkCmd.
 func NewMockCmd() MockVmdkCmd {
 	return MockVmdkCmd{}
@@ -61,19 +72,51 @@ func (mockCmd MockVmdkCmd) Run(cmd string, name string, opts map[string]string)
 	log.WithFields(log.Fields{"cmd": cmd}).Debug("Running Mock Cmd")
 	switch cmd {
 	case "create":
+		if snapshot, exists := opts["from-snapshot"]; exists {
+			return nil, createFromSnapshot(name, snapshot)
+		}
 		err := createBlockDevice(name, opts)
-		return nil, err
+		if err != nil {
+			return nil, err
+		}
+		return nil, saveOptions(name, opts)
 	case "list":
 		return list()
+	case "listDatastores":
+		return listDatastores()
+	case "listAttached":
+		return listAttached()
+	case "snapshot":
+		return nil, createSnapshot(name, opts["snapshot"])
+	case "listSnapshots":
+		return listSnapshots(name)
+	case "removeSnapshot":
+		return nil, removeSnapshot(name, opts["snapshot"])
+	case "revertSnapshot":
+		return nil, revertSnapshot(name, opts["snapshot"])
 	case "get":
-		return nil, get(name)
+		return getMetadata(name)
 	case "attach":
-		return getBlockDeviceForName(name)
+		device, err := getBlockDeviceForName(name)
+		if err != nil {
+			return nil, err
+		}
+		return device, ioutil.WriteFile(getBackingFileName(name)+attachedSuffix, nil, 0644)
 	case "detach":
+		os.Remove(getBackingFileName(name) + attachedSuffix)
 		return nil, nil
 	case "remove":
 		err := remove(name)
 		return nil, err
+	case "resize":
+		err := resize(name, opts)
+		return nil, err
+	case handshakeCmd:
+		return json.Marshal(ServerInfo{
+			Version:      clientProtocolVersion,
+			Versions:     supportedProtocolVersions,
+			Capabilities: mockCapabilities,
+		})
 	}
 	return []byte("null"), nil
 }
@@ -86,16 +129,102 @@ func list() ([]byte, error) {
 	}
 	volumes := make([]VolumeData, 0, len(files))
 	for _, file := range files {
-		volumes = append(volumes, VolumeData{Name: file.Name()})
+		if isMockSidecar(file.Name()) {
+			continue
+		}
+		attributes := make(map[string]string)
+		if labels := loadOptions(file.Name())["labels"]; labels != "" {
+			attributes["labels"] = labels
+		}
+		volumes = append(volumes, VolumeData{Name: file.Name(), Attributes: attributes})
 	}
 	return json.Marshal(volumes)
 }
 
+// isMockSidecar checks whether file is kept next to a backing file rather than a backing file
+func isMockSidecar(file string) bool {
+	for _, suffix := range mockSuffixes {
+		if strings.HasSuffix(file, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// listDatastores returns the mock datastore, sized as the filesystem of backingRoot
+func listDatastores() ([]byte, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(backingRoot, &stat); err != nil {
+		return nil, fmt.Errorf("Failed to get size of %s: %s", backingRoot, err)
+	}
+	return json.Marshal([]DatastoreData{{
+		Name:     mockDatastore,
+		Capacity: stat.Blocks * uint64(stat.Bsize),
+		Free:     stat.Bavail * uint64(stat.Bsize),
+	}})
+}
+
+// listAttached returns the volumes attached and not detached since
+func listAttached() ([]byte, error) {
+	rootName := fmt.Sprintf("%s/%d", backingRoot, os.Getpid())
+	files, err := ioutil.ReadDir(rootName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s", backingRoot)
+	}
+	volumes := make([]VolumeData, 0)
+	for _, file := range files {
+		if name := strings.TrimSuffix(file.Name(), attachedSuffix); name != file.Name() {
+			volumes = append(volumes, VolumeData{Name: name})
+		}
+	}
+	return json.Marshal(volumes)
+}
+
+// saveOptions keeps the options volume name was created with, reported by get
+func saveOptions(name string, opts map[string]string) error {
+	content, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getBackingFileName(name)+optionsSuffix, content, 0644)
+}
+
+// loadOptions returns the options volume name was created with, none if unknown
+func loadOptions(name string) map[string]string {
+	opts := make(map[string]string)
+	if content, err := ioutil.ReadFile(getBackingFileName(name) + optionsSuffix); err == nil {
+		json.Unmarshal(content, &opts)
+	}
+	return opts
+}
+
+// getMetadata returns the metadata of the volume like ESX service does, with
+// the options it was created with and its labels as a map
+func getMetadata(name string) ([]byte, error) {
+	if err := get(name); err != nil {
+		return nil, err
+	}
+	metadata := make(map[string]interface{})
+	for key, value := range loadOptions(name) {
+		metadata[key] = value
+	}
+	if labels, exists := metadata["labels"]; exists {
+		parsed := make(map[string]string)
+		for _, label := range strings.Split(labels.(string), ",") {
+			if kv := strings.SplitN(label, "=", 2); len(kv) == 2 {
+				parsed[kv[0]] = kv[1]
+			}
+		}
+		metadata["labels"] = parsed
+	}
+	return json.Marshal(metadata)
+}
+
 // validates that the volume exists, returns error or nil (for OK)
 func get(name string) error {
 	filePath := getBackingFileName(name)
 	if _, err := os.Lstat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("Unknown volume %s", name)
+		return EsxError{Kind: ErrNotFound, Msg: fmt.Sprintf("Volume %s not found", name)}
 	} else if err != nil {
 		return err
 	}
@@ -104,13 +233,12 @@ func get(name string) error {
 
 func remove(name string) error {
 	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+	device, err := deviceOf(name)
 	if err != nil {
-		return fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return err
 	}
-	device := strings.TrimRight(string(out), " \n")
 	fmt.Printf("Detaching loopback device %s\n", device)
-	out, err = exec.Command("losetup", "-d", device).CombinedOutput()
+	out, err := exec.Command("losetup", "-d", device).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Failed to detach loopback device node %s with error: %s. Output = %s",
 			device, err, out)
@@ -119,28 +247,219 @@ func remove(name string) error {
 	if err != nil {
 		return fmt.Errorf("Failed to remove backing file %s: %s", backing, err)
 	}
+	for _, suffix := range mockSuffixes {
+		os.Remove(backing + suffix)
+	}
 	return os.Remove(device)
 }
 
-func createBlockDevice(label string, opts map[string]string) error {
+// createSnapshot copies the backing file of the volume, the copy is shared
+// copy-on-write where the filesystem supports reflinks.
+func createSnapshot(name string, snapshot string) error {
+	if snapshot == "" {
+		return fmt.Errorf("Snapshot name is required")
+	}
+	err := copyBlockDevice(name, snapshot)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getBackingFileName(snapshot)+snapshotSuffix, []byte(name), 0644)
+}
+
+// snapshotOf returns the volume snapshot was taken of, or an error if snapshot is not a snapshot
+func snapshotOf(snapshot string) (string, error) {
+	if err := get(snapshot); err != nil {
+		return "", err
+	}
+	name, err := ioutil.ReadFile(getBackingFileName(snapshot) + snapshotSuffix)
+	if err != nil {
+		return "", fmt.Errorf("Volume %s is not a snapshot", snapshot)
+	}
+	return string(name), nil
+}
+
+// checkSnapshot verifies snapshot is a snapshot of volume name
+func checkSnapshot(name string, snapshot string) error {
+	of, err := snapshotOf(snapshot)
+	if err != nil {
+		return err
+	}
+	if of != name {
+		return fmt.Errorf("Volume %s is not a snapshot of %s", snapshot, name)
+	}
+	return nil
+}
+
+func listSnapshots(name string) ([]byte, error) {
+	if err := get(name); err != nil {
+		return nil, err
+	}
+	rootName := fmt.Sprintf("%s/%d", backingRoot, os.Getpid())
+	files, err := ioutil.ReadDir(rootName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s", backingRoot)
+	}
+	snapshots := make([]VolumeData, 0)
+	for _, file := range files {
+		snapshot := strings.TrimSuffix(file.Name(), snapshotSuffix)
+		if snapshot == file.Name() {
+			continue
+		}
+		if of, err := snapshotOf(snapshot); err == nil && of == name {
+			snapshots = append(snapshots, VolumeData{Name: snapshot})
+		}
+	}
+	return json.Marshal(snapshots)
+}
+
+func removeSnapshot(name string, snapshot string) error {
+	if err := checkSnapshot(name, snapshot); err != nil {
+		return err
+	}
+	return remove(snapshot)
+}
+
+// createFromSnapshot creates a writable volume with the content of snapshot
+func createFromSnapshot(name string, snapshot string) error {
+	if _, err := snapshotOf(snapshot); err != nil {
+		return err
+	}
+	return copyBlockDevice(snapshot, name)
+}
+
+// revertSnapshot copies the snapshot over the backing file of the volume
+func revertSnapshot(name string, snapshot string) error {
+	if err := checkSnapshot(name, snapshot); err != nil {
+		return err
+	}
+	device, err := deviceOf(name)
+	if err != nil {
+		return err
+	}
+	backing := getBackingFileName(name)
+	out, err := exec.Command("cp", "--reflink=auto", "--sparse=always",
+		getBackingFileName(snapshot), backing).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy snapshot %s to %s: %s. Output = %s", snapshot, backing, err, out)
+	}
+	// Drop cached blocks of the old content, and pick up the size of the snapshot
+	exec.Command("blockdev", "--flushbufs", device).CombinedOutput()
+	out, err = exec.Command("losetup", "-c", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to refresh loopback device %s: %s. Output = %s", device, err, out)
+	}
+	return setLabel(device, name)
+}
+
+// copyBlockDevice creates volume label as a copy of volume src
+func copyBlockDevice(src string, label string) error {
+	if err := get(src); err != nil {
+		return err
+	}
 	backing := getBackingFileName(label)
-	err := createBackingFile(backing)
+	if _, err := os.Lstat(backing); err == nil {
+		return EsxError{Kind: ErrAlreadyExists, Msg: fmt.Sprintf("Volume backing file %s already exists", backing)}
+	}
+	out, err := exec.Command("cp", "--reflink=auto", "--sparse=always",
+		getBackingFileName(src), backing).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to copy %s to %s: %s. Output = %s", src, backing, err, out)
+	}
+	device, err := attachBackingFile(backing)
 	if err != nil {
 		return err
 	}
-	loopbackCount := getMaxLoopbackCount() + 1
-	device := fmt.Sprintf("/dev/loop%d", loopbackCount)
-	err = createDeviceNode(device, loopbackCount)
+	// Copies keep the options of the source
+	if err = saveOptions(label, loadOptions(src)); err != nil {
+		return err
+	}
+	return setLabel(device, label)
+}
+
+// setLabel sets the filesystem label of a copied volume to its name, as for new volumes.
+// XFS also refuses to mount filesystems with duplicate UUIDs, so a new UUID is generated.
+func setLabel(device string, label string) error {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", device).CombinedOutput()
+	if err != nil {
+		// No filesystem, e.g. copy of a block-mode volume
+		return nil
+	}
+	var cmd *exec.Cmd
+	switch fstype := strings.TrimRight(string(out), " \n"); fstype {
+	case "ext2", "ext3", "ext4":
+		cmd = exec.Command("e2label", device, label)
+	case "xfs":
+		cmd = exec.Command("xfs_admin", "-L", label, "-U", "generate", device)
+	default:
+		return fmt.Errorf("Copying %s volumes is not supported by the mock", fstype)
+	}
+	out, err = cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to set label of %s: %s. Output = %s", device, err, out)
+	}
+	return nil
+}
+
+// resize grows the backing file and lets the loopback device pick up the new size
+func resize(name string, opts map[string]string) error {
+	size, err := sizeToBytes(opts["size"])
 	if err != nil {
 		return err
 	}
-	// Ignore output. This is to prevent spurious failures from old devices
-	// that were removed, but not detached.
-	exec.Command("losetup", "-d", device).CombinedOutput()
-	err = setupLoopbackDevice(backing, device)
+	backing := getBackingFileName(name)
+	stat, err := os.Stat(backing)
+	if os.IsNotExist(err) {
+		return EsxError{Kind: ErrNotFound, Msg: fmt.Sprintf("Volume %s not found", name)}
+	} else if err != nil {
+		return err
+	}
+	if size <= stat.Size() {
+		return fmt.Errorf("Volume %s can only grow, current size is %d bytes", name, stat.Size())
+	}
+	err = os.Truncate(backing, size)
+	if err != nil {
+		return fmt.Errorf("Failed to grow backing file %s: %s", backing, err)
+	}
+
+	device, err := deviceOf(name)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command("losetup", "-c", device).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to refresh size of loopback device %s: %s. Output = %s",
+			device, err, out)
+	}
+	return nil
+}
+
+// sizeToBytes converts volume size in <int>mb/gb/tb format to bytes
+func sizeToBytes(size string) (int64, error) {
+	units := map[string]int64{"mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40}
+	size = strings.ToLower(size)
+	if len(size) > 2 {
+		if unit, exists := units[size[len(size)-2:]]; exists {
+			if n, err := strconv.ParseInt(size[:len(size)-2], 10, 64); err == nil {
+				return n * unit, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("Invalid size %q, valid sizes are <int>mb/gb/tb", size)
+}
+
+func createBlockDevice(label string, opts map[string]string) error {
+	backing := getBackingFileName(label)
+	err := createBackingFile(backing)
+	if err != nil {
+		return err
+	}
+	device, err := attachBackingFile(backing)
 	if err != nil {
 		return err
 	}
+	if opts["volume-mode"] == "block" {
+		return nil
+	}
 	// Use default fstype if not specified
 	if _, result := opts["fstype"]; result == false {
 		opts["fstype"] = fs.FstypeDefault
@@ -149,19 +468,47 @@ func createBlockDevice(label string, opts map[string]string) error {
 	if errFstype != nil {
 		return fmt.Errorf("Not found mkfs for %s", opts["fstype"])
 	}
-	return fs.MkfsByDevicePath(opts["fstype"], label, device)
+	return fs.MkfsByDevicePath(opts["fstype"], label, device, opts["mkfs-opts"])
+}
+
+// attachBackingFile sets up a new loopback device for the backing file
+func attachBackingFile(backing string) (string, error) {
+	loopbackCount := getMaxLoopbackCount() + 1
+	device := fmt.Sprintf("/dev/loop%d", loopbackCount)
+	err := createDeviceNode(device, loopbackCount)
+	if err != nil {
+		return "", err
+	}
+	// Ignore output. This is to prevent spurious failures from old devices
+	// that were removed, but not detached.
+	exec.Command("losetup", "-d", device).CombinedOutput()
+	err = setupLoopbackDevice(backing, device)
+	if err != nil {
+		return "", err
+	}
+	return device, nil
 }
 
 func getBlockDeviceForName(name string) ([]byte, error) {
-	backing := getBackingFileName(name)
-	out, err := exec.Command("blkid", []string{"-L", name}...).CombinedOutput()
+	device, err := deviceOf(name)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to find device for backing file %s via blkid", backing)
+		return nil, err
 	}
-	device := strings.TrimRight(string(out), " \n")
 	return []byte(device), nil
 }
 
+// deviceOf returns the loopback device of volume name, found by its backing file
+// as block-mode volumes have no filesystem label
+func deviceOf(name string) (string, error) {
+	backing := getBackingFileName(name)
+	out, err := exec.Command("losetup", "-j", backing).CombinedOutput()
+	if err != nil || len(out) == 0 {
+		return "", fmt.Errorf("Failed to find device for backing file %s via losetup", backing)
+	}
+	// "/dev/loop1001: [2049]:1234 (/tmp/docker-volumes/...)"
+	return strings.SplitN(string(out), ":", 2)[0], nil
+}
+
 func getMaxLoopbackCount() int {
 	// always start at 1000
 	count := 1000
@@ -183,7 +530,9 @@ func getMaxLoopbackCount() int {
 func createBackingFile(backing string) error {
 	flags := syscall.O_RDWR | syscall.O_CREAT | syscall.O_EXCL
 	file, err := os.OpenFile(backing, flags, 0755)
-	if err != nil {
+	if os.IsExist(err) {
+		return EsxError{Kind: ErrAlreadyExists, Msg: fmt.Sprintf("Volume backing file %s already exists", backing)}
+	} else if err != nil {
 		return fmt.Errorf("Failed to create backing file %s: %s", backing, err)
 	}
 	err = syscall.Fallocate(int(file.Fd()), 0, 0, fileSizeInBytes)
@@ -0,0 +1,147 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// A pure Go implementation of the VmdkCmdRunner interface.
+// It speaks the same protocol as EsxVmdkCmd, but over any net.Conn returned
+// by Dial: AF_VSOCK on a real Guest VM (see NewVsockCmd) or a unix/TCP
+// socket to a fake ESX service in tests.
+
+package vmdkops
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SockVmdkCmd struct - sends VMDK commands over connections created by Dial
+type SockVmdkCmd struct {
+	Dial func() (net.Conn, error) // Opens a new connection to ESX service
+}
+
+// NewVsockCmd returns a SockVmdkCmd talking to ESX service over vSocket on the given port.
+func NewVsockCmd(port int) SockVmdkCmd {
+	return SockVmdkCmd{
+		Dial: func() (net.Conn, error) {
+			return DialVsock(port)
+		},
+	}
+}
+
+// Run command Guest VM requests on ESX.
+// *
+// * For each request:
+// *   - Dials a new connection
+// *   - Sends json string up to ESX
+// *   - waits for reply and returns resulting JSON or an error
+func (sockCmd SockVmdkCmd) Run(cmd string, name string, opts map[string]string) ([]byte, error) {
+	return sockCmd.RunContext(context.Background(), cmd, name, opts)
+}
+
+// RunContext is Run giving up when ctx is done. The connection is closed
+// on cancellation, so ESX service sees the request aborted.
+func (sockCmd SockVmdkCmd) RunContext(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	jsonStr, err := marshalRequest(ctx, cmd, name, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	for i := 0; i <= maxRetryCount; i++ {
+		response, err = sockCmd.getReply(ctx, jsonStr)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		msg := fmt.Sprintf("Run '%s' failed: %v", cmd, err)
+		if i < maxRetryCount {
+			log.Warnf("%s Retrying...", msg)
+			select {
+			case <-time.After(retryInterval):
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if isConnLost(err) {
+			msg += esxCommFaqMsg
+		}
+		log.Warn(msg)
+		return nil, EsxError{Kind: ErrTransportFailure, Msg: msg}
+	}
+
+	err = unmarshalError(response)
+	if err != nil {
+		return nil, err
+	}
+	// There was no error, so return the slice containing the json response
+	return response, nil
+}
+
+// getReply sends one request over a new connection and waits for the reply
+func (sockCmd SockVmdkCmd) getReply(ctx context.Context, request []byte) ([]byte, error) {
+	conn, err := sockCmd.Dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Unblock reads and writes when ctx is done
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	replied := make(chan struct{})
+	defer close(replied)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-replied:
+		}
+	}()
+
+	err = writeMessage(conn, request)
+	if err != nil {
+		return nil, err
+	}
+	return readMessage(conn)
+}
+
+// isConnLost checks whether err means ESX service went away mid-request
+func isConnLost(err error) bool {
+	for {
+		switch e := err.(type) {
+		case transferError:
+			err = e.err
+		case *os.SyscallError:
+			err = e.Err
+		case syscall.Errno:
+			return e == syscall.ECONNRESET || e == syscall.ETIMEDOUT
+		case *net.OpError:
+			err = e.Err
+		case net.Error:
+			return e.Timeout()
+		default:
+			return false
+		}
+	}
+}
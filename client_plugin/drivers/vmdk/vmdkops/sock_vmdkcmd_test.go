@@ -0,0 +1,247 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdkops_test
+
+// Test SockVmdkCmd wire protocol against a fake ESX service on a unix socket.
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers/vmdk/vmdkops"
+)
+
+const fakeEsxMagic uint32 = 0xbadbeef
+
+// fakeRequest is what vmdk-opsd expects to find in a request
+type fakeRequest struct {
+	Cmd     string `json:"cmd"`
+	Version string `json:"version"`
+	Details struct {
+		Name string            `json:"Name"`
+		Opts map[string]string `json:"Opts"`
+	} `json:"details"`
+}
+
+// startFakeEsx serves requests on a unix socket, replying with handler's answer
+func startFakeEsx(t *testing.T, handler func(req fakeRequest) string) (string, func()) {
+	dir, err := ioutil.TempDir("", "fake-esx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "vmdk-opsd.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			serveFakeEsx(t, conn, handler)
+		}
+	}()
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func serveFakeEsx(t *testing.T, conn net.Conn, handler func(req fakeRequest) string) {
+	defer conn.Close()
+	var magic, mlen uint32
+	binary.Read(conn, binary.LittleEndian, &magic)
+	binary.Read(conn, binary.LittleEndian, &mlen)
+	buf := make([]byte, mlen)
+	if _, err := io.ReadFull(conn, buf); err != nil || magic != fakeEsxMagic {
+		t.Errorf("Bad request framing: magic=0x%x err=%v", magic, err)
+		return
+	}
+	if buf[mlen-1] != 0 {
+		t.Errorf("Request is not NUL terminated: %q", buf)
+	}
+	var req fakeRequest
+	if err := json.Unmarshal(buf[:mlen-1], &req); err != nil {
+		t.Errorf("Bad request json %q: %v", buf, err)
+		return
+	}
+	reply := handler(req)
+	binary.Write(conn, binary.LittleEndian, fakeEsxMagic)
+	binary.Write(conn, binary.LittleEndian, uint32(len(reply)+1))
+	conn.Write(append([]byte(reply), 0))
+}
+
+func newSockOps(sock string) vmdkops.VmdkOps {
+	return vmdkops.NewVmdkOps(vmdkops.SockVmdkCmd{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	})
+}
+
+func TestSockCmd(t *testing.T) {
+	sock, stop := startFakeEsx(t, func(req fakeRequest) string {
+		assert.Equal(t, "2", req.Version)
+		switch req.Cmd {
+		case "get":
+			if req.Details.Name == "vol1" {
+				return `{"datastore": "ds1", "fstype": "ext4"}`
+			}
+			return `{"Error": "Volume vol2 not found (file: /vmfs/volumes/ds1/dockvols/_DEFAULT/vol2.vmdk)"}`
+		case "create":
+			assert.Equal(t, "10gb", req.Details.Opts["size"])
+			return "null"
+		case "remove":
+			return `{"Error": "No delete privilege", "ErrorCode": "AccessDenied"}`
+		}
+		return `{"Error": "Unknown command"}`
+	})
+	defer stop()
+
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.SockVmdkCmd{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+
+	assert.Nil(t, ops.Create("vol1", map[string]string{"size": "10gb"}))
+
+	status, err := ops.Get("vol1")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "ds1", status["datastore"])
+	}
+
+	// old servers send no error code
+	_, err = ops.Get("vol2")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "not found")
+		assert.Equal(t, vmdkops.ErrNotFound, vmdkops.KindOf(err))
+		assert.Equal(t, vmdkops.ErrUnknown, vmdkops.ReportedKindOf(err))
+	}
+
+	err = ops.Remove("vol1", nil)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "No delete privilege", err.Error())
+		assert.Equal(t, vmdkops.ErrAccessDenied, vmdkops.KindOf(err))
+		assert.Equal(t, vmdkops.ErrAccessDenied, vmdkops.ReportedKindOf(err))
+	}
+}
+
+func TestSockCreateExisting(t *testing.T) {
+	sock, stop := startFakeEsx(t, func(req fakeRequest) string {
+		if req.Cmd == "create" {
+			// As createVMDK replies when the volume exists already
+			return `{"Error": "Volume vol1 already exists", "ErrorCode": "AlreadyExists"}`
+		}
+		return `{"Error": "Unknown command"}`
+	})
+	defer stop()
+
+	ops := vmdkops.VmdkOps{Cmd: vmdkops.SockVmdkCmd{
+		Dial: func() (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	err := ops.Create("vol1", map[string]string{"size": "10gb"})
+	if assert.NotNil(t, err, "Create of an existing volume should fail for the driver to adopt it") {
+		assert.Equal(t, vmdkops.ErrAlreadyExists, vmdkops.ReportedKindOf(err))
+	}
+}
+
+func TestSockHandshake(t *testing.T) {
+	var handshakes int32
+	sock, stop := startFakeEsx(t, func(req fakeRequest) string {
+		switch req.Cmd {
+		case "handshake":
+			atomic.AddInt32(&handshakes, 1)
+			assert.Equal(t, "2", req.Details.Opts["versions"])
+			return `{"Version": "2", "Versions": ["2", "3"], "Capabilities": ["clone"]}`
+		case "get":
+			return `{"datastore": "ds1"}`
+		}
+		return `{"Error": "Unknown command"}`
+	})
+	defer stop()
+
+	ops := newSockOps(sock)
+	for i := 0; i < 2; i++ {
+		_, err := ops.Get("vol1")
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handshakes), "handshake result is not cached")
+
+	info, err := ops.ServerInfoContext(context.Background())
+	if assert.Nil(t, err) {
+		assert.False(t, info.Legacy)
+		assert.True(t, info.HasCapability(vmdkops.CapClone))
+		assert.False(t, info.HasCapability(vmdkops.CapVsanPolicy))
+	}
+}
+
+func TestSockHandshakeRedone(t *testing.T) {
+	var handshakes, gets int32
+	sock, stop := startFakeEsx(t, func(req fakeRequest) string {
+		switch req.Cmd {
+		case "handshake":
+			atomic.AddInt32(&handshakes, 1)
+			return `{"Version": "2", "Versions": ["2"], "Capabilities": ["clone"]}`
+		case "get":
+			// ESX service restarted with another version after the first handshake
+			if atomic.AddInt32(&gets, 1) == 1 {
+				return `{"Error": "Unsupported protocol version", "ErrorCode": "VersionMismatch"}`
+			}
+			return `{"datastore": "ds1"}`
+		}
+		return `{"Error": "Unknown command"}`
+	})
+	defer stop()
+
+	ops := newSockOps(sock)
+	_, err := ops.Get("vol1")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&handshakes), "handshake is not redone on version mismatch")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&gets))
+}
+
+func TestSockHandshakeOldServer(t *testing.T) {
+	sock, stop := startFakeEsx(t, func(req fakeRequest) string {
+		if req.Cmd == "get" {
+			return `{"datastore": "ds1"}`
+		}
+		return `{"Error": "Unknown command:` + req.Cmd + `"}`
+	})
+	defer stop()
+
+	ops := newSockOps(sock)
+	_, err := ops.Get("vol1")
+	assert.Nil(t, err)
+
+	info, err := ops.ServerInfoContext(context.Background())
+	if assert.Nil(t, err) {
+		assert.True(t, info.Legacy)
+		assert.True(t, info.HasCapability(vmdkops.CapVsanPolicy))
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Client side of the Guest VM <-> ESX protocol, shared by all VmdkCmdRunner
+// implementations talking to vmdk-opsd.
+//
+// Each request is a JSON string framed as follows (see esx_service/vmci):
+//   - uint32 MAGIC
+//   - uint32 length of the message, including the trailing '\0'
+//   - the message itself, '\0' terminated
+// The reply uses the same framing.
+
+package vmdkops
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	maxRetryCount = 5
+	retryInterval = 1 * time.Second // sleep between attempts to reach the ESX service
+	// Server side understand protocol version. If you are changing client/server protocol we use
+	// over VMCI, PLEASE DO NOT FORGET TO CHANGE IT FOR SERVER in file <vmdk_ops.py> !
+	// Used until the version is negotiated with the server (see handshake.go).
+	clientProtocolVersion = "2"
+
+	// vmciMagic prefixes every message on the wire, see connection_types.h
+	vmciMagic uint32 = 0xbadbeef
+	// maxMessageLen is a safety limit. We do not expect json string > 1M
+	maxMessageLen = 1024 * 1024
+
+	esxCommFaqMsg = " Cannot communicate with ESX, please refer to the FAQ https://github.com/vmware/docker-volume-vsphere/wiki#faq"
+)
+
+// supportedProtocolVersions are all protocol versions the client can talk, offered to the server on handshake
+var supportedProtocolVersions = []string{clientProtocolVersion}
+
+// protocolVersionKey is the context key for the negotiated protocol version
+type protocolVersionKey struct{}
+
+// withProtocolVersion returns a copy of ctx making requests use the given protocol version
+func withProtocolVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, protocolVersionKey{}, version)
+}
+
+// vmciByteOrder is the byte order used by the C client and server for the
+// framing words. Both ends run on x86, so it is little endian.
+var vmciByteOrder = binary.LittleEndian
+
+// A request to be passed to ESX service
+type requestToVmci struct {
+	Ops     string     `json:"cmd"`
+	Details VolumeInfo `json:"details"`
+	Version string     `json:"version,omitempty"`
+}
+
+// VolumeInfo we get about the volume from upstairs
+type VolumeInfo struct {
+	Name    string            `json:"Name"`
+	Options map[string]string `json:"Opts,omitempty"`
+}
+
+type vmciError struct {
+	Error     string `json:",omitempty"`
+	ErrorCode string `json:",omitempty"` // see errorCodes
+}
+
+// transferError is an I/O failure while sending or receiving a message,
+// err keeps the original error for the callers to check
+type transferError struct {
+	msg string
+	err error
+}
+
+func (e transferError) Error() string {
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+// marshalRequest builds the JSON request string for the ESX service.
+// The protocol version comes from ctx if negotiated, VDVS_TEST_PROTOCOL_VERSION overrides it in tests.
+func marshalRequest(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	protocolVersion := os.Getenv("VDVS_TEST_PROTOCOL_VERSION")
+	log.Debugf("Run get request: version=%s", protocolVersion)
+	if protocolVersion == "" {
+		protocolVersion = clientProtocolVersion
+		if v, ok := ctx.Value(protocolVersionKey{}).(string); ok {
+			protocolVersion = v
+		}
+	}
+	jsonStr, err := json.Marshal(&requestToVmci{
+		Ops:     cmd,
+		Details: VolumeInfo{Name: name, Options: opts},
+		Version: protocolVersion})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal json: %v", err)
+	}
+	return jsonStr, nil
+}
+
+// writeMessage sends a framed, '\0' terminated message to w
+func writeMessage(w io.Writer, msg []byte) error {
+	if len(msg)+1 > maxMessageLen {
+		return fmt.Errorf("Message too long: %d bytes", len(msg))
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, vmciByteOrder, vmciMagic)
+	binary.Write(&buf, vmciByteOrder, uint32(len(msg)+1))
+	buf.Write(msg)
+	buf.WriteByte(0)
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		return transferError{"Failed to send message", err}
+	}
+	return nil
+}
+
+// readMessage receives a framed message from r and returns it without the trailing '\0'
+func readMessage(r io.Reader) ([]byte, error) {
+	var magic, mlen uint32
+	if err := binary.Read(r, vmciByteOrder, &magic); err != nil {
+		return nil, transferError{"Failed to receive magic data", err}
+	}
+	if magic != vmciMagic {
+		return nil, fmt.Errorf("Wrong magic: got 0x%x expected 0x%x", magic, vmciMagic)
+	}
+	if err := binary.Read(r, vmciByteOrder, &mlen); err != nil {
+		return nil, transferError{"Failed to receive data len", err}
+	}
+	if mlen > maxMessageLen {
+		return nil, fmt.Errorf("Message too long: %d bytes", mlen)
+	}
+	buf := make([]byte, mlen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, transferError{"Failed to receive message data", err}
+	}
+	// Same as C.GoString() - cut at the first '\0'
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return buf, nil
+}
+
+func unmarshalError(str []byte) error {
+	// Unmarshalling null always succeeds
+	if string(str) == "null" {
+		return nil
+	}
+	errStruct := vmciError{}
+	err := json.Unmarshal(str, &errStruct)
+	if err != nil {
+		// We didn't unmarshal an error, so there is no error ;)
+		return nil
+	}
+	if len(errStruct.Error) == 0 {
+		return nil
+	}
+	// Return the unmarshaled error string as an `error`
+	return newEsxError(errStruct.Error, errStruct.ErrorCode)
+}
+
+// retryLocked calls attempt until it succeeds or fails for good, up to maxRetryCount
+// retries interval apart, and gives up retrying once ctx is done. attempt tells whether
+// its failure is worth a retry. mtx, if set, is held during each attempt only, so other
+// requests are sent while one waits for its retry.
+func retryLocked(ctx context.Context, mtx *sync.Mutex, interval time.Duration, attempt func() (bool, error)) error {
+	for i := 0; ; i++ {
+		if mtx != nil {
+			mtx.Lock()
+		}
+		retry, err := attempt()
+		if mtx != nil {
+			mtx.Unlock()
+		}
+		if err == nil || !retry || i == maxRetryCount {
+			return err
+		}
+		log.Warnf("%v Retrying...", err)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdkops
+
+// Test the retries of the default runner don't hold back other requests.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRetryReleasesLock runs a get while an attach sharing the runner lock is
+// retrying, the get must complete before the attach gives up.
+func TestRetryReleasesLock(t *testing.T) {
+	mtx := &sync.Mutex{}
+	attempts := make(chan struct{}, maxRetryCount+1)
+	attachDone := make(chan error)
+
+	go func() {
+		attachDone <- retryLocked(context.Background(), mtx, 50*time.Millisecond, func() (bool, error) {
+			attempts <- struct{}{}
+			return true, errors.New("Run 'attach' failed: connection reset")
+		})
+	}()
+	<-attempts
+
+	getDone := make(chan error)
+	go func() {
+		getDone <- retryLocked(context.Background(), mtx, 50*time.Millisecond, func() (bool, error) {
+			return false, nil
+		})
+	}()
+
+	select {
+	case err := <-getDone:
+		assert.Nil(t, err)
+	case <-attachDone:
+		t.Fatal("Get waited for the attach retries")
+	}
+	assert.NotNil(t, <-attachDone)
+	assert.Equal(t, maxRetryCount, len(attempts), "Attach retried until it gave up")
+}
+
+// TestRetryContext checks a retry is abandoned once the context is done.
+func TestRetryContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	err := retryLocked(ctx, &sync.Mutex{}, time.Hour, func() (bool, error) {
+		attempts++
+		cancel()
+		return true, errors.New("Run 'attach' failed")
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 1, attempts)
+}
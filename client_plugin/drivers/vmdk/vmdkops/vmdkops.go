@@ -17,7 +17,11 @@
 package vmdkops
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 )
@@ -35,9 +39,27 @@ type VmdkCmdRunner interface {
 	Run(cmd string, name string, opts map[string]string) ([]byte, error)
 }
 
+// VmdkCmdContextRunner is the context-first variant of VmdkCmdRunner.
+// Runners implementing it stop retrying, and abort I/O where possible, when ctx is done.
+type VmdkCmdContextRunner interface {
+	VmdkCmdRunner
+	RunContext(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error)
+}
+
+// DefaultTimeoutKey is the key in VmdkOps.Timeouts used for commands without their own entry
+const DefaultTimeoutKey = "default"
+
 // VmdkOps struct
 type VmdkOps struct {
-	Cmd VmdkCmdRunner // see *_vmdkcmd.go for implementations.
+	Cmd      VmdkCmdRunner            // see *_vmdkcmd.go for implementations.
+	Timeouts map[string]time.Duration // per command timeouts, no timeout if missing or 0
+
+	server *serverInfoCache // handshake result, nil to skip handshake
+}
+
+// NewVmdkOps returns VmdkOps negotiating protocol version with ESX service before the first request.
+func NewVmdkOps(cmd VmdkCmdRunner) VmdkOps {
+	return VmdkOps{Cmd: cmd, server: newServerInfoCache()}
 }
 
 // VolumeData we return to the caller
@@ -46,24 +68,147 @@ type VolumeData struct {
 	Attributes map[string]string
 }
 
+// DatastoreData describes a datastore volumes can be created on, sizes in bytes
+type DatastoreData struct {
+	Name     string
+	Capacity uint64
+	Free     uint64
+}
+
+// runCmd runs cmd on runner, passing ctx along if the runner supports it.
+func runCmd(ctx context.Context, runner VmdkCmdRunner, cmd string, name string, opts map[string]string) ([]byte, error) {
+	if r, ok := runner.(VmdkCmdContextRunner); ok {
+		return r.RunContext(ctx, cmd, name, opts)
+	}
+	return runner.Run(cmd, name, opts)
+}
+
+// runAsync runs f in a goroutine and returns its result, or ctx error if ctx is done first
+func runAsync(ctx context.Context, f func() ([]byte, error)) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		out []byte
+		err error
+	}
+	// buffered, so the goroutine can exit even if nobody is waiting anymore
+	resCh := make(chan result, 1)
+	go func() {
+		out, err := f()
+		resCh <- result{out, err}
+	}()
+
+	select {
+	case res := <-resCh:
+		return res.out, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// timeout returns the configured timeout for cmd
+func (v VmdkOps) timeout(cmd string) time.Duration {
+	if t, exists := v.Timeouts[cmd]; exists {
+		return t
+	}
+	return v.Timeouts[DefaultTimeoutKey]
+}
+
+// run sends cmd to ESX using the protocol version negotiated on handshake.
+// If the server rejects the version, e.g. as ESX service was upgraded since, the
+// handshake is done again and cmd retried once.
+func (v VmdkOps) run(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	for retry := true; ; retry = false {
+		info, err := v.ServerInfoContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		str, err := v.send(withProtocolVersion(ctx, info.Version), cmd, name, opts)
+		if KindOf(err) != ErrVersionMismatch || v.server == nil {
+			return str, err
+		}
+		v.server.invalidate(info)
+		if !retry {
+			return str, err
+		}
+		log.WithFields(log.Fields{"cmd": cmd, "version": info.Version, "error": err}).Warning(
+			"ESX service rejected protocol version, redoing handshake ")
+	}
+}
+
+// noTimeoutKey is the context key for requests without the configured timeout
+type noTimeoutKey struct{}
+
+// WithoutTimeout returns a copy of ctx making requests ignore the configured timeouts,
+// for requests nobody waits for. They still end when ctx is done.
+func WithoutTimeout(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTimeoutKey{}, true)
+}
+
+// send sends cmd to ESX with the configured timeout on top of ctx
+func (v VmdkOps) send(ctx context.Context, cmd string, name string, opts map[string]string) ([]byte, error) {
+	t := v.timeout(cmd)
+	if ctx.Value(noTimeoutKey{}) != nil && cmd != handshakeCmd {
+		t = 0
+	}
+	if t > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t)
+		defer cancel()
+	}
+
+	// Do not keep the caller waiting once ctx is done, the runner
+	// completes in the background if it can't be interrupted.
+	str, err := runAsync(ctx, func() ([]byte, error) {
+		return runCmd(ctx, v.Cmd, cmd, name, opts)
+	})
+	switch err {
+	case context.DeadlineExceeded:
+		err = EsxError{
+			Kind: ErrTransportFailure,
+			Msg:  fmt.Sprintf("Timed out after %v waiting for ESX to complete '%s' for volume %s", t, cmd, name),
+		}
+	case context.Canceled:
+		err = fmt.Errorf("Cancelled '%s' for volume %s, plugin is shutting down", cmd, name)
+	}
+	return str, err
+}
+
 // Create a volume
 func (v VmdkOps) Create(name string, opts map[string]string) error {
+	return v.CreateContext(context.Background(), name, opts)
+}
+
+// CreateContext creates a volume, giving up when ctx is done
+func (v VmdkOps) CreateContext(ctx context.Context, name string, opts map[string]string) error {
 	log.Debugf("vmdkOp.Create name=%s", name)
-	_, err := v.Cmd.Run("create", name, opts)
+	_, err := v.run(ctx, "create", name, opts)
 	return err
 }
 
 // Remove a volume
 func (v VmdkOps) Remove(name string, opts map[string]string) error {
+	return v.RemoveContext(context.Background(), name, opts)
+}
+
+// RemoveContext removes a volume, giving up when ctx is done
+func (v VmdkOps) RemoveContext(ctx context.Context, name string, opts map[string]string) error {
 	log.Debugf("vmdkOps.Remove name=%s", name)
-	_, err := v.Cmd.Run("remove", name, opts)
+	_, err := v.run(ctx, "remove", name, opts)
 	return err
 }
 
 // RawAttach attaches a volume and returns `[]byte` representing the raw response string.
 func (v VmdkOps) RawAttach(name string, opts map[string]string) ([]byte, error) {
+	return v.RawAttachContext(context.Background(), name, opts)
+}
+
+// RawAttachContext is RawAttach giving up when ctx is done
+func (v VmdkOps) RawAttachContext(ctx context.Context, name string, opts map[string]string) ([]byte, error) {
 	log.Debugf("vmdkOps.Attach name=%s", name)
-	str, err := v.Cmd.Run("attach", name, opts)
+	str, err := v.run(ctx, "attach", name, opts)
 	if err != nil {
 		log.WithFields(log.Fields{"name": name, "opts": opts, "error": err}).Error("RawAttach failed ")
 		return nil, err
@@ -73,7 +218,12 @@ func (v VmdkOps) RawAttach(name string, opts map[string]string) ([]byte, error)
 
 // Attach attaches a volume and returns the disk's VolumeDevSpec.
 func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec, error) {
-	str, err := v.RawAttach(name, opts)
+	return v.AttachContext(context.Background(), name, opts)
+}
+
+// AttachContext is Attach giving up when ctx is done
+func (v VmdkOps) AttachContext(ctx context.Context, name string, opts map[string]string) (*fs.VolumeDevSpec, error) {
+	str, err := v.RawAttachContext(ctx, name, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +234,7 @@ func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec,
 		log.WithFields(log.Fields{"name": name, "opts": opts, "bytes": str,
 			"error": err}).Error("Failed to unmarshal, detaching volume ")
 		// RawAttach may have the volume attached to this client, so detach.
-		errDetach := v.Detach(name, nil)
+		errDetach := v.DetachContext(ctx, name, nil)
 		if errDetach != nil {
 			log.WithFields(log.Fields{"name": name,
 				"error": errDetach}).Warning("Detach volume failed ")
@@ -96,15 +246,148 @@ func (v VmdkOps) Attach(name string, opts map[string]string) (*fs.VolumeDevSpec,
 
 // Detach a volume
 func (v VmdkOps) Detach(name string, opts map[string]string) error {
+	return v.DetachContext(context.Background(), name, opts)
+}
+
+// DetachContext detaches a volume, giving up when ctx is done
+func (v VmdkOps) DetachContext(ctx context.Context, name string, opts map[string]string) error {
 	log.Debugf("vmdkOps.Detach name=%s", name)
-	_, err := v.Cmd.Run("detach", name, opts)
+	_, err := v.run(ctx, "detach", name, opts)
+	return err
+}
+
+// Resize grows a volume to opts["size"]
+func (v VmdkOps) Resize(name string, opts map[string]string) error {
+	return v.ResizeContext(context.Background(), name, opts)
+}
+
+// ResizeContext grows a volume, giving up when ctx is done
+func (v VmdkOps) ResizeContext(ctx context.Context, name string, opts map[string]string) error {
+	log.Debugf("vmdkOps.Resize name=%s", name)
+	_, err := v.run(ctx, "resize", name, opts)
+	return err
+}
+
+// snapshotOpts returns opts with the snapshot name added, leaving opts intact
+func snapshotOpts(snapshot string, opts map[string]string) map[string]string {
+	res := map[string]string{"snapshot": snapshot}
+	for k, v := range opts {
+		res[k] = v
+	}
+	return res
+}
+
+// CreateSnapshot creates snapshot, a read-only point-in-time copy of volume name.
+// The snapshot is a volume by itself, it can be mounted, cloned with
+// "from-snapshot" option on create, and removed as any other volume.
+func (v VmdkOps) CreateSnapshot(name string, snapshot string, opts map[string]string) error {
+	return v.CreateSnapshotContext(context.Background(), name, snapshot, opts)
+}
+
+// CreateSnapshotContext creates a snapshot of a volume, giving up when ctx is done
+func (v VmdkOps) CreateSnapshotContext(ctx context.Context, name string, snapshot string, opts map[string]string) error {
+	log.Debugf("vmdkOps.CreateSnapshot name=%s snapshot=%s", name, snapshot)
+	_, err := v.run(ctx, "snapshot", name, snapshotOpts(snapshot, opts))
+	return err
+}
+
+// ListSnapshots lists snapshots of a volume
+func (v VmdkOps) ListSnapshots(name string) ([]VolumeData, error) {
+	return v.ListSnapshotsContext(context.Background(), name)
+}
+
+// ListSnapshotsContext lists snapshots of a volume, giving up when ctx is done
+func (v VmdkOps) ListSnapshotsContext(ctx context.Context, name string) ([]VolumeData, error) {
+	log.Debugf("vmdkOps.ListSnapshots name=%s", name)
+	str, err := v.run(ctx, "listSnapshots", name, make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []VolumeData
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RemoveSnapshot removes a snapshot of a volume
+func (v VmdkOps) RemoveSnapshot(name string, snapshot string) error {
+	return v.RemoveSnapshotContext(context.Background(), name, snapshot)
+}
+
+// RemoveSnapshotContext removes a snapshot of a volume, giving up when ctx is done
+func (v VmdkOps) RemoveSnapshotContext(ctx context.Context, name string, snapshot string) error {
+	log.Debugf("vmdkOps.RemoveSnapshot name=%s snapshot=%s", name, snapshot)
+	_, err := v.run(ctx, "removeSnapshot", name, snapshotOpts(snapshot, nil))
+	return err
+}
+
+// RevertSnapshot replaces the content of a volume with the content of its snapshot.
+// The volume must not be attached.
+func (v VmdkOps) RevertSnapshot(name string, snapshot string) error {
+	return v.RevertSnapshotContext(context.Background(), name, snapshot)
+}
+
+// RevertSnapshotContext reverts a volume to a snapshot, giving up when ctx is done
+func (v VmdkOps) RevertSnapshotContext(ctx context.Context, name string, snapshot string) error {
+	log.Debugf("vmdkOps.RevertSnapshot name=%s snapshot=%s", name, snapshot)
+	_, err := v.run(ctx, "revertSnapshot", name, snapshotOpts(snapshot, nil))
 	return err
 }
 
 // List all volumes
 func (v VmdkOps) List() ([]VolumeData, error) {
+	return v.ListContext(context.Background())
+}
+
+// ListContext lists all volumes, giving up when ctx is done
+func (v VmdkOps) ListContext(ctx context.Context) ([]VolumeData, error) {
 	log.Debugf("vmdkOps.List")
-	str, err := v.Cmd.Run("list", "", make(map[string]string))
+	str, err := v.run(ctx, "list", "", make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []VolumeData
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListDatastores lists the datastores volumes can be created on
+func (v VmdkOps) ListDatastores() ([]DatastoreData, error) {
+	return v.ListDatastoresContext(context.Background())
+}
+
+// ListDatastoresContext lists the datastores volumes can be created on, giving up when ctx is done
+func (v VmdkOps) ListDatastoresContext(ctx context.Context) ([]DatastoreData, error) {
+	log.Debugf("vmdkOps.ListDatastores")
+	str, err := v.run(ctx, "listDatastores", "", make(map[string]string))
+	if err != nil {
+		return nil, err
+	}
+
+	var result []DatastoreData
+	err = json.Unmarshal(str, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListAttached lists the volumes attached to this VM
+func (v VmdkOps) ListAttached() ([]VolumeData, error) {
+	return v.ListAttachedContext(context.Background())
+}
+
+// ListAttachedContext lists the volumes attached to this VM, giving up when ctx is done
+func (v VmdkOps) ListAttachedContext(ctx context.Context) ([]VolumeData, error) {
+	log.Debugf("vmdkOps.ListAttached")
+	str, err := v.run(ctx, "listAttached", "", make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -119,8 +402,13 @@ func (v VmdkOps) List() ([]VolumeData, error) {
 
 // Get for volume
 func (v VmdkOps) Get(name string) (map[string]interface{}, error) {
+	return v.GetContext(context.Background(), name)
+}
+
+// GetContext gets volume status, giving up when ctx is done
+func (v VmdkOps) GetContext(ctx context.Context, name string) (map[string]interface{}, error) {
 	log.Debugf("vmdkOps.Get name=%s", name)
-	str, err := v.Cmd.Run("get", name, make(map[string]string))
+	str, err := v.run(ctx, "get", name, make(map[string]string))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,114 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// AF_VSOCK connections to ESX without open-vm-tools, the Go equivalent
+// of vsock_init() in esx_service/vmci/vmci_client.c.
+
+package vmdkops
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	esxVmciCid      = 2    // ESX host VMCI CID ("address")
+	startClientPort = 100  // Where to start client port
+	maxClientPort   = 1023 // Last privileged port
+)
+
+var (
+	// Round robin client bind port, shared by all connections
+	nextClientPort = startClientPort
+	clientPortMtx  = &sync.Mutex{}
+)
+
+// vsockAddr implements net.Addr for vSocket endpoints
+type vsockAddr struct {
+	cid  uint32
+	port uint32
+}
+
+func (a vsockAddr) Network() string { return "vsock" }
+func (a vsockAddr) String() string  { return fmt.Sprintf("%d:%d", a.cid, a.port) }
+
+// vsockConn is a net.Conn on top of a connected vSocket.
+// Go net package does not know about AF_VSOCK, so it wraps an *os.File.
+type vsockConn struct {
+	*os.File
+	local  vsockAddr
+	remote vsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr  { return c.local }
+func (c *vsockConn) RemoteAddr() net.Addr { return c.remote }
+
+// getClientPort returns the next port to try to bind to
+func getClientPort() int {
+	clientPortMtx.Lock()
+	defer clientPortMtx.Unlock()
+	port := nextClientPort
+	if nextClientPort == maxClientPort {
+		nextClientPort = startClientPort
+	} else {
+		nextClientPort++
+	}
+	return port
+}
+
+// DialVsock connects to ESX service listening on vSocket port.
+// The client side binds a privileged port, which tells ESX service the
+// request comes from a root process.
+func DialVsock(port int) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	local := vsockAddr{cid: unix.VMADDR_CID_ANY}
+	for i := startClientPort; i <= maxClientPort; i++ {
+		local.port = uint32(getClientPort())
+		err = unix.Bind(fd, &unix.SockaddrVM{CID: local.cid, Port: local.port})
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	remote := vsockAddr{cid: esxVmciCid, port: uint32(port)}
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: remote.cid, Port: remote.port})
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("connect", err)
+	}
+
+	// Non-blocking fd lets os.File use the runtime poller, so deadlines work
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+	return &vsockConn{
+		File:   os.NewFile(uintptr(fd), remote.String()),
+		local:  local,
+		remote: remote,
+	}, nil
+}
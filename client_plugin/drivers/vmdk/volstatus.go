@@ -0,0 +1,146 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Status of volumes mounted on this host.
+//
+// Operations run on mounted volumes, e.g. trims and filesystem checks, keep their
+// last result per volume in the status store, which reports it in the volume status.
+// Operations running in the background are tracked too, so an unmount can wait
+// for them, and refcount recovery leaves the volumes being created attached.
+
+package vmdk
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// Kinds of operations in the status store
+	opTrim     = "trim"
+	opFsck     = "fsck"
+	opIoLimits = "io-limits"
+	opCreate   = "create" // no result, only tracked while in progress
+)
+
+// opResult is the result of an operation on a volume
+type opResult interface {
+	// status returns the result for the volume status
+	status() map[string]interface{}
+}
+
+// opKey is an operation of a kind on a volume
+type opKey struct {
+	op   string
+	name string
+}
+
+// statusStore keeps the last result of operations by kind and volume name, and the
+// operations in progress
+type statusStore struct {
+	mtx     *sync.Mutex
+	results map[opKey]opResult
+	running map[opKey]chan struct{} // closed when the operation completes
+}
+
+func newStatusStore() *statusStore {
+	return &statusStore{
+		mtx:     &sync.Mutex{},
+		results: make(map[opKey]opResult),
+		running: make(map[opKey]chan struct{}),
+	}
+}
+
+func (s *statusStore) set(op string, name string, result opResult) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.results[opKey{op, name}] = result
+}
+
+// remove forgets the result of operation op on volume name, returns it if there was one
+func (s *statusStore) remove(op string, name string) (opResult, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	result, exists := s.results[opKey{op, name}]
+	delete(s.results, opKey{op, name})
+	return result, exists
+}
+
+// start records operation op on volume name in progress, false if one is in progress already
+func (s *statusStore) start(op string, name string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, exists := s.running[opKey{op, name}]; exists {
+		return false
+	}
+	s.running[opKey{op, name}] = make(chan struct{})
+	return true
+}
+
+// finish records the result, if any, of operation op on volume name in progress
+func (s *statusStore) finish(op string, name string, result opResult) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key := opKey{op, name}
+	if result != nil {
+		s.results[key] = result
+	}
+	if done, exists := s.running[key]; exists {
+		close(done)
+		delete(s.running, key)
+	}
+}
+
+// wait waits for operation op on volume name in progress, if any, to complete
+func (s *statusStore) wait(op string, name string) {
+	s.mtx.Lock()
+	done, exists := s.running[opKey{op, name}]
+	s.mtx.Unlock()
+	if exists {
+		log.WithFields(log.Fields{"name": name, "operation": op}).Info("Waiting for operation on volume to complete ")
+		<-done
+	}
+}
+
+// inProgress returns the volumes operation op is in progress on
+func (s *statusStore) inProgress(op string) []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	var names []string
+	for key := range s.running {
+		if key.op == op {
+			names = append(names, key.name)
+		}
+	}
+	return names
+}
+
+// status returns the results of all operations on volume name for the volume status,
+// empty if none were run
+func (s *statusStore) status(name string) map[string]interface{} {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := make(map[string]interface{})
+	for key, result := range s.results {
+		if key.name != name {
+			continue
+		}
+		for k, v := range result.status() {
+			status[k] = v
+		}
+	}
+	return status
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vmdk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusStore(t *testing.T) {
+	s := newStatusStore()
+	assert.Empty(t, s.status("vol1@datastore1"), "Volume without operations should have no status")
+
+	lastRun := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	s.set(opTrim, "vol1@datastore1", trimResult{bytes: 4096, lastRun: lastRun})
+	s.set(opFsck, "vol1@datastore1", fsckResult{policy: "check-only", result: "passed", lastRun: lastRun})
+	s.set(opTrim, "vol2@datastore1", trimResult{bytes: 512, lastRun: lastRun})
+	status := s.status("vol1@datastore1")
+	assert.Equal(t, uint64(4096), status[trimBytesKey])
+	assert.Equal(t, "passed", status[fsckResultKey])
+
+	_, exists := s.remove(opTrim, "vol1@datastore1")
+	assert.True(t, exists)
+	_, exists = s.remove(opTrim, "vol1@datastore1")
+	assert.False(t, exists, "Removed result should be gone")
+	assert.NotContains(t, s.status("vol1@datastore1"), trimBytesKey)
+	assert.Equal(t, uint64(512), s.status("vol2@datastore1")[trimBytesKey])
+}
+
+func TestStatusStoreRunning(t *testing.T) {
+	s := newStatusStore()
+	assert.True(t, s.start(opTrim, "vol1@datastore1"))
+	assert.False(t, s.start(opTrim, "vol1@datastore1"), "Volume should not be trimmed twice at once")
+
+	assert.Equal(t, []string{"vol1@datastore1"}, s.inProgress(opTrim))
+	assert.Empty(t, s.inProgress(opCreate))
+
+	// Other volumes and operations don't wait
+	s.wait(opTrim, "vol2@datastore1")
+	s.wait(opFsck, "vol1@datastore1")
+
+	waited := make(chan struct{})
+	go func() {
+		s.wait(opTrim, "vol1@datastore1")
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Unmount should wait for the trim in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	s.finish(opTrim, "vol1@datastore1", trimResult{bytes: 4096, lastRun: time.Now()})
+	<-waited
+	assert.Empty(t, s.inProgress(opTrim))
+	assert.Equal(t, uint64(4096), s.status("vol1@datastore1")[trimBytesKey])
+
+	// Operations without result are only tracked while in progress
+	assert.True(t, s.start(opCreate, "vol3@datastore1"))
+	s.finish(opCreate, "vol3@datastore1", nil)
+	assert.Empty(t, s.inProgress(opCreate))
+	assert.Empty(t, s.status("vol3@datastore1"))
+	assert.True(t, s.start(opTrim, "vol1@datastore1"), "Volume should be trimmed again once the trim completed")
+}
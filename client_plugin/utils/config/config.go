@@ -46,8 +46,73 @@ const (
 	defaultMaxLogSizeMb  = 100
 	defaultMaxLogAgeDays = 28
 	defaultLogLevel      = "info"
+
+	// DefaultMaxEsxRequests is the default number of parallel requests to ESX service
+	DefaultMaxEsxRequests = 8
+
+	// EsxTimeoutDefaultKey is the EsxTimeoutsSec entry for commands without their own timeout
+	EsxTimeoutDefaultKey = "default"
+
+	// DefaultMaxFreezeSec is how long a filesystem may stay frozen while cloning a mounted volume
+	DefaultMaxFreezeSec = 60
+
+	// DefaultAsyncCreateWaitSec is how long Mount waits for an asynchronous create to complete
+	DefaultAsyncCreateWaitSec = 90
+
+	// DefaultTrimIntervalSec is how often mounted volumes are trimmed to release unused space
+	DefaultTrimIntervalSec = 24 * 60 * 60
+
+	// DefaultFsckPolicy is the policy of the filesystem check before mount, no check by default
+	DefaultFsckPolicy = "none"
+
+	// DefaultFsckTimeoutSec is how long the filesystem check before mount may take
+	DefaultFsckTimeoutSec = 300
+
+	// DefaultKeyProvider supplies the keys of encrypted volumes from files in KeyDir
+	DefaultKeyProvider = "file"
+
+	// DefaultIoCgroup is the cgroup of containers started by Docker with the cgroupfs driver
+	DefaultIoCgroup = "docker"
+
+	// DefaultUsageCheckIntervalSec is how often the usage of mounted volumes is checked against UsageWarnPercent
+	DefaultUsageCheckIntervalSec = 5 * 60
+
+	// DefaultPlacementPolicy leaves the datastore of volumes created without one to ESX
+	DefaultPlacementPolicy = "none"
+
+	// DefaultRefCountAuditIntervalSec is how often refcounts are audited against Docker and mounts
+	DefaultRefCountAuditIntervalSec = 10 * 60
+
+	// DefaultRefCountAuditMode only reports discrepancies found by refcount audits
+	DefaultRefCountAuditMode = "dry-run"
+
+	// DefaultRefCountEventAuditDelaySec is how long after Docker events refcounts are audited
+	DefaultRefCountEventAuditDelaySec = 10
+
+	// DefaultKvStore is the etcd cluster the shared driver starts on swarm managers
+	DefaultKvStore = "etcd"
+
+	// DefaultOrphanDetachMode only reports volumes found attached but not mounted on recovery
+	DefaultOrphanDetachMode = "dry-run"
 )
 
+// defaultEsxTimeoutsSec - timeouts for requests to ESX service, by command.
+// Creating eagerzeroedthick volumes may take long, hence the large create timeout.
+var defaultEsxTimeoutsSec = map[string]int{
+	"create":             600,
+	"remove":             120,
+	"attach":             120,
+	"detach":             120,
+	"resize":             600,
+	"snapshot":           600,
+	"revertSnapshot":     600,
+	"get":                30,
+	"list":               30,
+	"listDatastores":     30,
+	"listAttached":       30,
+	EsxTimeoutDefaultKey: 120,
+}
+
 // Config stores the configuration for the plugin
 type Config struct {
 	Driver         string `json:",omitempty"`
@@ -59,6 +124,53 @@ type Config struct {
 	Target         string `json:",omitempty"`
 	Project        string `json:",omitempty"`
 	Host           string `json:",omitempty"`
+	MaxEsxRequests int    `json:",omitempty"`
+	// Timeouts in seconds for requests to ESX service by command, 0 for no timeout
+	EsxTimeoutsSec map[string]int `json:",omitempty"`
+	// Max time in seconds to keep the filesystem of a mounted volume frozen while copying it
+	MaxFreezeSec int `json:",omitempty"`
+	// Max time in seconds for Mount to wait for an asynchronous create of the volume
+	AsyncCreateWaitSec int `json:",omitempty"`
+	// Interval in seconds between trims of mounted volumes, negative to disable periodic trim
+	TrimIntervalSec int `json:",omitempty"`
+	// Filesystem check before mount: none, check-only or auto-repair
+	FsckPolicy string `json:",omitempty"`
+	// Max time in seconds for the filesystem check before mount, repairs run to completion
+	FsckTimeoutSec int `json:",omitempty"`
+	// Source of the keys of encrypted volumes: file or env
+	KeyProvider string `json:",omitempty"`
+	// Directory with key files of encrypted volumes, for the file key provider
+	KeyDir string `json:",omitempty"`
+	// Cgroup the I/O limits of volumes are set in, relative to the cgroup root
+	IoCgroup string `json:",omitempty"`
+	// Percent full of a mounted volume to warn about, 0 to never warn
+	UsageWarnPercent int `json:",omitempty"`
+	// Interval in seconds between checks of the usage of mounted volumes against UsageWarnPercent
+	UsageCheckIntervalSec int `json:",omitempty"`
+	// Datastore of volumes created without one: none, most-free, round-robin or labels
+	PlacementPolicy string `json:",omitempty"`
+	// Datastores most-free and round-robin choose from, all allowed ones if empty
+	PlacementDatastores []string `json:",omitempty"`
+	// Datastores by volume label as key=value, for the labels policy
+	PlacementLabels map[string]string `json:",omitempty"`
+	// Interval in seconds between refcount audits, negative to disable them
+	RefCountAuditIntervalSec int `json:",omitempty"`
+	// Refcount audit mode: dry-run to report discrepancies, or repair to fix them too
+	RefCountAuditMode string `json:",omitempty"`
+	// Delay in seconds of refcount audits on Docker events, negative to not watch events
+	RefCountEventAuditDelaySec int `json:",omitempty"`
+	// KV store of the shared driver: etcd, external-etcd or consul
+	KvStore string `json:",omitempty"`
+	// Endpoints of the external-etcd or consul KV store, as host:port or URL
+	KvStoreEndpoints []string `json:",omitempty"`
+	// TLS client certificate and key, and CA certificates, for the KV store. Plain connections if all are empty
+	KvStoreCertFile string `json:",omitempty"`
+	KvStoreKeyFile  string `json:",omitempty"`
+	KvStoreCAFile   string `json:",omitempty"`
+	// Recovery of volumes attached but not mounted: dry-run to report them, or detach to detach them too
+	OrphanDetachMode string `json:",omitempty"`
+	// Volumes recovery never detaches, by name or pattern, with or without datastore
+	OrphanAllowList []string `json:",omitempty"`
 }
 
 // LogInfo stores parameters for setting up logs
@@ -94,6 +206,62 @@ func setDefaults(config *Config) {
 	if config.LogLevel == "" {
 		config.LogLevel = defaultLogLevel
 	}
+	if config.MaxEsxRequests == 0 {
+		config.MaxEsxRequests = DefaultMaxEsxRequests
+	}
+	if config.MaxFreezeSec == 0 {
+		config.MaxFreezeSec = DefaultMaxFreezeSec
+	}
+	if config.AsyncCreateWaitSec == 0 {
+		config.AsyncCreateWaitSec = DefaultAsyncCreateWaitSec
+	}
+	if config.TrimIntervalSec == 0 {
+		config.TrimIntervalSec = DefaultTrimIntervalSec
+	}
+	if config.FsckPolicy == "" {
+		config.FsckPolicy = DefaultFsckPolicy
+	}
+	if config.FsckTimeoutSec == 0 {
+		config.FsckTimeoutSec = DefaultFsckTimeoutSec
+	}
+	if config.KeyProvider == "" {
+		config.KeyProvider = DefaultKeyProvider
+	}
+	if config.KeyDir == "" {
+		config.KeyDir = DefaultKeyDir
+	}
+	if config.IoCgroup == "" {
+		config.IoCgroup = DefaultIoCgroup
+	}
+	if config.UsageCheckIntervalSec == 0 {
+		config.UsageCheckIntervalSec = DefaultUsageCheckIntervalSec
+	}
+	if config.PlacementPolicy == "" {
+		config.PlacementPolicy = DefaultPlacementPolicy
+	}
+	if config.RefCountAuditIntervalSec == 0 {
+		config.RefCountAuditIntervalSec = DefaultRefCountAuditIntervalSec
+	}
+	if config.RefCountAuditMode == "" {
+		config.RefCountAuditMode = DefaultRefCountAuditMode
+	}
+	if config.RefCountEventAuditDelaySec == 0 {
+		config.RefCountEventAuditDelaySec = DefaultRefCountEventAuditDelaySec
+	}
+	if config.KvStore == "" {
+		config.KvStore = DefaultKvStore
+	}
+	if config.OrphanDetachMode == "" {
+		config.OrphanDetachMode = DefaultOrphanDetachMode
+	}
+	if config.EsxTimeoutsSec == nil {
+		config.EsxTimeoutsSec = make(map[string]int)
+	}
+	for cmd, timeout := range defaultEsxTimeoutsSec {
+		if _, exists := config.EsxTimeoutsSec[cmd]; !exists {
+			config.EsxTimeoutsSec[cmd] = timeout
+		}
+	}
 }
 
 // LogInit init log with passed logLevel (and get config from configFile if it's present)
@@ -163,6 +331,7 @@ func InitConfig(defaultConfigPath string, defaultLogPath string, defaultDriver s
 	c, err := Load(*configFile)
 	if err != nil {
 		log.Warningf("Failed to load config file %s: %v", *configFile, err)
+		setDefaults(&c)
 	}
 
 	logInfo := &LogInfo{
@@ -31,4 +31,13 @@ const (
 
 	// VSharedMountRoot is the path where shared volumes are mounted
 	VSharedMountRoot = "/mnt/vshared"
+
+	// CreateTasksDir keeps the state of asynchronous volume creates
+	CreateTasksDir = "/var/lib/docker-volume-vsphere/create-tasks"
+
+	// RefCountsDir keeps the refcount journal of volumes mounted on this host
+	RefCountsDir = "/var/lib/docker-volume-vsphere/refcounts"
+
+	// DefaultKeyDir has the key files of encrypted volumes
+	DefaultKeyDir = "/etc/docker-volume-vsphere/keys"
 )
@@ -28,4 +28,23 @@ func TestLoad(t *testing.T) {
 	assert.Equal(t, conf.MaxLogSizeMb, 100)
 	assert.Equal(t, conf.MaxLogAgeDays, 28)
 	assert.Equal(t, conf.LogPath, "/var/log/docker-volume-vsphere.log")
+	assert.Equal(t, conf.MaxEsxRequests, config.DefaultMaxEsxRequests)
+	assert.Equal(t, 600, conf.EsxTimeoutsSec["create"])
+	assert.Equal(t, 120, conf.EsxTimeoutsSec[config.EsxTimeoutDefaultKey])
+	assert.Equal(t, conf.MaxFreezeSec, config.DefaultMaxFreezeSec)
+	assert.Equal(t, conf.AsyncCreateWaitSec, config.DefaultAsyncCreateWaitSec)
+	assert.Equal(t, conf.TrimIntervalSec, config.DefaultTrimIntervalSec)
+	assert.Equal(t, conf.FsckPolicy, config.DefaultFsckPolicy)
+	assert.Equal(t, conf.FsckTimeoutSec, config.DefaultFsckTimeoutSec)
+	assert.Equal(t, conf.KeyProvider, config.DefaultKeyProvider)
+	assert.Equal(t, conf.KeyDir, config.DefaultKeyDir)
+	assert.Equal(t, conf.IoCgroup, config.DefaultIoCgroup)
+	assert.Equal(t, conf.UsageWarnPercent, 0)
+	assert.Equal(t, conf.UsageCheckIntervalSec, config.DefaultUsageCheckIntervalSec)
+	assert.Equal(t, conf.PlacementPolicy, config.DefaultPlacementPolicy)
+	assert.Equal(t, conf.RefCountAuditIntervalSec, config.DefaultRefCountAuditIntervalSec)
+	assert.Equal(t, conf.RefCountAuditMode, config.DefaultRefCountAuditMode)
+	assert.Equal(t, conf.RefCountEventAuditDelaySec, config.DefaultRefCountEventAuditDelaySec)
+	assert.Equal(t, conf.OrphanDetachMode, config.DefaultOrphanDetachMode)
+	assert.Equal(t, conf.KvStore, config.DefaultKvStore)
 }
@@ -27,4 +27,13 @@ var (
 
 	// VMDK volumes are mounted here
 	MountRoot = filepath.Join(os.Getenv("LOCALAPPDATA"), "docker-volume-vsphere", "mounts")
+
+	// CreateTasksDir keeps the state of asynchronous volume creates
+	CreateTasksDir = filepath.Join(os.Getenv("PROGRAMDATA"), "docker-volume-vsphere", "create-tasks")
+
+	// RefCountsDir keeps the refcount journal of volumes mounted on this host
+	RefCountsDir = filepath.Join(os.Getenv("PROGRAMDATA"), "docker-volume-vsphere", "refcounts")
+
+	// DefaultKeyDir has the key files of encrypted volumes
+	DefaultKeyDir = filepath.Join(os.Getenv("PROGRAMDATA"), "docker-volume-vsphere", "keys")
 )
@@ -20,10 +20,49 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+const (
+	// FstypeBlock is passed as fstype to mount block-mode volumes, which have no filesystem.
+	FstypeBlock = "block"
+
+	// BlockDeviceFile is the device node of a block-mode volume in its mountpoint
+	BlockDeviceFile = "device"
+
+	// LuksMapperPrefix starts the device-mapper names of encrypted volumes
+	LuksMapperPrefix = "vdvs-"
+
+	// LuksFsType is the type GetFsType returns for encrypted devices
+	LuksFsType = "crypto_LUKS"
+
+	// Policies of the filesystem check before mount
+	FsckNone       = "none"        // no check
+	FsckCheckOnly  = "check-only"  // check, refuse the mount on errors
+	FsckAutoRepair = "auto-repair" // repair what can be repaired safely, refuse the mount on other errors
+
+	// Results of the filesystem check
+	FsckPassed   = "passed"   // no errors, or nothing the mount doesn't handle
+	FsckRepaired = "repaired" // errors repaired
+	FsckFailed   = "failed"   // errors left, the filesystem must not be mounted
+	FsckSkipped  = "skipped"  // no tool to check the filesystem
+)
+
+// FsckPolicies lists the valid filesystem check policies
+var FsckPolicies = []string{FsckNone, FsckCheckOnly, FsckAutoRepair}
+
+// FsUsage is the usage of a mounted filesystem, as df reports it
+type FsUsage struct {
+	UsedBytes   uint64
+	FreeBytes   uint64 // available to unprivileged users
+	UsedInodes  uint64
+	FreeInodes  uint64
+	PercentFull uint64 // of the space available to unprivileged users, rounded up
+}
+
 // VolumeDevSpec - volume spec returned from the server on an attach
 type VolumeDevSpec struct {
 	Unit                    string
@@ -74,3 +113,26 @@ func GetMountRootEntries(mountRoot string) ([]string, error) {
 	}
 	return vols, nil
 }
+
+// HasBlockDevice tells whether a block-mode volume is exposed at mountpoint
+func HasBlockDevice(mountpoint string) bool {
+	stat, err := os.Lstat(filepath.Join(mountpoint, BlockDeviceFile))
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0
+}
+
+// RemoveBlockDevice removes the device node of a block-mode volume from mountpoint
+func RemoveBlockDevice(mountpoint string) error {
+	err := os.Remove(filepath.Join(mountpoint, BlockDeviceFile))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to remove block device at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// LuksMapperName returns the device-mapper name of the opened encrypted volume
+func LuksMapperName(volume string) string {
+	return LuksMapperPrefix + strings.Replace(volume, "/", "_", -1)
+}
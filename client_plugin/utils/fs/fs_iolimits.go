@@ -0,0 +1,70 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// I/O limits of volumes, given by users as volume options "iops-limit",
+// e.g. "500", and "bps-limit", e.g. "20mb" for 20 MiB per second.
+
+package fs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// IoLimits are the I/O limits of a volume, for reads and writes each. 0 means no limit.
+type IoLimits struct {
+	Iops uint64 // I/O operations per second
+	Bps  uint64 // bytes per second
+}
+
+// bpsUnits are the units bps-limit may be given in
+var bpsUnits = map[string]uint64{
+	"kb": 1024,
+	"mb": 1024 * 1024,
+	"gb": 1024 * 1024 * 1024,
+}
+
+// ParseIoLimits parses the iops-limit and bps-limit volume options, empty if not given.
+func ParseIoLimits(iops string, bps string) (IoLimits, error) {
+	var limits IoLimits
+	var err error
+	if iops != "" {
+		if limits.Iops, err = strconv.ParseUint(iops, 10, 64); err != nil {
+			return limits, fmt.Errorf("Invalid iops-limit %q, expected a number of I/O operations per second", iops)
+		}
+	}
+	if bps != "" {
+		value, multiplier := strings.ToLower(bps), uint64(1)
+		if len(value) > 2 {
+			if unit, exists := bpsUnits[value[len(value)-2:]]; exists {
+				value, multiplier = value[:len(value)-2], unit
+			}
+		}
+		if limits.Bps, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return limits, fmt.Errorf("Invalid bps-limit %q, expected bytes per second as X[kb|mb|gb]", bps)
+		}
+		if limits.Bps > math.MaxUint64/multiplier {
+			return limits, fmt.Errorf("Invalid bps-limit %q, too large", bps)
+		}
+		limits.Bps *= multiplier
+	}
+	return limits, nil
+}
+
+// IsSet tells whether any limit is set
+func (l IoLimits) IsSet() bool {
+	return l.Iops != 0 || l.Bps != 0
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// I/O limits of volumes with cgroup blkio (v1) or io (v2) controllers.
+//
+// Limits are set for the device of the volume in a cgroup containing the
+// containers, e.g. "docker", so they apply to all containers using the volume.
+
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// cgroupRoot is where cgroup filesystems are mounted
+var cgroupRoot = "/sys/fs/cgroup"
+
+const (
+	cgroupV2Controllers = "cgroup.controllers" // only in cgroup v2 unified hierarchy
+	cgroupV2IoMax       = "io.max"
+	cgroupV1Blkio       = "blkio"
+)
+
+// cgroupV1Throttles are the blkio throttle files of cgroup v1, with the limit each takes
+var cgroupV1Throttles = []struct {
+	file  string
+	limit func(IoLimits) uint64
+}{
+	{"blkio.throttle.read_iops_device", func(l IoLimits) uint64 { return l.Iops }},
+	{"blkio.throttle.write_iops_device", func(l IoLimits) uint64 { return l.Iops }},
+	{"blkio.throttle.read_bps_device", func(l IoLimits) uint64 { return l.Bps }},
+	{"blkio.throttle.write_bps_device", func(l IoLimits) uint64 { return l.Bps }},
+}
+
+// SetIoLimits sets the I/O limits of volDev in cgroup. Empty limits remove the limits of the device.
+func SetIoLimits(volDev *VolumeDevSpec, cgroup string, limits IoLimits) error {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return err
+	}
+	return SetIoLimitsByDevicePath(device, cgroup, limits)
+}
+
+// SetIoLimitsByDevicePath sets the I/O limits of device in cgroup, relative to the cgroup root.
+// Empty limits remove the limits of the device.
+func SetIoLimitsByDevicePath(device string, cgroup string, limits IoLimits) error {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(device, &stat); err != nil {
+		return fmt.Errorf("Failed to stat device %s: %s", device, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return fmt.Errorf("%s is not a block device", device)
+	}
+	devNum := fmt.Sprintf("%d:%d", devMajor(stat.Rdev), devMinor(stat.Rdev))
+
+	log.WithFields(log.Fields{"device": device, "cgroup": cgroup, "iops": limits.Iops,
+		"bps": limits.Bps}).Debug("Setting I/O limits ")
+	if _, err := os.Stat(filepath.Join(cgroupRoot, cgroupV2Controllers)); err == nil {
+		return setIoMax(filepath.Join(cgroupRoot, cgroup), devNum, limits)
+	}
+	if _, err := os.Stat(filepath.Join(cgroupRoot, cgroupV1Blkio, cgroup)); err != nil {
+		// Managed plugins only see the cgroups of the host with it mounted
+		return fmt.Errorf("Cgroup %s not found in %s, the cgroups of the host must be mounted there: %s",
+			cgroup, cgroupRoot, err)
+	}
+	return setBlkioThrottle(filepath.Join(cgroupRoot, cgroupV1Blkio, cgroup), devNum, limits)
+}
+
+// setIoMax sets the limits of device devNum in io.max of cgroup v2 dir
+func setIoMax(dir string, devNum string, limits IoLimits) error {
+	value := func(limit uint64) string {
+		if limit == 0 {
+			return "max"
+		}
+		return fmt.Sprint(limit)
+	}
+	iops, bps := value(limits.Iops), value(limits.Bps)
+	rule := fmt.Sprintf("%s riops=%s wiops=%s rbps=%s wbps=%s", devNum, iops, iops, bps, bps)
+	if err := ioutil.WriteFile(filepath.Join(dir, cgroupV2IoMax), []byte(rule), 0644); err != nil {
+		return fmt.Errorf("Failed to set I/O limits in cgroup %s, the io controller must be enabled for it: %s", dir, err)
+	}
+	return nil
+}
+
+// setBlkioThrottle sets the limits of device devNum in the blkio throttle files of cgroup v1 dir
+func setBlkioThrottle(dir string, devNum string, limits IoLimits) error {
+	for _, throttle := range cgroupV1Throttles {
+		// A limit of 0 removes the rule
+		rule := fmt.Sprintf("%s %d", devNum, throttle.limit(limits))
+		if err := ioutil.WriteFile(filepath.Join(dir, throttle.file), []byte(rule), 0644); err != nil {
+			return fmt.Errorf("Failed to set I/O limits in cgroup %s: %s", dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetIoMax(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, setIoMax(dir, "8:16", IoLimits{Iops: 500}))
+	rule, _ := ioutil.ReadFile(filepath.Join(dir, cgroupV2IoMax))
+	assert.Equal(t, "8:16 riops=500 wiops=500 rbps=max wbps=max", string(rule))
+}
+
+func TestSetBlkioThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, setBlkioThrottle(dir, "8:16", IoLimits{Iops: 500, Bps: 1024}))
+	rule, _ := ioutil.ReadFile(filepath.Join(dir, "blkio.throttle.write_iops_device"))
+	assert.Equal(t, "8:16 500", string(rule))
+	rule, _ = ioutil.ReadFile(filepath.Join(dir, "blkio.throttle.read_bps_device"))
+	assert.Equal(t, "8:16 1024", string(rule))
+
+	assert.NotNil(t, setBlkioThrottle(filepath.Join(dir, "missing"), "8:16", IoLimits{}),
+		"Limits in a missing cgroup should fail")
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseIoLimits(t *testing.T) {
+	limits, err := ParseIoLimits("500", "20mb")
+	assert.Nil(t, err)
+	assert.Equal(t, IoLimits{Iops: 500, Bps: 20 * 1024 * 1024}, limits)
+
+	limits, err = ParseIoLimits("", "4096")
+	assert.Nil(t, err)
+	assert.Equal(t, IoLimits{Bps: 4096}, limits)
+
+	limits, err = ParseIoLimits("", "")
+	assert.Nil(t, err)
+	assert.False(t, limits.IsSet(), "No limits expected without options")
+
+	for _, opts := range [][2]string{{"fast", ""}, {"-1", ""}, {"", "10tb"}, {"", "mb"},
+		{"", "17179869184gb"}} {
+		_, err = ParseIoLimits(opts[0], opts[1])
+		assert.NotNil(t, err, "I/O limits %v should be refused", opts)
+	}
+}
@@ -17,16 +17,19 @@
 package fs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 
 	log "github.com/Sirupsen/logrus"
 	"golang.org/x/exp/inotify"
@@ -44,10 +47,16 @@ const (
 	scsiHostPath     = "/sys/class/scsi_host/"  // Path for scsi hosts
 	devWaitTimeout   = 10 * time.Second         // give it plenty of time to sense the attached disk
 	bdevPath         = "/sys/block/"
+	sysDevBlock      = "/sys/dev/block"
 	deleteFile       = "/device/delete"
 	watchPath        = "/dev/disk/by-id"
 	diskWatchPath    = "/dev/disk/by-path"
 	linuxMountsFile  = "/proc/mounts" // Path of file containing linux mounts information
+	ioctlFreeze      = 0xC0045877     // FIFREEZE, _IOWR('X', 119, int)
+	ioctlThaw        = 0xC0045878     // FITHAW, _IOWR('X', 120, int)
+	ioctlBlkRoSet    = 0x125D         // BLKROSET, _IO(0x12, 93)
+	ioctlTrim        = 0xC0185879     // FITRIM, _IOWR('X', 121, struct fstrim_range)
+	blkidTool        = "blkid"
 )
 
 // BinSearchPath contains search paths for host binaries
@@ -119,32 +128,38 @@ func DevAttachWaitFallback() {
 	time.Sleep(sleepBeforeMount)
 }
 
-// Mkfs creates a filesystem at the specified volDev.
-func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
+// Mkfs creates a filesystem at the specified volDev, with mkfsOpts as in "mkfs-opts" volume option.
+func Mkfs(fstype string, label string, volDev *VolumeDevSpec, mkfsOpts string) error {
 	device, err := getDevicePath(volDev)
 	if err != nil {
 		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
 		return err
 	}
-	return MkfsByDevicePath(fstype, label, device)
+	return MkfsByDevicePath(fstype, label, device, mkfsOpts)
 }
 
-// MkfsByDevicePath creates a filesystem at the specified device.
-func MkfsByDevicePath(fstype string, label string, device string) error {
+// MkfsByDevicePath creates a filesystem at the specified device, with mkfsOpts as in "mkfs-opts" volume option.
+func MkfsByDevicePath(fstype string, label string, device string, mkfsOpts string) error {
 	var err error
 	var out []byte
 
 	// Identify mkfscmd for fstype
 	mkfscmd := mkfsLookup()[fstype]
 
+	extraArgs, err := mkfsArgs(fstype, mkfsOpts)
+	if err != nil {
+		return err
+	}
+
 	// Workaround older versions of e2fsprogs, issue 629.
 	// If mkfscmd is of an ext* filesystem use -F flag
 	// to avoid having mkfs command to expect user confirmation.
+	args := []string{"-L", label}
 	if strings.Split(mkfscmd, ".")[1][0:3] == "ext" {
-		out, err = exec.Command(mkfscmd, "-F", "-L", label, device).CombinedOutput()
-	} else {
-		out, err = exec.Command(mkfscmd, "-L", label, device).CombinedOutput()
+		args = append([]string{"-F"}, args...)
 	}
+	args = append(append(args, extraArgs...), device)
+	out, err = exec.Command(mkfscmd, args...).CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("Failed to create filesystem on %s: %s. Output = %s",
 			device, err, out)
@@ -152,6 +167,37 @@ func MkfsByDevicePath(fstype string, label string, device string) error {
 	return nil
 }
 
+// GetFsType returns the type of the filesystem on volDev, empty if it has none.
+func GetFsType(volDev *VolumeDevSpec) (string, error) {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return "", err
+	}
+	return GetFsTypeByDevicePath(device)
+}
+
+// GetFsTypeByDevicePath returns the type of the filesystem on device, empty if it has none.
+// An encrypted device has type LuksFsType.
+func GetFsTypeByDevicePath(device string) (string, error) {
+	blkid := toolLookup(map[string]string{blkidTool: blkidTool})[blkidTool]
+	if blkid == "" {
+		return "", fmt.Errorf("Not found %s to check the filesystem on %s", blkidTool, device)
+	}
+	// Probe the device itself, not the cache of blkid
+	out, err := exec.Command(blkid, "-p", "-o", "value", "-s", "TYPE", device).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		// blkid exits with 2 when nothing is found on the device
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 2 {
+			return "", nil
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to probe filesystem on %s: %s", device, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
 // VerifyFSSupport checks whether the fstype filesystem is supported.
 func VerifyFSSupport(fstype string) error {
 	supportedFs := mkfsLookup()
@@ -184,35 +230,393 @@ func mkfsLookup() map[string]string {
 	return supportedFs
 }
 
-// Mount the filesystem (`fs`) on the volDev at the given mountpoint.
-func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool) error {
+// growfsTools lists the tools growing a mounted filesystem, by fstype
+var growfsTools = map[string]string{
+	"ext2":  "resize2fs",
+	"ext3":  "resize2fs",
+	"ext4":  "resize2fs",
+	"xfs":   "xfs_growfs",
+	"btrfs": "btrfs",
+}
+
+// growfsLookup finds existent tools to grow filesystems
+func growfsLookup() map[string]string {
+	return toolLookup(growfsTools)
+}
+
+// fsckTools lists the tools checking a filesystem, by fstype
+var fsckTools = map[string]string{
+	"ext2":  "e2fsck",
+	"ext3":  "e2fsck",
+	"ext4":  "e2fsck",
+	"xfs":   "xfs_repair",
+	"btrfs": "btrfs",
+}
+
+// fsckLookup finds existent tools to check filesystems
+func fsckLookup() map[string]string {
+	return toolLookup(fsckTools)
+}
+
+// toolLookup finds existent tools in BinSearchPath, by fstype
+func toolLookup(tools map[string]string) map[string]string {
+	supportedFs := make(map[string]string)
+	for fstype, tool := range tools {
+		for _, sp := range BinSearchPath {
+			if _, err := os.Stat(sp + "/" + tool); err == nil {
+				supportedFs[fstype] = sp + "/" + tool
+				break
+			}
+		}
+	}
+	return supportedFs
+}
+
+// Fsck checks the filesystem on volDev as policy says, before it is mounted.
+// Returns the result, and an error if the filesystem must not be mounted.
+func Fsck(fstype string, volDev *VolumeDevSpec, policy string, timeout time.Duration) (string, error) {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return FsckFailed, err
+	}
+	return FsckByDevicePath(fstype, device, policy, timeout)
+}
+
+// FsckByDevicePath checks the filesystem on device as policy says, before it is mounted.
+// Returns the result, and an error if the filesystem must not be mounted.
+// A read-only check is killed after timeout, 0 for no timeout. Repairs run to completion.
+func FsckByDevicePath(fstype string, device string, policy string, timeout time.Duration) (string, error) {
+	if policy == FsckNone {
+		return FsckSkipped, nil
+	}
+	fsckcmd, exists := fsckLookup()[fstype]
+	if !exists {
+		log.WithFields(log.Fields{"device": device, "fstype": fstype}).Warning(
+			"Not found tool to check filesystem, mounting without check ")
+		return FsckSkipped, nil
+	}
+	repair := policy == FsckAutoRepair
+
+	var args []string
+	writes := false // the tool may modify the filesystem
+	switch filepath.Base(fsckcmd) {
+	case "e2fsck":
+		if repair {
+			args = []string{"-p", device} // repairs what is safe without a human
+			writes = true
+		} else {
+			args = []string{"-n", device}
+		}
+	case "xfs_repair":
+		if repair {
+			args = []string{device}
+			writes = true
+		} else {
+			args = []string{"-n", device}
+		}
+	case "btrfs":
+		// btrfs check --repair may do more harm than good, never repair automatically
+		args = []string{"check", "--readonly", device}
+	}
+
+	// Killing a repair in the middle may leave the filesystem worse than it
+	// was, so only read-only checks are given up on timeout
+	ctx := context.Background()
+	if timeout > 0 && !writes {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	log.WithFields(log.Fields{"device": device, "fstype": fstype, "policy": policy}).Info("Checking filesystem ")
+	out, err := exec.CommandContext(ctx, fsckcmd, args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return FsckFailed, fmt.Errorf("Filesystem check of %s did not complete in %v", device, timeout)
+	}
+	exitCode := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+	} else if err != nil {
+		return FsckFailed, fmt.Errorf("Failed to check filesystem on %s: %s", device, err)
+	}
+
+	result := FsckFailed
+	switch {
+	case exitCode == 0:
+		result = FsckPassed
+	case filepath.Base(fsckcmd) == "e2fsck" && repair && (exitCode == 1 || exitCode == 2):
+		result = FsckRepaired
+	case filepath.Base(fsckcmd) == "xfs_repair" && exitCode == 2:
+		// Dirty log, mount replays it
+		result = FsckPassed
+	}
+	if result == FsckFailed {
+		return result, fmt.Errorf("Filesystem check of %s with policy %s found errors (exit code %d). Output = %s",
+			device, policy, exitCode, out)
+	}
+	return result, nil
+}
+
+// GrowFs grows the filesystem on device mounted at mountpoint to fill the device.
+// Called after the disk has been grown on ESX.
+func GrowFs(fstype string, device string, mountpoint string) error {
+	if fstype == FstypeBlock {
+		// No filesystem, growing the content of the device is up to its user
+		return rescanDevice(device)
+	}
+
+	growfscmd, exists := growfsLookup()[fstype]
+	if !exists {
+		return fmt.Errorf("Not found tool to grow %s filesystem", fstype)
+	}
+
+	err := rescanDevice(device)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch filepath.Base(growfscmd) {
+	case "resize2fs":
+		out, err = exec.Command(growfscmd, device).CombinedOutput()
+	case "xfs_growfs":
+		out, err = exec.Command(growfscmd, mountpoint).CombinedOutput()
+	case "btrfs":
+		out, err = exec.Command(growfscmd, "filesystem", "resize", "max", mountpoint).CombinedOutput()
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to grow filesystem on %s: %s. Output = %s",
+			device, err, out)
+	}
+	log.WithFields(log.Fields{"device": device, "fstype": fstype,
+		"mountpoint": mountpoint}).Info("Filesystem grown ")
+	return nil
+}
+
+// rescanDevice makes the kernel pick up the new size of a SCSI disk
+func rescanDevice(device string) error {
+	dev, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve device %s: %s", device, err)
+	}
+	rescan := bdevPath + filepath.Base(dev) + "/device/rescan"
+	if _, err = os.Stat(rescan); os.IsNotExist(err) {
+		// Not a SCSI disk, e.g. loopback device with mock ESX
+		return nil
+	}
+	err = ioutil.WriteFile(rescan, []byte("1"), 0200)
+	if err != nil {
+		return fmt.Errorf("Failed to rescan device %s: %s", dev, err)
+	}
+	return nil
+}
+
+// FreezeFs flushes the filesystem mounted at mountpoint to the disk and blocks
+// writes to it until ThawFs is called, so a copy of the disk is consistent.
+func FreezeFs(mountpoint string) error {
+	err := fsIoctl(mountpoint, ioctlFreeze)
+	if err != nil {
+		return fmt.Errorf("Failed to freeze filesystem at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// ThawFs resumes writes to the filesystem frozen with FreezeFs.
+func ThawFs(mountpoint string) error {
+	err := fsIoctl(mountpoint, ioctlThaw)
+	if err != nil {
+		return fmt.Errorf("Failed to thaw filesystem at %s: %s", mountpoint, err)
+	}
+	return nil
+}
+
+// GetFsUsage returns the usage of the filesystem mounted at mountpoint.
+func GetFsUsage(mountpoint string) (FsUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountpoint, &stat); err != nil {
+		return FsUsage{}, fmt.Errorf("Failed to get usage of filesystem at %s: %s", mountpoint, err)
+	}
+	bsize := uint64(stat.Bsize)
+	usage := FsUsage{
+		UsedBytes:  (stat.Blocks - stat.Bfree) * bsize,
+		FreeBytes:  stat.Bavail * bsize,
+		UsedInodes: stat.Files - stat.Ffree,
+		FreeInodes: stat.Ffree,
+	}
+	if total := usage.UsedBytes + usage.FreeBytes; total > 0 {
+		usage.PercentFull = (usage.UsedBytes*100 + total - 1) / total
+	}
+	return usage, nil
+}
+
+// fstrimRange is struct fstrim_range of linux/fs.h
+type fstrimRange struct {
+	start     uint64
+	length    uint64
+	minLength uint64
+}
+
+// Trim discards the unused blocks of the filesystem mounted at mountpoint, so a thin
+// disk can release them. Returns the number of bytes trimmed.
+func Trim(mountpoint string) (uint64, error) {
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to trim filesystem at %s: %s", mountpoint, err)
+	}
+	defer dir.Close()
+	trimRange := fstrimRange{length: math.MaxUint64}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), ioctlTrim, uintptr(unsafe.Pointer(&trimRange)))
+	if errno != 0 {
+		return 0, fmt.Errorf("Failed to trim filesystem at %s: %s", mountpoint, errno)
+	}
+	// The kernel sets length to the number of bytes trimmed
+	return trimRange.length, nil
+}
+
+// fsIoctl issues a filesystem ioctl on the mount point
+func fsIoctl(mountpoint string, request uintptr) error {
+	dir, err := os.Open(mountpoint)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dir.Fd(), request, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Mount the filesystem (`fs`) on the volDev at the given mountpoint,
+// with mountOpts as in "mount-opts" volume option.
+func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool, mountOpts string) error {
 	device, err := getDevicePath(volDev)
 	if err != nil {
 		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
 		return err
 	}
-	return MountByDevicePath(mountpoint, fstype, device, isReadOnly)
+	return MountByDevicePath(mountpoint, fstype, device, isReadOnly, mountOpts)
 }
 
-// MountByDevicePath mounts the filesystem (`fs`) on the device at the given mount point.
-func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool) error {
+// MountByDevicePath mounts the filesystem (`fs`) on the device at the given mount point,
+// with mountOpts as in "mount-opts" volume option.
+func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool, mountOpts string) error {
+	flags, data, err := mountArgs(fstype, mountOpts)
+	if err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{
 		"device":     device,
 		"fstype":     fstype,
 		"mountpoint": mountpoint,
+		"flags":      flags,
+		"data":       data,
 	}).Debug("Calling syscall.Mount() ")
 
-	flags := 0
 	if isReadOnly {
-		flags = syscall.MS_RDONLY
+		flags |= syscall.MS_RDONLY
 	}
-	err := syscall.Mount(device, mountpoint, fstype, uintptr(flags), "")
+	err = syscall.Mount(device, mountpoint, fstype, flags, data)
 	if err != nil {
 		return fmt.Errorf("Failed to mount device %s at %s: %s", device, mountpoint, err)
 	}
 	return nil
 }
 
+// ExposeBlockDevice creates a device node for the volDev in mountpoint, for block-mode volumes.
+func ExposeBlockDevice(mountpoint string, volDev *VolumeDevSpec, isReadOnly bool) error {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return err
+	}
+	return ExposeBlockDeviceByDevicePath(mountpoint, device, isReadOnly)
+}
+
+// ExposeBlockDeviceByDevicePath creates a device node for the device in mountpoint, for block-mode volumes.
+// The node keeps the same path whatever name the device gets on attach. A read-only device
+// is also set read-only in the kernel, so it can't be written through other nodes.
+func ExposeBlockDeviceByDevicePath(mountpoint string, device string, isReadOnly bool) error {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(device, &stat); err != nil {
+		return fmt.Errorf("Failed to stat device %s: %s", device, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+		return fmt.Errorf("%s is not a block device", device)
+	}
+
+	perm := uint32(0660)
+	if isReadOnly {
+		perm = 0440
+		if err := setDeviceReadOnly(device); err != nil {
+			return err
+		}
+	}
+
+	// Replace the node left by an earlier attach, the device may differ now
+	node := filepath.Join(mountpoint, BlockDeviceFile)
+	if err := RemoveBlockDevice(mountpoint); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"device": device, "node": node}).Debug("Calling syscall.Mknod() ")
+	if err := syscall.Mknod(node, syscall.S_IFBLK|perm, int(stat.Rdev)); err != nil {
+		return fmt.Errorf("Failed to create block device %s for %s: %s", node, device, err)
+	}
+	// Mknod applies umask
+	return os.Chmod(node, os.FileMode(perm))
+}
+
+// setDeviceReadOnly makes the kernel refuse writes to the block device
+func setDeviceReadOnly(device string) error {
+	dev, err := os.Open(device)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+	readOnly := int32(1)
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dev.Fd(), ioctlBlkRoSet, uintptr(unsafe.Pointer(&readOnly)))
+	if errno != 0 {
+		return fmt.Errorf("Failed to set device %s read-only: %s", device, errno)
+	}
+	return nil
+}
+
+// GetBlockDevices returns a map of block-mode volumes exposed under mountRoot to their devices.
+// Block-mode volumes are attached while exposed, but never show in the mount info.
+func GetBlockDevices(mountRoot string) (map[string]string, error) {
+	volumeDevMap := make(map[string]string)
+
+	volumes, err := GetMountRootEntries(mountRoot)
+	if err != nil {
+		return volumeDevMap, err
+	}
+	for _, vol := range volumes {
+		node := filepath.Join(mountRoot, vol, BlockDeviceFile)
+		var stat syscall.Stat_t
+		if err = syscall.Stat(node, &stat); err != nil || stat.Mode&syscall.S_IFMT != syscall.S_IFBLK {
+			continue
+		}
+		// Report the device behind the node, as mount info does for mounted volumes
+		volumeDevMap[vol] = node
+		sysDev := fmt.Sprintf("%s/%d:%d", sysDevBlock, devMajor(stat.Rdev), devMinor(stat.Rdev))
+		if dev, err := filepath.EvalSymlinks(sysDev); err == nil {
+			volumeDevMap[vol] = "/dev/" + filepath.Base(dev)
+		}
+	}
+
+	log.WithFields(log.Fields{"map": volumeDevMap}).Debug("Successfully retrieved block devices: ")
+	return volumeDevMap, nil
+}
+
+// devMajor and devMinor decode a device number as glibc major() and minor() do
+func devMajor(dev uint64) uint64 {
+	return (dev>>8)&0xfff | (dev>>32)&0xfffff000
+}
+
+func devMinor(dev uint64) uint64 {
+	return dev&0xff | (dev>>12)&0xffffff00
+}
+
 // MountWithID - mount device with ID
 func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
 	log.WithFields(log.Fields{
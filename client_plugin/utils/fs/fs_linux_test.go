@@ -0,0 +1,76 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDevMajorMinor(t *testing.T) {
+	// 8:16 is /dev/sdb, 259:65536 needs the extended encoding
+	assert.Equal(t, uint64(8), devMajor(0x810))
+	assert.Equal(t, uint64(16), devMinor(0x810))
+	assert.Equal(t, uint64(259), devMajor(0x10010300))
+	assert.Equal(t, uint64(65536), devMinor(0x10010300))
+}
+
+func TestExposeBlockDeviceError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	err = ExposeBlockDeviceByDevicePath(dir, "/dev/null", false)
+	assert.NotNil(t, err, "Character device shouldn't be exposed as a block device")
+	assert.False(t, HasBlockDevice(dir))
+
+	devices, err := GetBlockDevices(dir)
+	assert.Nil(t, err)
+	assert.Empty(t, devices)
+}
+
+func TestGetFsUsage(t *testing.T) {
+	usage, err := GetFsUsage(os.TempDir())
+	assert.Nil(t, err)
+	assert.True(t, usage.PercentFull <= 100, "Usage %v should be at most 100%% full", usage)
+
+	_, err = GetFsUsage("/nonexistent/mountpoint")
+	assert.NotNil(t, err)
+}
+
+func TestGetFsType(t *testing.T) {
+	if err := VerifyFSSupport(FstypeDefault); err != nil {
+		t.Skip(err)
+	}
+	file, err := ioutil.TempFile("", "fs_test")
+	assert.Nil(t, err)
+	defer os.Remove(file.Name())
+	assert.Nil(t, file.Truncate(16*1024*1024))
+	file.Close()
+
+	fstype, err := GetFsTypeByDevicePath(file.Name())
+	if err != nil {
+		t.Skip(err)
+	}
+	assert.Equal(t, "", fstype, "Empty device shouldn't have a filesystem")
+
+	assert.Nil(t, MkfsByDevicePath(FstypeDefault, "fs_test", file.Name(), ""))
+	fstype, err = GetFsTypeByDevicePath(file.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, FstypeDefault, fstype)
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Encryption of volumes with LUKS/dm-crypt, using cryptsetup on the guest.
+//
+// The attached device of an encrypted volume is opened as a device-mapper
+// device named by LuksMapperName, which is then formatted, mounted or exposed
+// instead of the attached device. Keys are passed to cryptsetup on stdin,
+// never on the command line.
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	cryptsetupTool = "cryptsetup"
+	devMapperPath  = "/dev/mapper/"
+)
+
+// cryptsetupLookup finds cryptsetup in BinSearchPath
+func cryptsetupLookup() (string, error) {
+	for _, sp := range BinSearchPath {
+		if _, err := os.Stat(sp + "/" + cryptsetupTool); err == nil {
+			return sp + "/" + cryptsetupTool, nil
+		}
+	}
+	return "", errors.New("Not found cryptsetup, install it to use encrypted volumes")
+}
+
+// cryptsetup runs cryptsetup with args, passing key on stdin
+func cryptsetup(key []byte, args ...string) error {
+	cmd, err := cryptsetupLookup()
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{"args": args}).Debug("Running cryptsetup ")
+	c := exec.Command(cmd, args...)
+	if key != nil {
+		c.Stdin = bytes.NewReader(key)
+	}
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s. Output = %s", err, out)
+	}
+	return nil
+}
+
+// VerifyLuksSupport checks whether encrypted volumes can be used on this host.
+func VerifyLuksSupport() error {
+	_, err := cryptsetupLookup()
+	return err
+}
+
+// LuksFormat sets up LUKS encryption with key on volDev, destroying its content.
+func LuksFormat(volDev *VolumeDevSpec, key []byte) error {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return err
+	}
+	return LuksFormatByDevicePath(device, key)
+}
+
+// LuksFormatByDevicePath sets up LUKS encryption with key on device, destroying its content.
+func LuksFormatByDevicePath(device string, key []byte) error {
+	err := cryptsetup(key, "luksFormat", "--batch-mode", "--key-file=-", device)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt device %s: %s", device, err)
+	}
+	return nil
+}
+
+// LuksOpen opens encrypted volDev with key as device-mapper device name.
+// Returns the path of the opened device.
+func LuksOpen(volDev *VolumeDevSpec, name string, key []byte, isReadOnly bool) (string, error) {
+	device, err := getDevicePath(volDev)
+	if err != nil {
+		log.WithFields(log.Fields{"volDev": *volDev, "err": err}).Error("Failed to get device path ")
+		return "", err
+	}
+	return LuksOpenByDevicePath(device, name, key, isReadOnly)
+}
+
+// LuksOpenByDevicePath opens encrypted device with key as device-mapper device name.
+// A mapping left open by an earlier attach, e.g. before plugin restart, is replaced,
+// the device may differ now. Returns the path of the opened device.
+func LuksOpenByDevicePath(device string, name string, key []byte, isReadOnly bool) (string, error) {
+	if LuksIsOpen(name) {
+		log.WithFields(log.Fields{"device": device, "name": name}).Warning("Closing stale encrypted device ")
+		if err := LuksClose(name); err != nil {
+			return "", err
+		}
+	}
+	// Let trim release the unused space of thin volumes
+	args := []string{"luksOpen", "--key-file=-", "--allow-discards"}
+	if isReadOnly {
+		args = append(args, "--readonly")
+	}
+	args = append(args, device, name)
+	if err := cryptsetup(key, args...); err != nil {
+		return "", fmt.Errorf("Failed to open encrypted device %s: %s", device, err)
+	}
+	return devMapperPath + name, nil
+}
+
+// LuksIsOpen tells whether device-mapper device name is open
+func LuksIsOpen(name string) bool {
+	_, err := os.Stat(devMapperPath + name)
+	return err == nil
+}
+
+// LuksClose closes device-mapper device name of an encrypted volume.
+func LuksClose(name string) error {
+	if err := cryptsetup(nil, "luksClose", name); err != nil {
+		return fmt.Errorf("Failed to close encrypted device %s: %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Filesystem options for mkfs and mount, given by users as volume options
+// "mkfs-opts" and "mount-opts", e.g. "inode_size=512" and "noatime,discard".
+//
+// Options are comma separated "name" or "name=value" entries, checked against
+// an allow-list per fstype, so users can't pass arbitrary arguments to mkfs or
+// mount options which compromise the host.
+
+package fs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fsOption describes an allowed option. For mkfs, arg is the arguments the option
+// turns into, with %s replaced by the value. An option with a value takes a number,
+// or one of values if the list is given.
+type fsOption struct {
+	arg      string
+	hasValue bool
+	values   []string
+}
+
+// parsedOption is an option given by the user, checked against the allow-list
+type parsedOption struct {
+	name  string
+	value string
+	fsOption
+}
+
+var extMkfsOptions = map[string]fsOption{
+	"inode_size":       {arg: "-I %s", hasValue: true},
+	"inode_ratio":      {arg: "-i %s", hasValue: true},
+	"block_size":       {arg: "-b %s", hasValue: true},
+	"reserved_percent": {arg: "-m %s", hasValue: true},
+	"lazy_itable_init": {arg: "-E lazy_itable_init=%s", hasValue: true, values: []string{"0", "1"}},
+	"nodiscard":        {arg: "-E nodiscard"},
+}
+
+// mkfsOptions are the allowed mkfs-opts by fstype
+var mkfsOptions = map[string]map[string]fsOption{
+	"ext2": extMkfsOptions,
+	"ext3": extMkfsOptions,
+	"ext4": extMkfsOptions,
+	"xfs": {
+		"inode_size": {arg: "-i size=%s", hasValue: true},
+		"block_size": {arg: "-b size=%s", hasValue: true},
+		"nodiscard":  {arg: "-K"},
+	},
+	"btrfs": {
+		"metadata":  {arg: "-m %s", hasValue: true, values: []string{"single", "dup"}},
+		"nodiscard": {arg: "-K"},
+	},
+}
+
+// mountFlags are the allowed mount-opts for any fstype, passed to mount as flags
+var mountFlags = map[string]uintptr{
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+	"nodev":       syscall.MS_NODEV,
+	"nosuid":      syscall.MS_NOSUID,
+	"noexec":      syscall.MS_NOEXEC,
+	"sync":        syscall.MS_SYNCHRONOUS,
+	"dirsync":     syscall.MS_DIRSYNC,
+}
+
+// extErrorsOption is what ext filesystems do on errors. Not panic, which would
+// let a damaged volume take the whole host down.
+var extErrorsOption = fsOption{hasValue: true, values: []string{"continue", "remount-ro"}}
+
+// mountDataOptions are the allowed filesystem specific mount-opts by fstype, passed to mount as data
+var mountDataOptions = map[string]map[string]fsOption{
+	"ext2": {
+		"errors": extErrorsOption,
+	},
+	"ext3": {
+		"errors":    extErrorsOption,
+		"data":      {hasValue: true, values: []string{"ordered", "writeback", "journal"}},
+		"commit":    {hasValue: true},
+		"barrier":   {hasValue: true, values: []string{"0", "1"}},
+		"nobarrier": {},
+	},
+	"ext4": {
+		"errors":          extErrorsOption,
+		"data":            {hasValue: true, values: []string{"ordered", "writeback", "journal"}},
+		"commit":          {hasValue: true},
+		"barrier":         {hasValue: true, values: []string{"0", "1"}},
+		"nobarrier":       {},
+		"discard":         {},
+		"nodiscard":       {},
+		"noauto_da_alloc": {},
+	},
+	"xfs": {
+		"discard":   {},
+		"nodiscard": {},
+		"nobarrier": {},
+		"inode64":   {},
+		"largeio":   {},
+		"logbufs":   {hasValue: true},
+		"logbsize":  {hasValue: true, values: []string{"16k", "32k", "64k", "128k", "256k"}},
+	},
+	"btrfs": {
+		"discard":    {},
+		"nodiscard":  {},
+		"ssd":        {},
+		"nossd":      {},
+		"autodefrag": {},
+		"commit":     {hasValue: true},
+		"compress":   {hasValue: true, values: []string{"zlib", "lzo", "zstd", "no"}},
+	},
+}
+
+// optionNames returns sorted names of the allowed options, for error messages
+func optionNames(allowed ...map[string]fsOption) string {
+	var names []string
+	for _, options := range allowed {
+		for name := range options {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// parseFsOptions splits comma separated options and checks them against allowed
+func parseFsOptions(opts string, allowed map[string]fsOption) ([]parsedOption, error) {
+	var parsed []parsedOption
+	if opts == "" {
+		return parsed, nil
+	}
+	for _, entry := range strings.Split(opts, ",") {
+		name, value := entry, ""
+		hasValue := false
+		if i := strings.Index(entry, "="); i >= 0 {
+			name, value, hasValue = entry[:i], entry[i+1:], true
+		}
+		option, exists := allowed[name]
+		if !exists {
+			return nil, fmt.Errorf("Option %s is not allowed", name)
+		}
+		if hasValue != option.hasValue {
+			if option.hasValue {
+				return nil, fmt.Errorf("Option %s requires a value", name)
+			}
+			return nil, fmt.Errorf("Option %s does not take a value", name)
+		}
+		if option.hasValue && !validOptionValue(option, value) {
+			if len(option.values) > 0 {
+				return nil, fmt.Errorf("Invalid value %q for option %s, valid values are %s",
+					value, name, strings.Join(option.values, ", "))
+			}
+			return nil, fmt.Errorf("Invalid value %q for option %s, expected a number", value, name)
+		}
+		parsed = append(parsed, parsedOption{name, value, option})
+	}
+	return parsed, nil
+}
+
+func validOptionValue(option fsOption, value string) bool {
+	if len(option.values) == 0 {
+		_, err := strconv.ParseUint(value, 10, 32)
+		return err == nil
+	}
+	for _, v := range option.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// mkfsArgs returns mkfs arguments for mkfs-opts
+func mkfsArgs(fstype string, opts string) ([]string, error) {
+	allowed := mkfsOptions[fstype]
+	parsed, err := parseFsOptions(opts, allowed)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid mkfs-opts for %s: %v. Allowed options: %s",
+			fstype, err, optionNames(allowed))
+	}
+	var args []string
+	for _, option := range parsed {
+		arg := option.arg
+		if option.hasValue {
+			arg = fmt.Sprintf(arg, option.value)
+		}
+		args = append(args, strings.Fields(arg)...)
+	}
+	return args, nil
+}
+
+// mountArgs returns mount flags and data for mount-opts
+func mountArgs(fstype string, opts string) (uintptr, string, error) {
+	allowed := make(map[string]fsOption)
+	for name, option := range mountDataOptions[fstype] {
+		allowed[name] = option
+	}
+	for name := range mountFlags {
+		allowed[name] = fsOption{}
+	}
+	parsed, err := parseFsOptions(opts, allowed)
+	if err != nil {
+		return 0, "", fmt.Errorf("Invalid mount-opts for %s: %v. Allowed options: %s",
+			fstype, err, optionNames(allowed))
+	}
+	var flags uintptr
+	var data []string
+	for _, option := range parsed {
+		if flag, exists := mountFlags[option.name]; exists {
+			flags |= flag
+		} else if option.hasValue {
+			data = append(data, option.name+"="+option.value)
+		} else {
+			data = append(data, option.name)
+		}
+	}
+	return flags, strings.Join(data, ","), nil
+}
+
+// ValidateMkfsOptions checks mkfs-opts against the options allowed for fstype
+func ValidateMkfsOptions(fstype string, opts string) error {
+	_, err := mkfsArgs(fstype, opts)
+	return err
+}
+
+// ValidateMountOptions checks mount-opts against the options allowed for fstype
+func ValidateMountOptions(fstype string, opts string) error {
+	_, _, err := mountArgs(fstype, opts)
+	return err
+}
@@ -0,0 +1,80 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fs
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	args, err := mkfsArgs("ext4", "inode_size=512,lazy_itable_init=0,nodiscard")
+	assert.Nil(t, err, "Valid ext4 mkfs options should be accepted")
+	assert.Equal(t, []string{"-I", "512", "-E", "lazy_itable_init=0", "-E", "nodiscard"}, args)
+
+	args, err = mkfsArgs("xfs", "inode_size=512")
+	assert.Nil(t, err, "Valid xfs mkfs options should be accepted")
+	assert.Equal(t, []string{"-i", "size=512"}, args)
+
+	args, err = mkfsArgs("ext4", "")
+	assert.Nil(t, err, "Empty mkfs options should be accepted")
+	assert.Empty(t, args)
+}
+
+func TestMkfsArgsError(t *testing.T) {
+	for _, opts := range []string{
+		"inode_size",           // missing value
+		"inode_size=big",       // not a number
+		"nodiscard=1",          // no value expected
+		"lazy_itable_init=2",   // not one of the values
+		"-O ^has_journal",      // not in the allow-list
+		"inode_size=512,bogus", // one bad option
+	} {
+		_, err := mkfsArgs("ext4", opts)
+		assert.NotNil(t, err, "mkfs options %q should be refused", opts)
+	}
+	_, err := mkfsArgs(funnyfs, "inode_size=512")
+	assert.NotNil(t, err, "mkfs options for fstype %s should be refused", funnyfs)
+}
+
+func TestMountArgs(t *testing.T) {
+	flags, data, err := mountArgs("ext4", "noatime,discard,data=writeback,nodev")
+	assert.Nil(t, err, "Valid ext4 mount options should be accepted")
+	assert.Equal(t, uintptr(syscall.MS_NOATIME|syscall.MS_NODEV), flags)
+	assert.Equal(t, "discard,data=writeback", data)
+
+	flags, data, err = mountArgs(funnyfs, "noatime")
+	assert.Nil(t, err, "Generic mount options should be accepted for any fstype")
+	assert.Equal(t, uintptr(syscall.MS_NOATIME), flags)
+	assert.Equal(t, "", data)
+}
+
+func TestMountArgsError(t *testing.T) {
+	for _, opts := range []string{
+		"discard=1",        // no value expected
+		"commit=soon",      // not a number
+		"data=unordered",   // not one of the values
+		"remount",          // not in the allow-list
+		"errors=panic",     // affects the host
+		"noatime,,discard", // empty entry
+	} {
+		_, _, err := mountArgs("ext4", opts)
+		assert.NotNil(t, err, "mount options %q should be refused", opts)
+	}
+	_, _, err := mountArgs("ext2", "discard")
+	assert.NotNil(t, err, "discard should be refused for ext2")
+}
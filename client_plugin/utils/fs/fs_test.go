@@ -15,6 +15,9 @@
 package fs
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -31,3 +34,40 @@ func TestVerifyFSSupportError(t *testing.T) {
 	err := VerifyFSSupport(funnyfs)
 	assert.NotNil(t, err, "Fstype %s shouldn't be supported", funnyfs)
 }
+
+func TestGrowFsError(t *testing.T) {
+	err := GrowFs(funnyfs, "/dev/null", "/tmp")
+	assert.NotNil(t, err, "Growing fstype %s shouldn't be supported", funnyfs)
+}
+
+func TestFreezeFsError(t *testing.T) {
+	err := FreezeFs("/non/existent/mountpoint")
+	assert.NotNil(t, err, "Freezing a non existent mountpoint should fail")
+	err = ThawFs("/non/existent/mountpoint")
+	assert.NotNil(t, err, "Thawing a non existent mountpoint should fail")
+}
+
+func TestTrimError(t *testing.T) {
+	_, err := Trim("/non/existent/mountpoint")
+	assert.NotNil(t, err, "Trimming a non existent mountpoint should fail")
+}
+
+func TestFsckPolicyNone(t *testing.T) {
+	result, err := FsckByDevicePath(FstypeDefault, "/dev/null", FsckNone, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, FsckSkipped, result, "No check expected with policy %s", FsckNone)
+}
+
+func TestHasBlockDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fs_test")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.False(t, HasBlockDevice(dir), "Empty mountpoint shouldn't have a block device")
+	err = ioutil.WriteFile(filepath.Join(dir, BlockDeviceFile), []byte{}, 0600)
+	assert.Nil(t, err)
+	assert.False(t, HasBlockDevice(dir), "Regular file shouldn't be taken for a block device")
+
+	assert.Nil(t, RemoveBlockDevice(dir))
+	assert.Nil(t, RemoveBlockDevice(dir), "Removing a missing block device should succeed")
+}
@@ -176,8 +176,11 @@ func DevAttachWaitFallback() {
 	// NOP since DevAttachWaitPrep never returns an error
 }
 
-// Mkfs creates a filesystem at the specified volDev.
-func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
+// Mkfs creates a filesystem at the specified volDev. mkfsOpts are not supported.
+func Mkfs(fstype string, label string, volDev *VolumeDevSpec, mkfsOpts string) error {
+	if err := ValidateMkfsOptions(fstype, mkfsOpts); err != nil {
+		return err
+	}
 	diskNum, err := getDiskNum(volDev)
 	if err != nil {
 		log.WithFields(log.Fields{"fstype": fstype, "label": label, "volDev": *volDev,
@@ -198,8 +201,11 @@ func Mkfs(fstype string, label string, volDev *VolumeDevSpec) error {
 	}
 }
 
-// Mount mounts the filesystem on the volDev at the given mountpoint.
-func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool) error {
+// Mount mounts the filesystem on the volDev at the given mountpoint. mountOpts are not supported.
+func Mount(mountpoint string, fstype string, volDev *VolumeDevSpec, isReadOnly bool, mountOpts string) error {
+	if err := ValidateMountOptions(fstype, mountOpts); err != nil {
+		return err
+	}
 	diskNum, err := getDiskNum(volDev)
 	if err != nil {
 		log.WithFields(log.Fields{"mountpoint": mountpoint, "fstype": fstype,
@@ -319,12 +325,22 @@ func GetDevicePathByID(id string) (string, error) {
 }
 
 // MkfsByDevicePath returns an error.
-func MkfsByDevicePath(fstype string, label string, device string) error {
+func MkfsByDevicePath(fstype string, label string, device string, mkfsOpts string) error {
 	return errors.New("MkfsByDevicePath is not supported")
 }
 
+// GetFsType returns an error.
+func GetFsType(volDev *VolumeDevSpec) (string, error) {
+	return "", errors.New("GetFsType is not supported")
+}
+
+// GetFsTypeByDevicePath returns an error.
+func GetFsTypeByDevicePath(device string) (string, error) {
+	return "", errors.New("GetFsTypeByDevicePath is not supported")
+}
+
 // MountByDevicePath returns an error.
-func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool) error {
+func MountByDevicePath(mountpoint string, fstype string, device string, isReadOnly bool, mountOpts string) error {
 	return errors.New("MountByDevicePath is not supported")
 }
 
@@ -332,3 +348,114 @@ func MountByDevicePath(mountpoint string, fstype string, device string, isReadOn
 func MountWithID(mountpoint string, fstype string, id string, isReadOnly bool) error {
 	return errors.New("MountWithID is not supported")
 }
+
+// GrowFs returns an error.
+func GrowFs(fstype string, device string, mountpoint string) error {
+	return errors.New("GrowFs is not supported")
+}
+
+// FreezeFs returns an error.
+func FreezeFs(mountpoint string) error {
+	return errors.New("FreezeFs is not supported")
+}
+
+// ThawFs returns an error.
+func ThawFs(mountpoint string) error {
+	return errors.New("ThawFs is not supported")
+}
+
+// ExposeBlockDevice returns an error, block-mode volumes are not supported.
+func ExposeBlockDevice(mountpoint string, volDev *VolumeDevSpec, isReadOnly bool) error {
+	return errors.New("Block-mode volumes are not supported")
+}
+
+// ExposeBlockDeviceByDevicePath returns an error, block-mode volumes are not supported.
+func ExposeBlockDeviceByDevicePath(mountpoint string, device string, isReadOnly bool) error {
+	return errors.New("Block-mode volumes are not supported")
+}
+
+// GetBlockDevices returns an empty map, block-mode volumes are never exposed.
+func GetBlockDevices(mountRoot string) (map[string]string, error) {
+	return make(map[string]string), nil
+}
+
+// Fsck does not check the filesystem on Windows.
+func Fsck(fstype string, volDev *VolumeDevSpec, policy string, timeout time.Duration) (string, error) {
+	return FsckSkipped, nil
+}
+
+// FsckByDevicePath does not check the filesystem on Windows.
+func FsckByDevicePath(fstype string, device string, policy string, timeout time.Duration) (string, error) {
+	return FsckSkipped, nil
+}
+
+// Trim returns an error.
+func Trim(mountpoint string) (uint64, error) {
+	return 0, errors.New("Trim is not supported")
+}
+
+// ValidateMkfsOptions returns an error if any mkfs options are given.
+func ValidateMkfsOptions(fstype string, opts string) error {
+	if opts != "" {
+		return errors.New("mkfs-opts are not supported")
+	}
+	return nil
+}
+
+// ValidateMountOptions returns an error if any mount options are given.
+func ValidateMountOptions(fstype string, opts string) error {
+	if opts != "" {
+		return errors.New("mount-opts are not supported")
+	}
+	return nil
+}
+
+// VerifyLuksSupport returns an error, encrypted volumes are not supported.
+func VerifyLuksSupport() error {
+	return errors.New("Encrypted volumes are not supported")
+}
+
+// LuksFormat returns an error.
+func LuksFormat(volDev *VolumeDevSpec, key []byte) error {
+	return errors.New("Encrypted volumes are not supported")
+}
+
+// LuksFormatByDevicePath returns an error.
+func LuksFormatByDevicePath(device string, key []byte) error {
+	return errors.New("Encrypted volumes are not supported")
+}
+
+// LuksOpen returns an error.
+func LuksOpen(volDev *VolumeDevSpec, name string, key []byte, isReadOnly bool) (string, error) {
+	return "", errors.New("Encrypted volumes are not supported")
+}
+
+// LuksOpenByDevicePath returns an error.
+func LuksOpenByDevicePath(device string, name string, key []byte, isReadOnly bool) (string, error) {
+	return "", errors.New("Encrypted volumes are not supported")
+}
+
+// LuksIsOpen returns false, encrypted volumes are never opened.
+func LuksIsOpen(name string) bool {
+	return false
+}
+
+// LuksClose returns an error.
+func LuksClose(name string) error {
+	return errors.New("Encrypted volumes are not supported")
+}
+
+// SetIoLimits returns an error, I/O limits are not supported.
+func SetIoLimits(volDev *VolumeDevSpec, cgroup string, limits IoLimits) error {
+	return errors.New("I/O limits are not supported")
+}
+
+// SetIoLimitsByDevicePath returns an error, I/O limits are not supported.
+func SetIoLimitsByDevicePath(device string, cgroup string, limits IoLimits) error {
+	return errors.New("I/O limits are not supported")
+}
+
+// GetFsUsage returns an error.
+func GetFsUsage(mountpoint string) (FsUsage, error) {
+	return FsUsage{}, errors.New("Filesystem usage is not supported")
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Key providers supply the keys of encrypted volumes.
+//
+// The "file" provider reads the key of a volume from a file named as the volume
+// in the key directory, or from the file "default" there if the volume has none.
+// The "env" provider uses the key in the VDVS_VOLUME_KEY environment variable
+// for all volumes.
+
+package keyprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// FileProvider reads keys from files
+	FileProvider = "file"
+	// EnvProvider takes the key from the environment
+	EnvProvider = "env"
+
+	// EnvKeyVar is the environment variable with the key for EnvProvider
+	EnvKeyVar = "VDVS_VOLUME_KEY"
+
+	// defaultKeyFile has the key for volumes without their own key file
+	defaultKeyFile = "default"
+)
+
+// Provider supplies the keys of encrypted volumes.
+type Provider interface {
+	// Key returns the key of the volume.
+	Key(volume string) ([]byte, error)
+}
+
+// New returns the provider of the given kind. dir is the key directory of FileProvider.
+func New(kind string, dir string) (Provider, error) {
+	switch kind {
+	case FileProvider:
+		return fileProvider{dir: dir}, nil
+	case EnvProvider:
+		return envProvider{}, nil
+	}
+	return nil, fmt.Errorf("Unknown key provider %q, valid providers are %s and %s", kind, FileProvider, EnvProvider)
+}
+
+// fileProvider reads the key of a volume from dir/<volume>, or dir/default
+type fileProvider struct {
+	dir string
+}
+
+func (p fileProvider) Key(volume string) ([]byte, error) {
+	if volume == "" || strings.ContainsAny(volume, `/\`) || volume == "." || volume == ".." {
+		return nil, fmt.Errorf("Invalid volume name %q for a key file", volume)
+	}
+	for _, name := range []string{volume, defaultKeyFile} {
+		data, err := ioutil.ReadFile(filepath.Join(p.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read key of volume %s: %v", volume, err)
+		}
+		// Editors add a newline at the end of the file
+		key := bytes.TrimRight(data, "\r\n")
+		if len(key) == 0 {
+			return nil, fmt.Errorf("Key file %s is empty", filepath.Join(p.dir, name))
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("No key for volume %s, add key file %s or %s", volume,
+		filepath.Join(p.dir, volume), filepath.Join(p.dir, defaultKeyFile))
+}
+
+// envProvider takes the key of all volumes from EnvKeyVar
+type envProvider struct{}
+
+func (p envProvider) Key(volume string) ([]byte, error) {
+	key := os.Getenv(EnvKeyVar)
+	if key == "" {
+		return nil, fmt.Errorf("No key for volume %s, %s is not set", volume, EnvKeyVar)
+	}
+	return []byte(key), nil
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keyprovider
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := New(FileProvider, dir)
+	assert.Nil(t, err)
+	_, err = p.Key("vol1")
+	assert.NotNil(t, err, "Volume without key file and no default key should have no key")
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "vol1"), []byte("secret1\n"), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, defaultKeyFile), []byte("secret"), 0600))
+	key, err := p.Key("vol1")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret1", string(key))
+	key, err = p.Key("vol2")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(key), "Volume without key file should have the default key")
+
+	_, err = p.Key("../vol1")
+	assert.NotNil(t, err, "Key files outside the key directory should not be read")
+}
+
+func TestEnvProvider(t *testing.T) {
+	p, err := New(EnvProvider, "")
+	assert.Nil(t, err)
+	os.Setenv(EnvKeyVar, "")
+	_, err = p.Key("vol1")
+	assert.NotNil(t, err)
+	os.Setenv(EnvKeyVar, "secret")
+	defer os.Unsetenv(EnvKeyVar)
+	key, err := p.Key("vol1")
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", string(key))
+
+	_, err = New("vault", "")
+	assert.NotNil(t, err)
+}
@@ -15,11 +15,13 @@
 package plugin_server
 
 import (
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/sdk"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/codecov"
 )
@@ -32,6 +34,123 @@ type PluginServer interface {
 	Destroy()
 }
 
+// Canceler is implemented by drivers which can abort requests in progress.
+type Canceler interface {
+	// Cancel aborts requests in progress.
+	Cancel()
+}
+
+// Resizer is implemented by drivers which can grow volumes.
+type Resizer interface {
+	// ResizeVolume grows the volume to size.
+	ResizeVolume(name string, size string) error
+}
+
+// Reverter is implemented by drivers which can revert volumes to snapshots.
+type Reverter interface {
+	// RevertVolume replaces the content of the volume with the content of snapshot.
+	RevertVolume(name string, snapshot string) error
+}
+
+// SnapshotManager is implemented by drivers which can list and remove snapshots of volumes.
+type SnapshotManager interface {
+	// ListSnapshots lists the snapshots of the volume.
+	ListSnapshots(name string) ([]*volume.Volume, error)
+	// RemoveSnapshot removes snapshot of the volume.
+	RemoveSnapshot(name string, snapshot string) error
+}
+
+// Reclaimer is implemented by drivers which can release unused space of volumes.
+type Reclaimer interface {
+	// ReclaimVolume releases the unused space of the volume.
+	ReclaimVolume(name string) error
+}
+
+// LabelLister is implemented by drivers which can list volumes by their labels.
+type LabelLister interface {
+	// ListVolumesByLabels lists the volumes with labels matching selector.
+	ListVolumesByLabels(selector string) ([]*volume.Volume, error)
+}
+
+// Paths extending the Docker volume plugin API, for admins to manage volumes. E.g.
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Name": "vol1", "Opts": {"size": "20gb"}}' http://localhost/VolumeDriver.Resize
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Name": "vol1", "Opts": {"snapshot": "snap1"}}' http://localhost/VolumeDriver.Revert
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Name": "vol1"}' http://localhost/VolumeDriver.ListSnapshots
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Name": "vol1", "Opts": {"snapshot": "snap1"}}' http://localhost/VolumeDriver.RemoveSnapshot
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Name": "vol1"}' http://localhost/VolumeDriver.Reclaim
+// curl --unix-socket /run/docker/plugins/vsphere.sock -d '{"Opts": {"selector": "app=web"}}' http://localhost/VolumeDriver.ListByLabels
+const (
+	resizePath         = "/VolumeDriver.Resize"
+	revertPath         = "/VolumeDriver.Revert"
+	listSnapshotsPath  = "/VolumeDriver.ListSnapshots"
+	removeSnapshotPath = "/VolumeDriver.RemoveSnapshot"
+	reclaimPath        = "/VolumeDriver.Reclaim"
+	listByLabelsPath   = "/VolumeDriver.ListByLabels"
+)
+
+// handleAdminQuery serves path with f, taking volume name and options from the request
+// and responding with the response of f
+func handleAdminQuery(handler *volume.Handler, path string, f func(req volume.Request) volume.Response) {
+	handler.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		var req volume.Request
+		if err := sdk.DecodeRequest(w, r, &req); err != nil {
+			return
+		}
+		res := f(req)
+		sdk.EncodeResponse(w, res, res.Err)
+	})
+}
+
+// handleAdminRequest serves path with f, taking volume name and options from the request
+func handleAdminRequest(handler *volume.Handler, path string, f func(req volume.Request) error) {
+	handleAdminQuery(handler, path, func(req volume.Request) volume.Response {
+		if err := f(req); err != nil {
+			return volume.Response{Err: err.Error()}
+		}
+		return volume.Response{}
+	})
+}
+
+// addAdminHandlers serves requests which are not part of the Docker volume plugin API
+func addAdminHandlers(handler *volume.Handler, driver volume.Driver) {
+	if resizer, ok := driver.(Resizer); ok {
+		handleAdminRequest(handler, resizePath, func(req volume.Request) error {
+			return resizer.ResizeVolume(req.Name, req.Options["size"])
+		})
+	}
+	if reverter, ok := driver.(Reverter); ok {
+		handleAdminRequest(handler, revertPath, func(req volume.Request) error {
+			return reverter.RevertVolume(req.Name, req.Options["snapshot"])
+		})
+	}
+	if manager, ok := driver.(SnapshotManager); ok {
+		handleAdminQuery(handler, listSnapshotsPath, func(req volume.Request) volume.Response {
+			snapshots, err := manager.ListSnapshots(req.Name)
+			if err != nil {
+				return volume.Response{Err: err.Error()}
+			}
+			return volume.Response{Volumes: snapshots}
+		})
+		handleAdminRequest(handler, removeSnapshotPath, func(req volume.Request) error {
+			return manager.RemoveSnapshot(req.Name, req.Options["snapshot"])
+		})
+	}
+	if reclaimer, ok := driver.(Reclaimer); ok {
+		handleAdminRequest(handler, reclaimPath, func(req volume.Request) error {
+			return reclaimer.ReclaimVolume(req.Name)
+		})
+	}
+	if lister, ok := driver.(LabelLister); ok {
+		handleAdminQuery(handler, listByLabelsPath, func(req volume.Request) volume.Response {
+			volumes, err := lister.ListVolumesByLabels(req.Options["selector"])
+			if err != nil {
+				return volume.Response{Err: err.Error()}
+			}
+			return volume.Response{Volumes: volumes}
+		})
+	}
+}
+
 // StartServer starts a plugin server based on runtime OS
 func StartServer(driverName string, driver *volume.Driver) {
 	server := NewPluginServer(driverName, driver)
@@ -41,6 +160,9 @@ func StartServer(driverName string, driver *volume.Driver) {
 	go func() {
 		sig := <-sigChannel
 		log.WithFields(log.Fields{"signal": sig}).Warning("Received signal ")
+		if c, ok := (*driver).(Canceler); ok {
+			c.Cancel()
+		}
 		coverage.Capture()
 		server.Destroy()
 		os.Exit(0)
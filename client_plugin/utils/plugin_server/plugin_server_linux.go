@@ -54,6 +54,7 @@ func NewPluginServer(driverName string, driver *volume.Driver) *SockPluginServer
 // requests from Docker.
 func (s *SockPluginServer) Init() {
 	handler := volume.NewHandler(*s.driver)
+	addAdminHandlers(handler, *s.driver)
 
 	log.WithFields(log.Fields{
 		"address": s.sockAddr,
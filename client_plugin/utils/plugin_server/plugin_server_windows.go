@@ -91,6 +91,7 @@ func (s *NpipePluginServer) Init() {
 	}
 
 	handler := volume.NewHandler(*s.driver)
+	addAdminHandlers(handler, *s.driver)
 	log.WithFields(log.Fields{"npipe": npipeAddr}).Info("Going into Serve - Listening on npipe ")
 	log.Info(handler.Serve(s.listener))
 }
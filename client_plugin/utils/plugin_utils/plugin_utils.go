@@ -17,6 +17,7 @@ package plugin_utils
 // This file holds utility/helper methods required in plugin module
 
 import (
+	"path/filepath"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
@@ -29,6 +30,21 @@ const (
 	// "datastore" key is defined in vmdkops service
 	datastoreKey = "datastore"
 
+	// VolumeModeKey is the volume metadata key and create option for the volume mode
+	VolumeModeKey = "volume-mode"
+	// VolumeModeBlock is the volume mode of volumes used as raw block devices, without a filesystem
+	VolumeModeBlock = "block"
+	// VolumeModeFilesystem is the default volume mode
+	VolumeModeFilesystem = "filesystem"
+
+	// EncryptionKey is the volume metadata key and create option for the encryption of the volume
+	EncryptionKey = "encryption"
+	// EncryptionLuks is the encryption of volumes encrypted with LUKS/dm-crypt in the guest
+	EncryptionLuks = "luks"
+	// EncryptionKeyIDKey is the volume metadata key for the name the key of an encrypted volume is
+	// looked up by, the name of the volume it was created as. Copies keep it with the metadata.
+	EncryptionKeyIDKey = "encryption-key"
+
 	// PluginInitError message to indicate that plugin initialization(refcounting) is not yet complete
 	PluginInitError = "Plugin initialization in progress."
 )
@@ -40,7 +56,8 @@ type VolumeInfo struct {
 	VolumeMeta    map[string]interface{}
 }
 
-// AlreadyMounted - check if volume is already mounted on the mountRoot
+// AlreadyMounted - check if volume is already mounted on the mountRoot,
+// or exposed there as a block device for block-mode volumes
 func AlreadyMounted(name string, mountRoot string) bool {
 	volumeMap, err := fs.GetMountInfo(mountRoot)
 
@@ -51,7 +68,31 @@ func AlreadyMounted(name string, mountRoot string) bool {
 	if _, ok := volumeMap[name]; ok {
 		return true
 	}
-	return false
+	return fs.HasBlockDevice(filepath.Join(mountRoot, name))
+}
+
+// MountFstype returns the fstype to mount the volume with, given the volume metadata:
+// fs.FstypeBlock for block-mode volumes, the volume fstype otherwise.
+// The second return value is false if the metadata has neither.
+func MountFstype(volumeMeta map[string]interface{}) (string, bool) {
+	if mode, _ := volumeMeta[VolumeModeKey].(string); mode == VolumeModeBlock {
+		return fs.FstypeBlock, true
+	}
+	fstype, exists := volumeMeta["fstype"].(string)
+	return fstype, exists
+}
+
+// IsEncrypted tells whether the volume metadata is of an encrypted volume
+func IsEncrypted(volumeMeta map[string]interface{}) bool {
+	encryption, _ := volumeMeta[EncryptionKey].(string)
+	return encryption == EncryptionLuks
+}
+
+// EncryptionKeyID returns the name the key of an encrypted volume is looked up by, from its
+// metadata. Empty for volumes encrypted before it was kept in the metadata.
+func EncryptionKeyID(volumeMeta map[string]interface{}) string {
+	id, _ := volumeMeta[EncryptionKeyIDKey].(string)
+	return id
 }
 
 // makeFullVolName - return a full name in format volume@datastore
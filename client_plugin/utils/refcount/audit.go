@@ -0,0 +1,250 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// Refcount audit.
+//
+// Refcounts and mounts are synced with Docker on plugin start only. Drift
+// building up later, from a container killed without unmount, a manual umount
+// or a disk detached from vCenter, is found by the auditor. It periodically
+// discovers refcounts from Docker again, compares them with the refcounts of
+// the plugin and with the mounts, and logs each discrepancy as an event. In
+// repair mode it also fixes them, as discovery on start does. A container may
+// be starting or stopping while Docker is asked, so a discrepancy is reported
+// only when the next audit finds it again.
+//
+
+package refcount
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
+)
+
+const (
+	// Audit modes
+	AuditDryRun = "dry-run" // report discrepancies only
+	AuditRepair = "repair"  // report and fix discrepancies
+
+	// Kinds of discrepancies
+	auditRefCount   = "refcount-mismatch" // refcount differs from Docker's
+	auditUnused     = "unused-mount"      // mounted, but no container uses it
+	auditNotMounted = "not-mounted"       // used by containers, but not mounted
+	auditNoDevice   = "device-missing"    // mounted, but the device is gone
+)
+
+// auditEvent is a discrepancy found by the audit
+type auditEvent struct {
+	kind     string
+	name     string
+	refcount uint   // refcount of the plugin
+	docker   uint   // refcount as Docker sees it
+	dev      string // device the volume is mounted from, if mounted
+}
+
+// auditRefCounts compares refcounts of the plugin with refcounts from Docker and with
+// mounted volumes and their devices, and returns the discrepancies ordered by volume
+func auditRefCounts(refcounts map[string]uint, docker map[string]uint, mounted map[string]string,
+	missing func(dev string) bool) []auditEvent {
+	names := make(map[string]bool)
+	for _, m := range []map[string]uint{refcounts, docker} {
+		for vol := range m {
+			names[vol] = true
+		}
+	}
+	for vol := range mounted {
+		names[vol] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for vol := range names {
+		sorted = append(sorted, vol)
+	}
+	sort.Strings(sorted)
+
+	var events []auditEvent
+	for _, vol := range sorted {
+		dev, isMounted := mounted[vol]
+		event := auditEvent{name: vol, refcount: refcounts[vol], docker: docker[vol], dev: dev}
+		if event.refcount != event.docker {
+			event.kind = auditRefCount
+			events = append(events, event)
+		}
+		switch {
+		case isMounted && missing(dev):
+			event.kind = auditNoDevice
+		case isMounted && event.docker == 0:
+			event.kind = auditUnused
+		case !isMounted && event.docker > 0:
+			event.kind = auditNotMounted
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// ValidAuditMode returns mode if it is valid, AuditDryRun otherwise
+func ValidAuditMode(mode string) string {
+	if mode != AuditDryRun && mode != AuditRepair {
+		log.WithFields(log.Fields{"mode": mode, "valid": []string{AuditDryRun, AuditRepair}}).Error(
+			"Invalid RefCountAuditMode, only reporting discrepancies ")
+		return AuditDryRun
+	}
+	return mode
+}
+
+// AuditLoop audits refcounts every interval, fixing discrepancies in AuditRepair mode
+func (r *RefCountsMap) AuditLoop(d drivers.VolumeDriver, interval time.Duration, mode string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := r.audit(d, mode == AuditRepair); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warning("Refcount audit skipped ")
+		}
+	}
+}
+
+// audit discovers refcounts from Docker, compares them with refcounts and mounts,
+// and logs the discrepancies. Fixes them if repair is set.
+func (r *RefCountsMap) audit(d drivers.VolumeDriver, repair bool) error {
+	if !r.IsInitialized() {
+		return fmt.Errorf("refcounting is not initialized")
+	}
+	r.discoverMtx.Lock()
+	defer r.discoverMtx.Unlock()
+
+	c, err := client.NewClient(DockerHostAddr, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		return err
+	}
+	r.StateMtx.Lock()
+	r.isDirty = false
+	r.StateMtx.Unlock()
+
+	docker, err := r.dockerRefCounts(c)
+	if err != nil {
+		return err
+	}
+
+	// Compare and repair under the same lock as mounts and unmounts
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if r.isDirty {
+		return fmt.Errorf("refcounts changed during the audit")
+	}
+	mounted, err := fs.GetMountInfo(mountRoot)
+	if err != nil {
+		return err
+	}
+	blockDevMap, err := fs.GetBlockDevices(mountRoot)
+	if err != nil {
+		return err
+	}
+	for vol, dev := range blockDevMap {
+		mounted[vol] = dev
+	}
+
+	r.mtx.RLock()
+	refcounts := make(map[string]uint)
+	for vol, rc := range r.refMap {
+		if rc.count > 0 {
+			refcounts[vol] = rc.count
+		}
+	}
+	r.mtx.RUnlock()
+
+	events := auditRefCounts(refcounts, docker, mounted, deviceMissing)
+	suspects := make(map[string]bool)
+	confirmed := 0
+	for _, event := range events {
+		key := event.kind + "/" + event.name
+		suspects[key] = true
+		if !r.auditSuspects[key] {
+			continue
+		}
+		confirmed++
+		log.WithFields(log.Fields{
+			"event":    "refcount-audit",
+			"kind":     event.kind,
+			"name":     event.name,
+			"refcount": event.refcount,
+			"docker":   event.docker,
+			"device":   event.dev,
+			"repair":   repair,
+		}).Warning("Refcount audit found a discrepancy ")
+		if repair {
+			r.repair(d, event)
+		}
+	}
+	r.auditSuspects = suspects
+	log.WithFields(log.Fields{"volumes": len(refcounts), "discrepancies": confirmed}).Debug("Refcount audit completed ")
+	return nil
+}
+
+// repair fixes the discrepancy of event. Docker's view is the correct one.
+// Caller holds r.StateMtx.
+func (r *RefCountsMap) repair(d drivers.VolumeDriver, event auditEvent) {
+	var err error
+	switch event.kind {
+	case auditRefCount:
+		r.setCount(event.name, event.docker)
+	case auditUnused:
+		err = d.UnmountVolume(event.name)
+	case auditNoDevice:
+		// Drop the stale mount, the disk may be detached already,
+		// and mount again if containers use the volume
+		d.UnmountVolume(event.name)
+		if event.docker > 0 {
+			err = recoveryMount(d, event.name)
+		}
+	case auditNotMounted:
+		err = recoveryMount(d, event.name)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"kind": event.kind, "name": event.name, "error": err}).Warning(
+			"Failed to repair refcount audit discrepancy - manual recovery may be needed ")
+		return
+	}
+	log.WithFields(log.Fields{"kind": event.kind, "name": event.name}).Info("Refcount audit discrepancy repaired ")
+}
+
+// setCount sets the refcount of vol, forgetting the volume and its mount IDs if count is 0
+func (r *RefCountsMap) setCount(vol string, count uint) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if count == 0 {
+		delete(r.refMap, vol)
+		for id, mountVol := range r.mountIDs {
+			if mountVol == vol {
+				delete(r.mountIDs, id)
+			}
+		}
+	} else {
+		rc := r.refMap[vol]
+		if rc == nil {
+			rc = newRefCount()
+			r.refMap[vol] = rc
+		}
+		rc.count = count
+	}
+	r.saveJournal()
+}
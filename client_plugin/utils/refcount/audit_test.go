@@ -0,0 +1,50 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditRefCounts(t *testing.T) {
+	refcounts := map[string]uint{"ok@ds1": 1, "killed@ds1": 1, "umounted@ds1": 2, "detached@ds1": 1}
+	docker := map[string]uint{"ok@ds1": 1, "umounted@ds1": 2, "detached@ds1": 1, "missed@ds2": 1}
+	mounted := map[string]string{"ok@ds1": "/dev/sdb", "killed@ds1": "/dev/sdc", "detached@ds1": "/dev/sdd",
+		"missed@ds2": "/dev/sde"}
+	missing := func(dev string) bool { return dev == "/dev/sdd" }
+
+	var found []string
+	for _, event := range auditRefCounts(refcounts, docker, mounted, missing) {
+		found = append(found, event.kind+"/"+event.name)
+	}
+	assert.Equal(t, []string{
+		"device-missing/detached@ds1",
+		"refcount-mismatch/killed@ds1",
+		"unused-mount/killed@ds1",
+		"refcount-mismatch/missed@ds2",
+		"not-mounted/umounted@ds1",
+	}, found)
+
+	assert.Empty(t, auditRefCounts(docker, docker, map[string]string{"ok@ds1": "/dev/sdb",
+		"umounted@ds1": "/dev/sdc", "detached@ds1": "/dev/sdd", "missed@ds2": "/dev/sde"},
+		func(string) bool { return false }))
+}
+
+func TestValidAuditMode(t *testing.T) {
+	assert.Equal(t, AuditRepair, ValidAuditMode(AuditRepair))
+	assert.Equal(t, AuditDryRun, ValidAuditMode("fix-all"))
+}
@@ -0,0 +1,197 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// Docker events.
+//
+// Refcounts rely on Docker sending an Unmount for each Mount. Docker may
+// forget it, e.g. when the daemon crashes while stopping a container. The
+// events watcher subscribes to Docker events, and when a container using
+// volumes of the plugin dies or is destroyed, or a volume the plugin holds a
+// refcount for is unmounted, it schedules an audit (see audit.go) a little
+// later, once Docker is done with its unmounts. The audit is run again to
+// confirm the discrepancies it found, so they are reported or repaired without
+// waiting for the periodic audits. Events are not used to change refcounts
+// directly, as Docker sends the Unmount for most of them anyway.
+//
+// The stream ends when Docker restarts. The watcher reconnects, and audits as
+// events may have been missed meanwhile.
+//
+
+package refcount
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/docker/engine-api/types/filters"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+	"golang.org/x/net/context"
+)
+
+const (
+	eventsRetryMaxSec = 60 // max. delay between reconnects to Docker events
+
+	// Actions of events which may leave refcounts out of sync
+	eventDie     = "die"
+	eventDestroy = "destroy"
+	eventUnmount = "unmount"
+)
+
+// EventsLoop watches Docker events and audits refcounts delay after events which may
+// leave them out of sync, fixing discrepancies in AuditRepair mode. Reconnects when
+// the events stream ends.
+func (r *RefCountsMap) EventsLoop(d drivers.VolumeDriver, delay time.Duration, mode string) {
+	audits := make(chan struct{}, 1)
+	go r.eventAudits(d, audits, delay, mode == AuditRepair)
+
+	retry := defaultSleepIntervalSec * time.Second
+	for reconnect := false; ; reconnect = true {
+		connected, err := r.watchEvents(audits, reconnect)
+		if connected {
+			retry = defaultSleepIntervalSec * time.Second
+		}
+		log.WithFields(log.Fields{"error": err, "retry": retry}).Warning("Docker events stream ended, reconnecting ")
+		time.Sleep(retry)
+		if retry < eventsRetryMaxSec*time.Second {
+			retry *= 2
+		}
+	}
+}
+
+// watchEvents requests an audit on audits for each event which may leave refcounts
+// out of sync, until the stream ends. Requests one on connect too if reconnect is set.
+// Returns whether the stream was opened.
+func (r *RefCountsMap) watchEvents(audits chan<- struct{}, reconnect bool) (bool, error) {
+	c, err := client.NewClient(DockerHostAddr, ApiVersion, nil, defaultHeaders)
+	if err != nil {
+		return false, err
+	}
+	args := filters.NewArgs()
+	args.Add("type", events.ContainerEventType)
+	args.Add("type", events.VolumeEventType)
+	args.Add("event", eventDie)
+	args.Add("event", eventDestroy)
+	args.Add("event", eventUnmount)
+	stream, err := c.Events(context.Background(), types.EventsOptions{Filters: args})
+	if err != nil {
+		return false, err
+	}
+	defer stream.Close()
+
+	log.Info("Watching Docker events for refcounts ")
+	if reconnect {
+		// Events may have been missed while disconnected
+		requestAudit(audits)
+	}
+
+	inspect := func(id string) ([]types.MountPoint, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
+		defer cancel()
+		info, err := c.ContainerInspect(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		return info.Mounts, nil
+	}
+	decoder := json.NewDecoder(stream)
+	for {
+		var msg events.Message
+		if err := decoder.Decode(&msg); err != nil {
+			return true, err
+		}
+		if r.affected(msg, inspect) {
+			log.WithFields(log.Fields{"type": msg.Type, "action": msg.Action, "id": msg.Actor.ID}).Debug(
+				"Scheduling refcount audit on Docker event ")
+			requestAudit(audits)
+		}
+	}
+}
+
+// requestAudit requests an audit on audits, unless one is requested already
+func requestAudit(audits chan<- struct{}) {
+	select {
+	case audits <- struct{}{}:
+	default:
+	}
+}
+
+// affected checks whether the event may leave refcounts out of sync. inspect returns
+// the mounts of a container.
+func (r *RefCountsMap) affected(msg events.Message, inspect func(id string) ([]types.MountPoint, error)) bool {
+	switch {
+	case msg.Type == events.VolumeEventType && msg.Action == eventUnmount:
+		return r.holdsVolume(msg.Actor.ID)
+	case msg.Type == events.ContainerEventType && (msg.Action == eventDie || msg.Action == eventDestroy):
+		mounts, err := inspect(msg.Actor.ID)
+		if err != nil {
+			// Destroyed already, the volumes it used are unknown
+			return r.holdsVolume("")
+		}
+		for _, mount := range mounts {
+			if isVMDKMount(mount.Source) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// holdsVolume checks whether volume name, with or without datastore, has a refcount.
+// Any volume if name is empty.
+func (r *RefCountsMap) holdsVolume(name string) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	for vol, rc := range r.refMap {
+		if rc.count > 0 && (name == "" || vol == name || strings.Split(vol, "@")[0] == name) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventAudits audits refcounts delay after each request on audits, and once more
+// after delay to confirm the discrepancies found
+func (r *RefCountsMap) eventAudits(d drivers.VolumeDriver, audits <-chan struct{}, delay time.Duration, repair bool) {
+	for range audits {
+		for confirm := false; ; confirm = true {
+			time.Sleep(delay)
+			// Requests meanwhile are served by this audit
+			select {
+			case <-audits:
+			default:
+			}
+			if err := r.audit(d, repair); err != nil {
+				log.WithFields(log.Fields{"error": err}).Warning("Refcount audit on Docker event skipped ")
+				break
+			}
+			if confirm || !r.hasAuditSuspects() {
+				break
+			}
+		}
+	}
+}
+
+// hasAuditSuspects checks whether the last audit found discrepancies
+func (r *RefCountsMap) hasAuditSuspects() bool {
+	r.discoverMtx.Lock()
+	defer r.discoverMtx.Unlock()
+	return len(r.auditSuspects) > 0
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAffected(t *testing.T) {
+	mountRoot = "/mnt/vmdk"
+	r := NewRefCountsMap()
+	r.Incr("vol@ds1")
+
+	containers := map[string][]types.MountPoint{
+		"vmdk":  {{Source: "/mnt/vmdk/vol@ds1/_data"}},
+		"local": {{Source: "/var/lib/docker/volumes/local/_data"}},
+	}
+	inspect := func(id string) ([]types.MountPoint, error) {
+		if mounts, exists := containers[id]; exists {
+			return mounts, nil
+		}
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+	event := func(eventType string, action string, id string) events.Message {
+		return events.Message{Type: eventType, Action: action, Actor: events.Actor{ID: id}}
+	}
+
+	assert.True(t, r.affected(event(events.VolumeEventType, eventUnmount, "vol"), inspect))
+	assert.True(t, r.affected(event(events.VolumeEventType, eventUnmount, "vol@ds1"), inspect))
+	assert.False(t, r.affected(event(events.VolumeEventType, eventUnmount, "vol@ds2"), inspect))
+	assert.False(t, r.affected(event(events.VolumeEventType, eventDestroy, "vol"), inspect))
+	assert.True(t, r.affected(event(events.ContainerEventType, eventDie, "vmdk"), inspect))
+	assert.False(t, r.affected(event(events.ContainerEventType, eventDie, "local"), inspect))
+	assert.True(t, r.affected(event(events.ContainerEventType, eventDestroy, "gone"), inspect))
+	assert.False(t, r.affected(event(events.ContainerEventType, "start", "vmdk"), inspect))
+
+	r.Decr("vol@ds1")
+	assert.False(t, r.affected(event(events.ContainerEventType, eventDestroy, "gone"), inspect))
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// Refcount journal.
+//
+// Refcounts and the volumes of mount IDs are saved to a journal file on each
+// mount and unmount. On plugin restart they are restored from the journal, so
+// mounts, unmounts and removes are served right away instead of waiting for
+// discovery from Docker. Refcounts of volumes which are not mounted anymore,
+// e.g. after a VM reboot, are dropped on restore. Discovery still runs, and
+// reconciles the journal with the containers Docker has running.
+//
+
+package refcount
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const journalExtension = ".json"
+
+// journalState is the content of the journal file
+type journalState struct {
+	Counts   map[string]uint   // refcount by volume name
+	MountIDs map[string]string // volume name by mount ID
+	Saved    time.Time
+}
+
+// journal persists refcounts in a file, replaced atomically on each save
+type journal struct {
+	path string
+}
+
+// newJournal returns the journal of driver name in dir
+func newJournal(dir string, name string) *journal {
+	return &journal{path: filepath.Join(dir, name+journalExtension)}
+}
+
+// load reads the journal, nil if there is none
+func (j *journal) load() (*journalState, error) {
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state journalState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// save writes the journal, replacing the previous one atomically. The journal is
+// flushed to disk before and after the rename, so a crash leaves the previous or the
+// new journal, never an empty one.
+func (j *journal) save(state *journalState) error {
+	state.Saved = time.Now()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err = writeSynced(tmp, data); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(j.path))
+}
+
+// writeSynced writes data to file path and flushes it to disk
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// saveJournal writes refcounts and mount IDs to the journal.
+// Caller holds r.mtx.
+func (r *RefCountsMap) saveJournal() {
+	if r.journal == nil {
+		return
+	}
+	state := &journalState{Counts: make(map[string]uint), MountIDs: r.mountIDs}
+	for vol, rc := range r.refMap {
+		if rc.count > 0 {
+			state.Counts[vol] = rc.count
+		}
+	}
+	if err := r.journal.save(state); err != nil {
+		log.WithFields(log.Fields{"file": r.journal.path, "error": err}).Warning("Failed to save refcount journal ")
+	}
+}
+
+// restoreJournal restores refcounts and mount IDs from the journal, keeping only volumes
+// still mounted. Returns false if there is no journal to restore from.
+func (r *RefCountsMap) restoreJournal(mounted map[string]bool) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.journal == nil {
+		return false
+	}
+	state, err := r.journal.load()
+	if err != nil {
+		log.WithFields(log.Fields{"file": r.journal.path, "error": err}).Warning("Ignoring unreadable refcount journal ")
+		return false
+	}
+	if state == nil {
+		return false
+	}
+	for vol, count := range state.Counts {
+		if !mounted[vol] {
+			log.WithFields(log.Fields{"name": vol, "refcount": count}).Info(
+				"Volume in refcount journal is not mounted anymore, dropping its refcount ")
+			continue
+		}
+		rc := newRefCount()
+		rc.count = count
+		rc.mounted = true
+		r.refMap[vol] = rc
+	}
+	for id, vol := range state.MountIDs {
+		if r.refMap[vol] != nil {
+			r.mountIDs[id] = vol
+		}
+	}
+	log.WithFields(log.Fields{"file": r.journal.path, "volumes": len(r.refMap),
+		"saved": state.Saved}).Info("Refcounts restored from journal ")
+	r.saveJournal()
+	return true
+}
+
+// reconcile replaces refcounts with those discovered from Docker, logging
+// those which differ from the refcounts restored from the journal
+func (r *RefCountsMap) reconcile(counts map[string]uint) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for vol, rc := range r.refMap {
+		if counts[vol] == 0 {
+			if r.restored && rc.count != 0 {
+				log.WithFields(log.Fields{"name": vol, "journal": rc.count}).Warning(
+					"Volume in refcount journal is not used by Docker, dropping its refcount ")
+			}
+			delete(r.refMap, vol)
+		}
+	}
+	for vol, count := range counts {
+		rc := r.refMap[vol]
+		if rc == nil {
+			rc = newRefCount()
+			r.refMap[vol] = rc
+		}
+		if r.restored && rc.count != count {
+			log.WithFields(log.Fields{"name": vol, "journal": rc.count, "docker": count}).Warning(
+				"Refcount in journal differs from Docker, using Docker's ")
+		}
+		rc.count = count
+	}
+	for id, vol := range r.mountIDs {
+		if r.refMap[vol] == nil {
+			delete(r.mountIDs, id)
+		}
+	}
+	r.saveJournal()
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "refcounts")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	r := NewRefCountsMap()
+	r.journal = newJournal(dir, "vsphere")
+	r.Incr("vol@ds1")
+	r.Incr("vol@ds1")
+	r.Incr("vol@ds2")
+	r.Incr("gone@ds1")
+	r.AddMountID("id1", "vol@ds1")
+	r.AddMountID("id2", "gone@ds1")
+	r.Decr("vol@ds2")
+
+	// Restarted, gone@ds1 was unmounted meanwhile
+	restored := NewRefCountsMap()
+	restored.journal = newJournal(dir, "vsphere")
+	assert.True(t, restored.restoreJournal(map[string]bool{"vol@ds1": true, "vol@ds2": true}))
+	assert.Equal(t, uint(2), restored.GetCount("vol@ds1"))
+	assert.Equal(t, uint(0), restored.GetCount("vol@ds2"))
+	assert.Equal(t, uint(0), restored.GetCount("gone@ds1"))
+	vol, exists := restored.RemoveMountID("id1")
+	assert.True(t, exists)
+	assert.Equal(t, "vol@ds1", vol)
+	_, exists = restored.RemoveMountID("id2")
+	assert.False(t, exists)
+
+	// Docker has the last word
+	restored.restored = true
+	restored.reconcile(map[string]uint{"vol@ds1": 1, "vol@ds2": 1})
+	assert.Equal(t, uint(1), restored.GetCount("vol@ds1"))
+	assert.Equal(t, uint(1), restored.GetCount("vol@ds2"))
+
+	state, err := restored.journal.load()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]uint{"vol@ds1": 1, "vol@ds2": 1}, state.Counts)
+
+	none := NewRefCountsMap()
+	none.journal = newJournal(dir, "photon")
+	assert.False(t, none.restoreJournal(nil))
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//
+// Orphan attachments.
+//
+// A volume may stay attached to the VM without being mounted, e.g. when the
+// plugin or the VM crashes between attach and mount, or after a failed detach.
+// Such a volume does not show under the mount root, so discovery can't find
+// it, yet other VMs can't attach it. Drivers implementing
+// drivers.AttachedLister tell which volumes are attached to the VM, and
+// recovery detaches those with no refcount which are not mounted. Volumes in
+// the allow-list, and those drivers.InProgressLister tells are being worked on,
+// e.g. created, are left attached. In dry-run mode orphans are only logged.
+//
+
+package refcount
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+)
+
+const (
+	// Orphan attachment modes
+	OrphanDryRun = "dry-run" // report orphan attachments only
+	OrphanDetach = "detach"  // report and detach orphan attachments
+)
+
+// orphanAttachments returns the volumes of attached which have no refcount, are not
+// mounted, are not in progress and do not match allowList, sorted by name. Volumes
+// in progress named without datastore are taken to be on any datastore.
+func orphanAttachments(attached []string, refcounts map[string]uint, mounted map[string]bool,
+	inProgress map[string]bool, allowList []string) []string {
+	var orphans []string
+	for _, vol := range attached {
+		if refcounts[vol] > 0 || mounted[vol] || orphanAllowed(vol, allowList) {
+			continue
+		}
+		if inProgress[vol] || inProgress[strings.Split(vol, "@")[0]] {
+			continue
+		}
+		orphans = append(orphans, vol)
+	}
+	sort.Strings(orphans)
+	return orphans
+}
+
+// orphanAllowed checks whether vol matches a name or pattern of allowList.
+// Names without datastore match the volume on any datastore.
+func orphanAllowed(vol string, allowList []string) bool {
+	shortName := strings.Split(vol, "@")[0]
+	for _, pattern := range allowList {
+		name := vol
+		if !strings.Contains(pattern, "@") {
+			name = shortName
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidOrphanMode returns mode if it is valid, OrphanDryRun otherwise
+func ValidOrphanMode(mode string) string {
+	if mode != OrphanDryRun && mode != OrphanDetach {
+		log.WithFields(log.Fields{"mode": mode, "valid": []string{OrphanDryRun, OrphanDetach}}).Error(
+			"Invalid OrphanDetachMode, only reporting orphan attachments ")
+		return OrphanDryRun
+	}
+	return mode
+}
+
+// SetOrphanPolicy sets what recovery does with volumes attached but not mounted,
+// and the volumes it leaves attached in any case. Called before Init.
+func (r *RefCountsMap) SetOrphanPolicy(mode string, allowList []string) {
+	r.orphanMode = ValidOrphanMode(mode)
+	r.orphanAllowList = allowList
+}
+
+// detachOrphans detaches volumes attached to the VM but neither used nor mounted,
+// or only logs them in dry-run mode. Caller holds r.StateMtx, refMap is synced with mounts.
+func (r *RefCountsMap) detachOrphans(d drivers.VolumeDriver) {
+	lister, ok := d.(drivers.AttachedLister)
+	if !ok {
+		return
+	}
+	attached, err := lister.ListAttached()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warning(
+			"Failed to list attached volumes, not checking for orphan attachments ")
+		return
+	}
+
+	r.mtx.RLock()
+	refcounts := make(map[string]uint)
+	mounted := make(map[string]bool)
+	for vol, rc := range r.refMap {
+		refcounts[vol] = rc.count
+		mounted[vol] = rc.mounted
+	}
+	r.mtx.RUnlock()
+
+	inProgress := make(map[string]bool)
+	if lister, ok := d.(drivers.InProgressLister); ok {
+		for _, vol := range lister.ListInProgress() {
+			inProgress[vol] = true
+		}
+	}
+
+	detach := r.orphanMode == OrphanDetach
+	for _, vol := range orphanAttachments(attached, refcounts, mounted, inProgress, r.orphanAllowList) {
+		f := log.Fields{"name": vol, "detach": detach}
+		log.WithFields(f).Warning("Volume is attached to the VM but not mounted ")
+		if !detach {
+			continue
+		}
+		if err := d.DetachVolume(vol); err != nil {
+			log.WithFields(log.Fields{"name": vol, "error": err}).Warning(
+				"Failed to detach orphan attachment - manual recovery may be needed ")
+			continue
+		}
+		log.WithFields(f).Info("Orphan attachment detached ")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrphanAttachments(t *testing.T) {
+	attached := []string{"used@ds1", "orphan@ds2", "mounted@ds1", "keep@ds1", "keep@ds2", "db-1@ds1", "orphan@ds1"}
+	refcounts := map[string]uint{"used@ds1": 2}
+	mounted := map[string]bool{"used@ds1": true, "mounted@ds1": true}
+
+	assert.Equal(t, []string{"db-1@ds1", "keep@ds1", "keep@ds2", "orphan@ds1", "orphan@ds2"},
+		orphanAttachments(attached, refcounts, mounted, nil, nil))
+	assert.Equal(t, []string{"keep@ds1", "orphan@ds1", "orphan@ds2"},
+		orphanAttachments(attached, refcounts, mounted, nil, []string{"keep@ds2", "db-*"}))
+	assert.Equal(t, []string{"orphan@ds1", "orphan@ds2"},
+		orphanAttachments(attached, refcounts, mounted, nil, []string{"keep", "db-*"}))
+	assert.Empty(t, orphanAttachments(attached, refcounts, mounted, nil, []string{"*"}))
+
+	// Volumes being created are attached for mkfs
+	inProgress := map[string]bool{"db-1@ds1": true, "orphan": true}
+	assert.Equal(t, []string{"keep@ds1", "keep@ds2"},
+		orphanAttachments(attached, refcounts, mounted, inProgress, nil))
+}
+
+func TestValidOrphanMode(t *testing.T) {
+	assert.Equal(t, OrphanDetach, ValidOrphanMode(OrphanDetach))
+	assert.Equal(t, OrphanDryRun, ValidOrphanMode("detach-all"))
+}
@@ -42,6 +42,14 @@
 // running and thus answering client.Info() request.
 //
 // After refcount discovery, results are compared to fs.GetMountInfo() content.
+// Block-mode volumes have no filesystem and never show in mount info, they are
+// exposed as a device node in their mountpoint instead, and found with
+// fs.GetBlockDevices(). Both are "mounted" for refcounting.
+// Encrypted volumes show with their device-mapper device, which the driver
+// closes on unmount or detach and opens again on a recovery mount.
+// Refcounts are kept by the name of the mount point, which is the full
+// volume@datastore name for vmdk volumes, so volumes with the same name on
+// different datastores are counted apart.
 //
 // We rely on all plugin mounts being in /mnt/vmdk/<volume_name> for Linux and
 // C:\Users\Administrator\AppData\Local\docker-volume-vsphere\mounts\<volume_name>
@@ -61,7 +69,12 @@
 // We assume that mounted (in Docker VM) and attached (to Docker VM) is the
 // same. If something is attached to VM but not mounted (so from refcnt and
 // mountspoint of view the volume is not used, but the VMDK is still attached
-// to the VM) - we leave it to manual recovery.
+// to the VM) - we detach it if the driver can list attached volumes, see
+// orphans.go, and leave it to manual recovery otherwise.
+//
+// Refcounts are also kept in a journal on disk, see journal.go. When the
+// journal is restored on plugin start, refcounting is initialized right away
+// and discovery only reconciles the journal with Docker.
 //
 // The RefCountsMap is safe to be used by multiple goroutines and has a single
 // RWMutex to serialize operations on the map and refCounts.
@@ -73,6 +86,7 @@ package refcount
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -82,6 +96,7 @@ import (
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/filters"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/drivers"
+	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/config"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/fs"
 	"github.com/vmware/docker-volume-vsphere/client_plugin/utils/plugin_utils"
 	"golang.org/x/net/context"
@@ -103,7 +118,8 @@ type refCount struct {
 	count uint
 
 	// Is the volume mounted from OS point of view
-	// (i.e. entry in /proc/mounts exists)
+	// (i.e. entry in /proc/mounts exists, or the device node of
+	// a block-mode volume exists in its mountpoint)
 	mounted bool
 
 	// Volume is mounted from this device. Used on recovery only , for info
@@ -113,12 +129,20 @@ type refCount struct {
 
 // RefCountsMap struct
 type RefCountsMap struct {
-	refMap map[string]*refCount // Map of refCounts
-	mtx    *sync.RWMutex        // Synchronizes RefCountsMap ops
+	refMap   map[string]*refCount // Map of refCounts
+	mountIDs map[string]string    // Map of mount ID -> volume name
+	mtx      *sync.RWMutex        // Synchronizes RefCountsMap ops
+	journal  *journal             // Persists refCounts and mountIDs, nil if not persisted
 
 	refcntInitSuccess bool        // save refcounting success
+	restored          bool        // refcounts were restored from the journal
 	isDirty           bool        // flag to check reconciling has been interrupted
 	StateMtx          *sync.Mutex // (Exported) Synchronizes refcounting between mount/unmount and refcounting thread
+	discoverMtx       *sync.Mutex // Serializes discovery and audits
+
+	auditSuspects   map[string]bool // discrepancies found by the last audit, by kind/name
+	orphanMode      string          // what recovery does with volumes attached but not mounted
+	orphanAllowList []string        // volumes recovery leaves attached, by name or pattern
 }
 
 var (
@@ -141,12 +165,16 @@ func init() {
 // NewRefCountsMap - creates a new RefCountsMap
 func NewRefCountsMap() *RefCountsMap {
 	return &RefCountsMap{
-		refMap: make(map[string]*refCount),
-		mtx:    &sync.RWMutex{},
+		refMap:   make(map[string]*refCount),
+		mountIDs: make(map[string]string),
+		mtx:      &sync.RWMutex{},
 
 		StateMtx:          &sync.Mutex{},
+		discoverMtx:       &sync.Mutex{},
 		isDirty:           false,
 		refcntInitSuccess: false,
+
+		orphanMode: OrphanDryRun,
 	}
 }
 
@@ -169,9 +197,19 @@ func (r *RefCountsMap) MarkDirty() {
 	r.isDirty = true
 }
 
-// tries to calculate refCounts for dvs volumes. If failed, triggers a timer
-// based reattempt to schedule scan after a delay
+// restores refCounts from the journal and tries to calculate refCounts for dvs volumes.
+// If failed, triggers a timer based reattempt to schedule scan after a delay
 func (r *RefCountsMap) Init(d drivers.VolumeDriver, mountDir string, name string) {
+	mountRoot = mountDir
+	driverName = name
+	r.journal = newJournal(config.RefCountsDir, name)
+	if mounted, err := mountedVolumes(); err != nil {
+		log.Warningf("Failed to get mounted volumes, not restoring refcount journal (%v)", err)
+	} else if r.restoreJournal(mounted) {
+		r.restored = true
+		r.refcntInitSuccess = true
+	}
+
 	err := r.calculate(d, mountDir, name)
 	// If refcounting wasn't successful, schedule one again
 	if err != nil {
@@ -204,6 +242,11 @@ func (r *RefCountsMap) retryCalculate(d drivers.VolumeDriver, mountDir string, n
 		}
 	}
 	// couldn't complete refcounting even after retries.
+	// With refcounts restored from the journal, keep going with them.
+	if r.restored {
+		log.Errorf("Failed to reconcile refcount journal with Docker, using the journal only")
+		return
+	}
 	// docker logs artifical panic and restarts the plugin.
 	panic(fmt.Sprintf("Failed to talk to docker to calculate volumes usage. Please restart docker"))
 }
@@ -278,6 +321,7 @@ func (r *RefCountsMap) Incr(vol string) uint {
 		r.refMap[vol] = rc
 	}
 	rc.count++
+	r.saveJournal()
 	return rc.count
 }
 
@@ -299,7 +343,7 @@ func (r *RefCountsMap) Decr(vol string) (uint, error) {
 		// it should be caught in previous check. So delete the entry (in case
 		// someone upstairs does 'recover', and panic.
 		delete(r.refMap, vol)
-		log.Warning("Decr: refcnt already 0 (rc.count=0), name=%s", vol)
+		log.Warningf("Decr: refcnt already 0 (rc.count=0), name=%s", vol)
 		return 0, nil
 	}
 
@@ -312,9 +356,32 @@ func (r *RefCountsMap) Decr(vol string) (uint, error) {
 	if rc.count <= 0 {
 		delete(r.refMap, vol)
 	}
+	r.saveJournal()
 	return rc.count, nil
 }
 
+// AddMountID records the volume mounted with mount ID id
+func (r *RefCountsMap) AddMountID(id string, vol string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.mountIDs[id] = vol
+	r.saveJournal()
+}
+
+// RemoveMountID forgets mount ID id and returns the volume it mounted, if known
+func (r *RefCountsMap) RemoveMountID(id string) (string, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	vol, exists := r.mountIDs[id]
+	if exists {
+		delete(r.mountIDs, id)
+		r.saveJournal()
+	}
+	return vol, exists
+}
+
 // check if volume with source as mount_source belongs to vmdk plugin
 func isVMDKMount(mount_source string) bool {
 	managedPluginMountStart := "/var/lib/docker/plugins/"
@@ -334,6 +401,18 @@ func isVMDKMount(mount_source string) bool {
 	return false
 }
 
+// mountVolumeName returns the name refcounts of the volume mounted at mount_source are kept by:
+// its entry under the mount root, as in mount info. The vmdk driver names mount points after
+// the full volume name, so each mount is counted for the volume on its own datastore, even
+// if volumes with the same short name are in use from several datastores.
+func mountVolumeName(mount_source string) string {
+	source, root := filepath.ToSlash(mount_source), filepath.ToSlash(mountRoot)
+	if i := strings.Index(source, root); i >= 0 {
+		source = source[i+len(root):]
+	}
+	return strings.Split(strings.Trim(source, "/"), "/")[0]
+}
+
 // check if refcounting has been made dirty by mounts/unmounts
 func (r *RefCountsMap) checkDirty() bool {
 	r.StateMtx.Lock()
@@ -343,12 +422,45 @@ func (r *RefCountsMap) checkDirty() bool {
 
 // enumerates volumes and  builds RefCountsMap, then sync with mount info
 func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver) error {
-	// we assume to  have empty refcounts. Let's enforce
+	r.discoverMtx.Lock()
+	defer r.discoverMtx.Unlock()
 
+	// refcounts discovered from Docker replace the current ones, restored from
+	// the journal or empty, unless mounts or unmounts run meanwhile
 	r.StateMtx.Lock()
 	r.isDirty = false
 	r.StateMtx.Unlock()
 
+	counts, err := r.dockerRefCounts(c)
+	if err != nil {
+		return err
+	}
+
+	// lock and check if the background refcount was dirtied.
+	// get mounts, remove unncessary mounts and set refcntInitSuccess
+	// under same lock to avoid races with parallel mount/unmount
+	r.StateMtx.Lock()
+	defer r.StateMtx.Unlock()
+	if r.isDirty == true {
+		// refcounting was dirtied by parallel mount/unmount.
+		return fmt.Errorf("refcounting wasn't clean.")
+	}
+
+	// Check that refcounts and actual mount info from Linux match
+	// If they don't, unmount unneeded stuff, or yell if something is
+	// not mounted but should be (it's error. we should not get there)
+	r.reconcile(counts)
+	r.updateRefMap()
+	r.syncMountsWithRefCounters(d)
+	r.detachOrphans(d)
+	// mark reconciling success so that further unmounts can instantly be processed
+	r.refcntInitSuccess = true
+	return nil
+}
+
+// dockerRefCounts enumerates containers using volumes of the plugin and
+// returns the refcounts of volumes as Docker sees them
+func (r *RefCountsMap) dockerRefCounts(c *client.Client) (map[string]uint, error) {
 	filters := filters.NewArgs()
 	filters.Add("status", "running")
 	filters.Add("status", "paused")
@@ -362,17 +474,16 @@ func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 	})
 	if err != nil {
 		log.Errorf("ContainerList failed (err: %v)", err)
-		return err
+		return nil, err
 	}
 
-	// use same datastore for all volumes with short names
-	datastoreName := ""
+	counts := make(map[string]uint)
 
 	log.Infof("Found %d running or paused containers", len(containers))
 	for _, ct := range containers {
 
 		if r.checkDirty() {
-			return fmt.Errorf("refcounting wasn't clean.")
+			return nil, fmt.Errorf("refcounting wasn't clean.")
 		}
 
 		ctx_inspect, cancel_inspect := context.WithTimeout(context.Background(), dockerConnTimeoutSec*time.Second)
@@ -382,7 +493,7 @@ func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 			log.Errorf("ContainerInspect failed for %s (err: %v)", ct.Names, err)
 			// We intentionally don't cleanup refMap because whatever refCounts(if any) we were able to
 			// populate are valid.
-			return err
+			return nil, err
 		}
 		log.Debugf("  Mounts for %v", ct.Names)
 		for _, mount := range containerJSONInfo.Mounts {
@@ -391,36 +502,13 @@ func (r *RefCountsMap) discoverAndSync(c *client.Client, d drivers.VolumeDriver)
 				continue
 			}
 
-			volumeInfo, err := plugin_utils.GetVolumeInfo(mount.Name, datastoreName, d)
-			if err != nil {
-				log.Errorf("Unable to get volume info for volume %s. err:%v", mount.Name, err)
-				return err
-			}
-			datastoreName = volumeInfo.DatastoreName
-			r.Incr(volumeInfo.VolumeName)
-			log.Debugf("name=%v (driver=%s source=%s) (%v)",
-				mount.Name, mount.Driver, mount.Source, mount)
+			volName := mountVolumeName(mount.Source)
+			counts[volName]++
+			log.Debugf("name=%v refname=%s (driver=%s source=%s) (%v)",
+				mount.Name, volName, mount.Driver, mount.Source, mount)
 		}
 	}
-
-	// lock and check if the background refcount was dirtied.
-	// get mounts, remove unncessary mounts and set refcntInitSuccess
-	// under same lock to avoid races with parallel mount/unmount
-	r.StateMtx.Lock()
-	defer r.StateMtx.Unlock()
-	if r.isDirty == true {
-		// refcounting was dirtied by parallel mount/unmount.
-		return fmt.Errorf("refcounting wasn't clean.")
-	}
-
-	// Check that refcounts and actual mount info from Linux match
-	// If they don't, unmount unneeded stuff, or yell if something is
-	// not mounted but should be (it's error. we should not get there)
-	r.updateRefMap()
-	r.syncMountsWithRefCounters(d)
-	// mark reconciling success so that further unmounts can instantly be processed
-	r.refcntInitSuccess = true
-	return nil
+	return counts, nil
 }
 
 // syncronize mount info with refcounts - and unmounts if needed
@@ -454,7 +542,7 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				// removed.
 				err := d.DetachVolume(vol)
 				if err != nil {
-					log.Warning("Failed to detach volume %s - volume may be attached and manual recovery may be needed ", vol)
+					log.Warningf("Failed to detach volume %s - volume may be attached and manual recovery may be needed ", vol)
 				}
 				fs.Rmdir(strings.Join([]string{mountRoot, vol}, "/"))
 				delete(r.refMap, vol)
@@ -464,35 +552,62 @@ func (r *RefCountsMap) syncMountsWithRefCounters(d drivers.VolumeDriver) {
 				// but not using files on the volumes, and the volume is (manually?)
 				// unmounted. Unlikely but possible. Mount !
 				log.WithFields(f).Warning("Initiating recovery mount. ")
-				status, err := d.GetVolume(vol)
-				if err != nil {
+				if err := recoveryMount(d, vol); err != nil {
 					log.Warning("Failed to mount - manual recovery may be needed")
-				} else {
-					//Ensure the refcount map has this disk ID
-					id := ""
-					exists := false
-					if driverName == photonDriver {
-						if id, exists = status["ID"].(string); !exists {
-							log.Warning("Failed to disk ID for photon disk cannot mount in use disk")
-						}
-					}
-
-					isReadOnly := false
-					if access, exists := status["access"]; exists {
-						if access == "read-only" {
-							isReadOnly = true
-						}
-					}
-					_, err = d.MountVolume(vol, status["fstype"].(string), id, isReadOnly, false)
-					if err != nil {
-						log.Warning("Failed to mount - manual recovery may be needed")
-					}
 				}
 			}
 		}
 	}
 }
 
+// recoveryMount mounts volume vol which is used by containers but not mounted
+func recoveryMount(d drivers.VolumeDriver, vol string) error {
+	status, err := d.GetVolume(vol)
+	if err != nil {
+		return err
+	}
+	//Ensure the refcount map has this disk ID
+	id := ""
+	exists := false
+	if driverName == photonDriver {
+		if id, exists = status["ID"].(string); !exists {
+			log.Warning("Failed to disk ID for photon disk cannot mount in use disk")
+		}
+	}
+
+	isReadOnly := false
+	if access, exists := status["access"]; exists {
+		if access == "read-only" {
+			isReadOnly = true
+		}
+	}
+	// The volume metadata has mount-opts, and tells whether the
+	// encrypted device must be opened again before the mount
+	fstype, _ := plugin_utils.MountFstype(status)
+	_, err = d.MountVolume(vol, fstype, id, isReadOnly, false, status)
+	return err
+}
+
+// mountedVolumes returns the volumes mounted, or exposed as block devices, under mountRoot
+func mountedVolumes() (map[string]bool, error) {
+	volumeMap, err := fs.GetMountInfo(mountRoot)
+	if err != nil {
+		return nil, err
+	}
+	blockDevMap, err := fs.GetBlockDevices(mountRoot)
+	if err != nil {
+		return nil, err
+	}
+	mounted := make(map[string]bool)
+	for volName := range volumeMap {
+		mounted[volName] = true
+	}
+	for volName := range blockDevMap {
+		mounted[volName] = true
+	}
+	return mounted, nil
+}
+
 // updates refcount map with mounted volumes using mount info
 func (r *RefCountsMap) updateRefMap() error {
 	r.mtx.Lock()
@@ -504,6 +619,14 @@ func (r *RefCountsMap) updateRefMap() error {
 		return err
 	}
 
+	blockDevMap, err := fs.GetBlockDevices(mountRoot)
+	if err != nil {
+		return err
+	}
+	for volName, dev := range blockDevMap {
+		volumeMap[volName] = dev
+	}
+
 	for volName, dev := range volumeMap {
 		refInfo := r.refMap[volName]
 		if refInfo == nil {
@@ -16,5 +16,30 @@
 
 package refcount
 
+import (
+	"os"
+	"strings"
+)
+
 // DockerHostAddr is the docker engine sock path on Linux.
 const DockerHostAddr = "unix:///var/run/docker.sock"
+
+// deviceMissing tells whether the device a volume is mounted from is gone,
+// e.g. when the disk was detached from the VM behind the plugin's back
+func deviceMissing(dev string) bool {
+	if !strings.HasPrefix(dev, "/dev/") {
+		return false
+	}
+	_, err := os.Stat(dev)
+	return os.IsNotExist(err)
+}
+
+// syncDir flushes the entries of dir, e.g. a file renamed into it, to disk
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
@@ -0,0 +1,43 @@
+// Copyright 2017 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package refcount
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountVolumeName(t *testing.T) {
+	mountRoot = "/mnt/vmdk"
+	tests := []struct {
+		source string
+		name   string
+	}{
+		// volumes with the same short name from two datastores are counted apart
+		{"/mnt/vmdk/vol@ds1", "vol@ds1"},
+		{"/mnt/vmdk/vol@ds2", "vol@ds2"},
+		{"/mnt/vmdk/vol@ds1/_data", "vol@ds1"},
+		// short name, as mounted by older plugins
+		{"/mnt/vmdk/vol", "vol"},
+		{"/mnt/vmdk/vol/", "vol"},
+		// managed plugin
+		{"/var/lib/docker/plugins/0c5a8b2e/rootfs/mnt/vmdk/vol@ds1", "vol@ds1"},
+		{"/var/lib/docker/plugins/0c5a8b2e/rootfs/mnt/vmdk/vol@ds2/_data", "vol@ds2"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.name, mountVolumeName(test.source), test.source)
+	}
+}
@@ -18,3 +18,15 @@ package refcount
 
 // DockerHostAddr is the docker engine npipe address on Windows.
 const DockerHostAddr = "npipe:////./pipe/docker_engine"
+
+// deviceMissing tells whether the device a volume is mounted from is gone,
+// not detected on Windows
+func deviceMissing(dev string) bool {
+	return false
+}
+
+// syncDir flushes the entries of dir to disk, done by the filesystem on Windows
+// where directories can't be flushed
+func syncDir(dir string) error {
+	return nil
+}
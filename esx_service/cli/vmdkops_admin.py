@@ -178,7 +178,7 @@ def commands():
                             'required': True
                         },
                         '--options': {
-                            'help': 'Options (specifically, access) to be set on the volume.',
+                            'help': 'Options (access, attach-as, iops-limit or bps-limit) to be set on the volume.',
                             'required': True
                         }
                     }
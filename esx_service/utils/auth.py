@@ -34,6 +34,10 @@ CMD_REMOVE = 'remove'
 CMD_ATTACH = 'attach'
 CMD_DETACH = 'detach'
 CMD_GET    = 'get'
+CMD_RESIZE = 'resize'
+CMD_SNAPSHOT = 'snapshot'
+CMD_REMOVE_SNAPSHOT = 'removeSnapshot'
+CMD_REVERT_SNAPSHOT = 'revertSnapshot'
 
 SIZE = 'size'
 
@@ -324,7 +328,28 @@ def check_privileges_for_command(cmd, opts, tenant_uuid, datastore_url, privileg
             result = error_code_to_message[ErrorCode.PRIVILEGE_USAGE_QUOTA_EXCEED]
             return result
 
-    if cmd == CMD_REMOVE:
+    if cmd == CMD_RESIZE:
+        # Growing a volume is like creating one with the new size, except the usage quota
+        # is checked by resizeVMDK with the size added, as the volume already counts there
+        # with its old size.
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+            return result
+        vol_size_in_MB = convert.convert_to_MB(get_vol_size(opts))
+        if vol_size_in_MB == 0:
+            result = error_code_to_message[ErrorCode.OPT_VOLUME_SIZE_INVALID]
+            return result
+        if not check_max_volume_size(vol_size_in_MB, privileges):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_MAX_VOL_EXCEED]
+            return result
+
+    # Snapshot size is checked as for create, once the size of the volume is known
+    if cmd in [CMD_SNAPSHOT, CMD_REVERT_SNAPSHOT]:
+        if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
+            result = error_code_to_message[ErrorCode.PRIVILEGE_NO_CREATE_PRIVILEGE]
+            return result
+
+    if cmd in [CMD_REMOVE, CMD_REMOVE_SNAPSHOT]:
         if not has_privilege(privileges, auth_data_const.COL_ALLOW_CREATE):
             result = error_code_to_message[ErrorCode.PRIVILEGE_NO_DELETE_PRIVILEGE]
             return result
@@ -482,6 +507,35 @@ def add_volume_to_volumes_table(tenant_uuid, datastore_url, vol_name, vol_size_i
 
     return None
 
+def update_volume_size_in_volumes_table(tenant_uuid, datastore_url, vol_name, vol_size_in_MB):
+    """
+        Update size of the volume in volumes table.
+        Return None on success or error string.
+    """
+    err_msg, _auth_mgr = get_auth_mgr()
+    if err_msg:
+        return err_msg
+
+    logging.debug("update volume size in volumes table(%s %s %s %s)", tenant_uuid, datastore_url,
+                  vol_name, vol_size_in_MB)
+
+    if _auth_mgr.allow_all_access():
+        logging.debug("Skipping Update volume in DB %s (allow_all_access)", tenant_uuid)
+        return None
+
+    try:
+        _auth_mgr.conn.execute(
+            "UPDATE volumes SET volume_size = ? WHERE tenant_id = ? AND datastore_url = ? AND volume_name = ?",
+            (vol_size_in_MB, tenant_uuid, datastore_url, vol_name)
+            )
+        _auth_mgr.conn.commit()
+    except sqlite3.Error as e:
+        logging.error("Error %s when update volumes table for tenant_id %s and datastore_url %s",
+                      e, tenant_uuid, datastore_url)
+        return str(e)
+
+    return None
+
 def remove_volume_from_volumes_table(tenant_uuid, datastore_url, vol_name):
     """
         Remove volume from volumes table.
@@ -47,6 +47,14 @@ class LockManager(object):
             #               self._list_locks())
             return lock
 
+    def get_locks(self, locknames):
+        """
+        Return a context manager holding the locks identified by locknames.
+        The locks are taken in name order, so threads taking the same locks
+        do not deadlock.
+        """
+        return LockSet([self.get_lock(lockname) for lockname in sorted(set(locknames))])
+
     def _list_locks(self):
         return self._lock_store.keys()
 
@@ -58,6 +66,25 @@ class LockManager(object):
             return self._list_locks()
 
 
+class LockSet(object):
+    """
+    Context manager acquiring locks in the given order, and releasing them
+    in the reverse order
+    """
+    def __init__(self, locks):
+        self._locks = locks
+
+    def __enter__(self):
+        for lock in self._locks:
+            lock.acquire()
+        return self
+
+    def __exit__(self, *args):
+        for lock in reversed(self._locks):
+            lock.release()
+        return False
+
+
 def get_lock_decorator(reentrant=False):
     """
     Create a locking decorator to be used in modules
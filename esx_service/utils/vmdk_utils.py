@@ -128,6 +128,17 @@ def get_datastores():
     return datastores
 
 
+def get_datastores_space():
+    """
+    Returns a dict of (capacity, free space) in bytes by datastore name,
+    for the datastores accessible from local ESX host
+    """
+    si = vmdk_ops.get_si()
+    ds_objects = si.content.rootFolder.childEntity[0].datastoreFolder.childEntity
+    return {datastore.info.name: (datastore.summary.capacity, datastore.summary.freeSpace)
+            for datastore in ds_objects if datastore.summary.accessible}
+
+
 def get_volumes(tenant_re):
     """ Return dicts of docker volumes, their datastore and their paths
     """
@@ -377,18 +388,25 @@ def get_attached_volume_path(vm, volname, datastore):
     logging.warning("Found path: %s", path)
     return path
 
-def find_dvs_volume(dev):
+def find_dvs_volume(dev, base=False):
     """
     If the @param dev (type is vim.vm.device) a vDVS managed volume, return its vmdk path
+    With @param base, the disk of a VM on the delta disk of a VM snapshot is the base
+    disk of the delta disk chain, the volume the snapshot was taken of.
     """
     # if device is not a virtual disk, skip this device
     if type(dev) != vim.vm.device.VirtualDisk:
         return False
 
+    backing = dev.backing
+    if base:
+        while getattr(backing, 'parent', None):
+            backing = backing.parent
+
     # Filename format is as follows:
     # "[<datastore name>] <parent-directory>/tenant/<vmdk-descriptor-name>"
     # Trim the datastore name and keep disk path.
-    datastore_name, disk_path = dev.backing.fileName.rsplit("]", 1)
+    datastore_name, disk_path = backing.fileName.rsplit("]", 1)
     logging.info("backing disk name is %s", disk_path)
     # name formatting to remove unwanted characters
     datastore_name = datastore_name[1:]
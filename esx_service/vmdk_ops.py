@@ -28,6 +28,8 @@ Commands ("cmd" in request):
 		"get"    - get info about an individual volume (vmdk)
 		"attach" - attach a VMDK to the requesting VM
 		"detach" - detach a VMDK from the requesting VM (assuming it's unmounted)
+		"listDatastores" - enumerate datastores the requesting VM can create VMDKs on
+		"listAttached" - enumerate VMDKs attached to the requesting VM
 
 '''
 
@@ -110,6 +112,12 @@ VMDK_ADAPTER_TYPE = 'busLogic'  # default adapter type
 # Server side understand protocol version. If you are changing client/server protocol we use
 # over VMCI, PLEASE DO NOT FORGET TO CHANGE IT FOR CLIENT in file <esx_vmdkcmd.go> !
 SERVER_PROTOCOL_VERSION = 2
+# All protocol versions the server can talk, negotiated with the client by "handshake" command
+SUPPORTED_PROTOCOL_VERSIONS = [SERVER_PROTOCOL_VERSION]
+# Features reported to the client by "handshake" command, so it can refuse options we don't support
+SERVER_CAPABILITIES = ["clone", "vsan-policy", "access-modes", "resize", "snapshot", "fs-options", "block-mode",
+                       "encryption", "io-limits", "labels", "list-datastores",
+                       "list-attached"]
 
 # Error codes
 VMCI_ERROR = -1 # VMCI C code uses '-1' to indicate failures
@@ -118,6 +126,8 @@ ECONNABORTED = 103 # Error on non privileged client
 # Volume data returned on Get request
 CAPACITY = 'capacity'
 SIZE = 'size'
+SNAPSHOT = 'snapshot'   # snapshot name in options of snapshot commands
+REVERT_SUFFIX = '-reverting'    # temporary copy of the snapshot being reverted to
 ALLOCATED = 'allocated'
 LOCATION = 'datastore'
 CREATED_BY_VM = 'created by VM'
@@ -171,15 +181,31 @@ def createVMDK(vmdk_path, vm_name, vol_name,
                  vmdk_path, opts, vm_name, vm_uuid, tenant_uuid, datastore_url)
 
     if os.path.isfile(vmdk_path):
-        # We are mostly here due to race or Plugin VMCI retry #1076
+        # We are mostly here due to race or Plugin VMCI retry #1076, the volume-plugin
+        # adopts the volume if it has the requested options
         logging.warning("File %s already exists", vmdk_path)
-        return None
+        return err("Volume {0} already exists".format(vol_name), ERR_ALREADY_EXISTS)
 
     try:
         validate_opts(opts, vmdk_path)
     except ValidationError as e:
         return err(e.msg)
 
+    if kv.FROM_SNAPSHOT in opts:
+        # A volume created from a snapshot is a writable clone of the snapshot
+        if kv.CLONE_FROM in opts:
+            return err("Options {0} and {1} cannot be used together".format(kv.CLONE_FROM, kv.FROM_SNAPSHOT))
+        if kv.ACCESS not in opts:
+            opts[kv.ACCESS] = kv.DEFAULT_ACCESS
+        return cloneVMDK(vm_name=vm_name,
+                         vmdk_path=vmdk_path,
+                         opts=opts,
+                         vm_uuid=vm_uuid,
+                         datastore_url=datastore_url,
+                         vm_datastore_url=vm_datastore_url,
+                         vm_datastore=vm_datastore,
+                         from_snapshot=True)
+
     if kv.CLONE_FROM in opts:
         return cloneVMDK(vm_name=vm_name,
                          vmdk_path=vmdk_path,
@@ -251,9 +277,14 @@ def createVMDK(vmdk_path, vm_name, vol_name,
         logging.debug(error_code_to_message[ErrorCode.VM_NOT_BELONG_TO_TENANT].format(vm_name))
 
 
-def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_datastore_url=None, vm_datastore=None):
+def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_datastore_url=None, vm_datastore=None,
+              from_snapshot=False):
+    """
+    Clones volume opts[kv.CLONE_FROM], or with from_snapshot the snapshot opts[kv.FROM_SNAPSHOT]
+    """
     logging.info("*** cloneVMDK: %s opts = %s vm_uuid=%s datastore_url=%s vm_datastore_url=%s vm_datastore=%s",
                  vmdk_path, opts, vm_uuid, datastore_url, vm_datastore_url, vm_datastore)
+    src_option = kv.FROM_SNAPSHOT if from_snapshot else kv.CLONE_FROM
 
     # Get source volume path for cloning
     error_info, tenant_uuid, tenant_name = auth.get_tenant(vm_uuid)
@@ -261,7 +292,7 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
         return err(error_info)
 
     try:
-        src_volume, src_datastore = parse_vol_name(opts[kv.CLONE_FROM])
+        src_volume, src_datastore = parse_vol_name(opts[src_option])
     except ValidationError as ex:
         return err(str(ex))
     if not src_datastore:
@@ -271,7 +302,8 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
         return err("Invalid datastore '%s'.\n" \
                     "Known datastores: %s.\n" \
                     "Default datastore_url: %s" \
-                    % (src_datastore, ", ".join(get_datastore_names_list()), datastore_url))
+                    % (src_datastore, ", ".join(get_datastore_names_list()), datastore_url),
+                   ERR_DATASTORE_UNAVAILABLE)
     else:
         src_datastore_url = vmdk_utils.get_datastore_url(src_datastore)
 
@@ -295,7 +327,9 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
     src_vmdk_path = vmdk_utils.get_vmdk_path(src_path, src_volume)
     logging.debug("cloneVMDK: src path=%s vol=%s vmdk_path=%s", src_path, src_volume, src_vmdk_path)
     if not os.path.isfile(src_vmdk_path):
-        return err("Could not find volume for cloning %s" % opts[kv.CLONE_FROM])
+        return err("Could not find volume for cloning %s" % opts[src_option], ERR_NOT_FOUND)
+    if from_snapshot and not get_snapshot_of(src_vmdk_path):
+        return err("Volume {0} is not a snapshot".format(opts[src_option]))
 
     # Form datastore path from vmdk_path
     dest_vol = vmdk_utils.get_datastore_path(vmdk_path)
@@ -321,7 +355,7 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
                                      vm_datastore_url=vm_datastore_url,
                                      vm_datastore=vm_datastore)
         if error_info:
-            return err(error_info)
+            return err(error_info, auth_error_code(error_info))
 
         # Handle the allocation format
         if not kv.DISK_ALLOCATION_FORMAT in opts:
@@ -362,12 +396,23 @@ def cloneVMDK(vm_name, vmdk_path, opts={}, vm_uuid=None, datastore_url=None, vm_
     vol_meta = kv.getAll(vmdk_path)
     vol_meta[kv.CREATED_BY] = vm_name
     vol_meta[kv.CREATED] = time.asctime(time.gmtime())
-    vol_meta[kv.VOL_OPTS][kv.CLONE_FROM] = src_volume
+    # A clone of a snapshot is not a snapshot, nor read-only unless asked for
+    if vol_meta[kv.VOL_OPTS].pop(kv.SNAPSHOT_OF, None) and kv.ACCESS not in opts:
+        vol_meta[kv.VOL_OPTS][kv.ACCESS] = kv.DEFAULT_ACCESS
+    if from_snapshot:
+        vol_meta[kv.VOL_OPTS][kv.FROM_SNAPSHOT] = src_volume
+    else:
+        vol_meta[kv.VOL_OPTS][kv.CLONE_FROM] = src_volume
     vol_meta[kv.VOL_OPTS][kv.DISK_ALLOCATION_FORMAT] = opts[kv.DISK_ALLOCATION_FORMAT]
     if kv.ACCESS in opts:
         vol_meta[kv.VOL_OPTS][kv.ACCESS] = opts[kv.ACCESS]
     if kv.ATTACH_AS in opts:
         vol_meta[kv.VOL_OPTS][kv.ATTACH_AS] = opts[kv.ATTACH_AS]
+    if kv.MOUNT_OPTS in opts:
+        vol_meta[kv.VOL_OPTS][kv.MOUNT_OPTS] = opts[kv.MOUNT_OPTS]
+    for opt in [kv.IOPS_LIMIT, kv.BPS_LIMIT, kv.LABELS]:
+        if opt in opts:
+            vol_meta[kv.VOL_OPTS][opt] = opts[opt]
 
     if not kv.setAll(vmdk_path, vol_meta):
         msg = "Failed to create metadata kv store for {0}".format(vmdk_path)
@@ -392,10 +437,15 @@ def validate_opts(opts, vmdk_path):
      * diskformat - The allocation format of allocated disk
     """
     valid_opts = [kv.SIZE, kv.VSAN_POLICY_NAME, kv.DISK_ALLOCATION_FORMAT,
-                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM]
+                  kv.ATTACH_AS, kv.ACCESS, kv.FILESYSTEM_TYPE, kv.CLONE_FROM, kv.FROM_SNAPSHOT,
+                  kv.MKFS_OPTS, kv.MOUNT_OPTS, kv.VOLUME_MODE, kv.ENCRYPTION,
+                  kv.ENCRYPTION_KEY, kv.IOPS_LIMIT, kv.BPS_LIMIT, kv.LABELS]
     defaults = [kv.DEFAULT_DISK_SIZE, kv.DEFAULT_VSAN_POLICY,\
                 kv.DEFAULT_ALLOCATION_FORMAT, kv.DEFAULT_ATTACH_AS,\
-                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM]
+                kv.DEFAULT_ACCESS, kv.DEFAULT_FILESYSTEM_TYPE, kv.DEFAULT_CLONE_FROM,\
+                kv.DEFAULT_FROM_SNAPSHOT, kv.DEFAULT_MKFS_OPTS, kv.DEFAULT_MOUNT_OPTS,\
+                kv.DEFAULT_VOLUME_MODE, kv.DEFAULT_ENCRYPTION,\
+                kv.DEFAULT_ENCRYPTION_KEY, kv.DEFAULT_IOPS_LIMIT, kv.DEFAULT_BPS_LIMIT, kv.DEFAULT_LABELS]
     invalid = frozenset(opts.keys()).difference(valid_opts)
     if len(invalid) != 0:
         msg = 'Invalid options: {0} \n'.format(list(invalid)) \
@@ -404,7 +454,7 @@ def validate_opts(opts, vmdk_path):
         raise ValidationError(msg)
 
     # For validation of clone (in)compatible options
-    clone = True if kv.CLONE_FROM in opts else False
+    clone = True if kv.CLONE_FROM in opts or kv.FROM_SNAPSHOT in opts else False
 
     if kv.SIZE in opts:
         validate_size(opts[kv.SIZE], clone)
@@ -418,6 +468,20 @@ def validate_opts(opts, vmdk_path):
         validate_access(opts[kv.ACCESS])
     if kv.FILESYSTEM_TYPE in opts:
         validate_fstype(opts[kv.FILESYSTEM_TYPE], clone)
+    if kv.MKFS_OPTS in opts and clone:
+        raise ValidationError("Cannot define {0} for a clone".format(kv.MKFS_OPTS))
+    if kv.VOLUME_MODE in opts:
+        validate_volume_mode(opts[kv.VOLUME_MODE], clone)
+    if kv.ENCRYPTION in opts:
+        validate_encryption(opts[kv.ENCRYPTION], clone)
+    if kv.ENCRYPTION_KEY in opts and kv.ENCRYPTION not in opts:
+        raise ValidationError("Cannot define {0} for an unencrypted volume".format(kv.ENCRYPTION_KEY))
+    if kv.IOPS_LIMIT in opts:
+        validate_iops_limit(opts[kv.IOPS_LIMIT])
+    if kv.BPS_LIMIT in opts:
+        validate_bps_limit(opts[kv.BPS_LIMIT])
+    if kv.LABELS in opts:
+        validate_labels(opts[kv.LABELS])
 
 
 def validate_size(size, clone=False):
@@ -510,6 +574,59 @@ def validate_fstype(fstype, clone=False):
     if clone:
         raise ValidationError("Cannot define the filesystem type for a clone")
 
+def validate_volume_mode(volume_mode, clone=False):
+    """
+    Ensure that we recognize the volume mode, and don't accept it for a clone
+    """
+    if clone:
+        raise ValidationError("Cannot define the volume mode for a clone")
+    if not volume_mode in kv.VOLUME_MODES:
+        raise ValidationError("Volume mode '{0}' is not supported."
+                              " Valid options are: {1}".format(volume_mode,
+                                                               kv.VOLUME_MODES))
+
+def validate_encryption(encryption, clone=False):
+    """
+    Ensure that we recognize the encryption, and don't accept it for a clone
+    """
+    if clone:
+        raise ValidationError("Cannot define the encryption for a clone")
+    if not encryption in kv.VALID_ENCRYPTION:
+        raise ValidationError("Encryption '{0}' is not supported."
+                              " Valid options are: {1}".format(encryption,
+                                                               kv.VALID_ENCRYPTION))
+
+def validate_iops_limit(iops_limit):
+    """
+    Ensure iops-limit is a number of I/O operations per second
+    """
+    if not iops_limit.isdigit():
+        raise ValidationError("Invalid format for {0} '{1}'. Valid limits are"
+                              " numbers of I/O operations per second".format(kv.IOPS_LIMIT, iops_limit))
+
+def validate_bps_limit(bps_limit):
+    """
+    Ensure bps-limit is given as <int>[unit] where unit is 'kb', 'mb' or 'gb', bytes if none
+    """
+    if not re.match(r'^[0-9]+([kKmMgG][bB])?$', bps_limit):
+        raise ValidationError("Invalid format for {0} '{1}'. Valid limits are"
+                              " of form X[kKmMgG]b where X is an integer".format(kv.BPS_LIMIT, bps_limit))
+
+def validate_labels(labels):
+    """
+    Ensure labels are given as comma separated key=value pairs
+    """
+    label = r'[A-Za-z0-9][A-Za-z0-9._/-]*=[A-Za-z0-9._/-]*'
+    if not re.match(r'^{0}(,{0})*$'.format(label), labels):
+        raise ValidationError("Invalid format for {0} '{1}'. Valid labels are comma separated"
+                              " key=value pairs, e.g. app=web,team=infra".format(kv.LABELS, labels))
+
+def parse_labels(labels):
+    """
+    Returns the labels given as comma separated key=value pairs as a dict
+    """
+    return dict(label.split('=', 1) for label in labels.split(','))
+
 # Returns the UUID if the vmdk_path is for a VSAN backed.
 def get_vsan_uuid(vmdk_path):
     f = open(vmdk_path)
@@ -568,6 +685,28 @@ def vol_info(vol_meta, vol_size_info, datastore):
           vinfo[kv.CLONE_FROM] = vol_meta[kv.VOL_OPTS][kv.CLONE_FROM]
        else:
           vinfo[kv.CLONE_FROM] = kv.DEFAULT_CLONE_FROM
+       if kv.SNAPSHOT_OF in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.SNAPSHOT_OF] = vol_meta[kv.VOL_OPTS][kv.SNAPSHOT_OF]
+       if kv.FROM_SNAPSHOT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.FROM_SNAPSHOT] = vol_meta[kv.VOL_OPTS][kv.FROM_SNAPSHOT]
+       if kv.MKFS_OPTS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.MKFS_OPTS] = vol_meta[kv.VOL_OPTS][kv.MKFS_OPTS]
+       if kv.MOUNT_OPTS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.MOUNT_OPTS] = vol_meta[kv.VOL_OPTS][kv.MOUNT_OPTS]
+       if kv.VOLUME_MODE in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.VOLUME_MODE] = vol_meta[kv.VOL_OPTS][kv.VOLUME_MODE]
+       else:
+          vinfo[kv.VOLUME_MODE] = kv.DEFAULT_VOLUME_MODE
+       if kv.ENCRYPTION in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.ENCRYPTION] = vol_meta[kv.VOL_OPTS][kv.ENCRYPTION]
+       if kv.ENCRYPTION_KEY in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.ENCRYPTION_KEY] = vol_meta[kv.VOL_OPTS][kv.ENCRYPTION_KEY]
+       if kv.IOPS_LIMIT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.IOPS_LIMIT] = vol_meta[kv.VOL_OPTS][kv.IOPS_LIMIT]
+       if kv.BPS_LIMIT in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.BPS_LIMIT] = vol_meta[kv.VOL_OPTS][kv.BPS_LIMIT]
+       if kv.LABELS in vol_meta[kv.VOL_OPTS]:
+          vinfo[kv.LABELS] = parse_labels(vol_meta[kv.VOL_OPTS][kv.LABELS])
 
     return vinfo
 
@@ -643,6 +782,286 @@ def removeVMDK(vmdk_path, vol_name=None, vm_name=None, tenant_uuid=None, datasto
     return None
 
 
+def resizeVMDK(vmdk_path, vol_name, opts, bios_uuid, vc_uuid, datastore, tenant_uuid=None, datastore_url=None,
+               vm_datastore_url=None, vm_datastore=None):
+    """
+    Grows the volume to opts[kv.SIZE].
+    A volume attached to the requesting VM is grown by reconfiguring the disk
+    device of the VM, so the guest sees the new size. A detached volume is grown
+    by extending the VMDK file. Volumes attached to other VMs can't be resized.
+    The size added is checked against the usage quota as a new volume would be.
+    Returns None on success or err(msg)
+    """
+    logging.info("*** resizeVMDK: %s opts=%s", vmdk_path, opts)
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path), ERR_NOT_FOUND)
+    if kv.SIZE not in opts:
+        return err("Volume size is required for resize")
+    try:
+        validate_size(opts[kv.SIZE])
+    except ValidationError as ex:
+        return err(ex.msg)
+    capacity_kb = convert.convert_to_KB(opts[kv.SIZE])
+
+    # The volume counts in the usage quota with the size it was created or last resized with
+    vol_meta = kv.getAll(vmdk_path)
+    vol_opts = vol_meta.get(kv.VOL_OPTS, {}) if vol_meta else {}
+    grow_mb = convert.convert_to_MB(opts[kv.SIZE]) - convert.convert_to_MB(vol_opts.get(kv.SIZE,
+                                                                                     kv.DEFAULT_DISK_SIZE))
+    if grow_mb > 0:
+        error_info = authorize_check(vm_uuid=bios_uuid,
+                                     datastore_url=datastore_url,
+                                     datastore=datastore,
+                                     cmd=auth.CMD_CREATE,
+                                     opts={kv.SIZE: "{0}mb".format(grow_mb)},
+                                     use_default_ds=False,
+                                     vm_datastore_url=vm_datastore_url,
+                                     vm_datastore=vm_datastore)
+        if error_info:
+            return err(error_info, auth_error_code(error_info))
+
+    vm = findVmByUuidChoice(bios_uuid, vc_uuid)
+    if not vm:
+        return err("Failed to find VM object for bios %s vc %s" % (bios_uuid, vc_uuid))
+
+    attached, kv_uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    si = get_si()
+    if attached and kv_uuid != vm.config.instanceUuid:
+        return err("Failed to resize volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
+    elif attached:
+        device = findDeviceByPath(vmdk_path, vm)
+        if not device:
+            return err("Failed to find disk for volume {0} on VM {1}".format(vol_name, vm.config.name))
+        if capacity_kb <= device.capacityInKB:
+            return err("Volume {0} can only grow, current size is {1}mb".format(vol_name,
+                                                                              device.capacityInKB // 1024))
+        device.capacityInKB = capacity_kb
+        dev_spec = vim.VirtualDeviceConfigSpec(operation='edit', device=device)
+        spec = vim.vm.ConfigSpec(deviceChange=[dev_spec])
+        task = vm.ReconfigVM_Task(spec=spec)
+    else:
+        task = si.content.virtualDiskManager.ExtendVirtualDisk(name=vmdk_utils.get_datastore_path(vmdk_path),
+                                                               newCapacityKb=capacity_kb,
+                                                               eagerZero=False)
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return err("Failed to resize volume {0}: {1}".format(vol_name, ex.msg))
+
+    vol_meta = kv.getAll(vmdk_path)
+    if vol_meta and kv.VOL_OPTS in vol_meta:
+        vol_meta[kv.VOL_OPTS][kv.SIZE] = opts[kv.SIZE]
+        if not kv.setAll(vmdk_path, vol_meta):
+            logging.warning("Resize: Failed to save Disk metadata for %s", vmdk_path)
+
+    if tenant_uuid:
+        auth.update_volume_size_in_volumes_table(tenant_uuid, datastore_url, vol_name,
+                                                 convert.convert_to_MB(opts[kv.SIZE]))
+    return None
+
+
+def get_snapshot_of(vmdk_path):
+    """Returns the name of the volume vmdk_path is a snapshot of, or None for other volumes"""
+    vol_meta = kv.getAll(vmdk_path)
+    if not vol_meta or kv.VOL_OPTS not in vol_meta:
+        return None
+    return vol_meta[kv.VOL_OPTS].get(kv.SNAPSHOT_OF)
+
+
+def get_snapshot_path(vol_name, opts, path, datastore, check=True):
+    """
+    Returns (snapshot name, snapshot vmdk path, error) for the snapshot opts[SNAPSHOT]
+    of volume vol_name. Snapshots are kept next to the volume.
+    With check, verifies the snapshot exists and was taken of the volume.
+    """
+    if not opts.get(SNAPSHOT):
+        return None, None, err("Snapshot name is required")
+    try:
+        snap_name, snap_datastore = parse_vol_name(opts[SNAPSHOT])
+    except ValidationError as ex:
+        return None, None, err(str(ex))
+    if snap_datastore and snap_datastore != datastore:
+        return None, None, err("Snapshot {0} must be on datastore {1} of volume {2}".format(snap_name,
+                                                                                          datastore,
+                                                                                          vol_name))
+    snap_vmdk_path = vmdk_utils.get_vmdk_path(path, snap_name)
+    if check:
+        if not os.path.isfile(snap_vmdk_path):
+            return None, None, err("Snapshot {0} not found (file: {1})".format(snap_name, snap_vmdk_path),
+                                   ERR_NOT_FOUND)
+        if get_snapshot_of(snap_vmdk_path) != vol_name:
+            return None, None, err("Volume {0} is not a snapshot of {1}".format(snap_name, vol_name))
+    return snap_name, snap_vmdk_path, None
+
+
+def copy_vmdk(src_vmdk_path, dest_vmdk_path, disk_format):
+    """Copies the disk with its metadata. Returns None on success or VimFault message"""
+    vdisk_spec = vim.VirtualDiskManager.VirtualDiskSpec()
+    vdisk_spec.adapterType = VMDK_ADAPTER_TYPE
+    vdisk_spec.diskType = disk_format
+    si = get_si()
+    task = si.content.virtualDiskManager.CopyVirtualDisk(
+        sourceName=vmdk_utils.get_datastore_path(src_vmdk_path),
+        destName=vmdk_utils.get_datastore_path(dest_vmdk_path),
+        destSpec=vdisk_spec)
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return ex.msg
+    return None
+
+
+def snapshotVMDK(vmdk_path, vol_name, opts, path, vm_name, vm_uuid, datastore, datastore_url,
+                 tenant_uuid=None, vm_datastore_url=None, vm_datastore=None):
+    """
+    Creates snapshot opts[SNAPSHOT] of the volume, a read-only point-in-time copy
+    kept next to the volume. The snapshot is a volume by itself, with snapshot-of
+    in its options pointing to the volume it was taken of.
+    A snapshot of an attached volume is crash consistent.
+    The caller holds the locks of both the volume and the snapshot.
+    Returns None on success or err(msg)
+    """
+    logging.info("*** snapshotVMDK: %s opts=%s", vmdk_path, opts)
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path), ERR_NOT_FOUND)
+    snap_name, snap_vmdk_path, error_info = get_snapshot_path(vol_name, opts, path, datastore, check=False)
+    if error_info:
+        return error_info
+
+    if os.path.isfile(snap_vmdk_path):
+        return err("Volume {0} already exists".format(snap_name), ERR_ALREADY_EXISTS)
+
+    attached, kv_uuid, _, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached:
+        log_attached_volume(vmdk_path, kv_uuid, attached_vm_name)
+
+    # A snapshot takes space as a volume of the same size does
+    src_size = kv.get_vol_info(vmdk_path)[SIZE]
+    error_info = authorize_check(vm_uuid=vm_uuid,
+                                 datastore_url=datastore_url,
+                                 datastore=datastore,
+                                 cmd=auth.CMD_CREATE,
+                                 opts={kv.SIZE: src_size},
+                                 use_default_ds=False,
+                                 vm_datastore_url=vm_datastore_url,
+                                 vm_datastore=vm_datastore)
+    if error_info:
+        return err(error_info, auth_error_code(error_info))
+
+    copy_err = copy_vmdk(vmdk_path, snap_vmdk_path, kv.VALID_ALLOCATION_FORMATS[kv.DEFAULT_ALLOCATION_FORMAT])
+    if copy_err:
+        return err("Failed to snapshot volume {0}: {1}".format(vol_name, copy_err))
+
+    vol_meta = kv.getAll(snap_vmdk_path)
+    if not vol_meta:
+        vol_meta = {}
+    snap_opts = dict(vol_meta.get(kv.VOL_OPTS, {}))
+    snap_opts.pop(kv.CLONE_FROM, None)
+    snap_opts.pop(kv.FROM_SNAPSHOT, None)
+    snap_opts[kv.SNAPSHOT_OF] = vol_name
+    snap_opts[kv.ACCESS] = kv.ACCESS_READONLY
+    snap_opts[kv.DISK_ALLOCATION_FORMAT] = kv.DEFAULT_ALLOCATION_FORMAT
+    snap_opts[kv.SIZE] = src_size
+    vol_meta = {kv.STATUS: kv.DETACHED,
+                kv.VOL_OPTS: snap_opts,
+                kv.CREATED: time.asctime(time.gmtime()),
+                kv.CREATED_BY: vm_name}
+    if not kv.setAll(snap_vmdk_path, vol_meta):
+        msg = "Failed to create metadata kv store for {0}".format(snap_vmdk_path)
+        logging.warning(msg)
+        cleanVMDK(snap_vmdk_path, snap_name)
+        return err(msg)
+
+    if tenant_uuid:
+        auth.add_volume_to_volumes_table(tenant_uuid, datastore_url, snap_name, convert.convert_to_MB(src_size))
+    return None
+
+
+def listSnapshotsVMDK(vmdk_path, vol_name, path, datastore):
+    """Returns the list of snapshots of the volume, in the format of listVMDK()"""
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path), ERR_NOT_FOUND)
+    snapshots = []
+    for file_name in vmdk_utils.list_vmdks(path):
+        snap_vmdk_path = os.path.join(path, file_name)
+        if get_snapshot_of(snap_vmdk_path) == vol_name:
+            vol_meta = kv.getAll(snap_vmdk_path)
+            snapshots.append({u'Name': get_full_vol_name(file_name, datastore),
+                              u'Attributes': {kv.CREATED: vol_meta.get(kv.CREATED, "")}})
+    return snapshots
+
+
+def removeSnapshotVMDK(vol_name, opts, path, datastore, vm_name, tenant_uuid=None, datastore_url=None):
+    """Removes a snapshot of the volume. Returns None on success or err(msg)"""
+    logging.info("*** removeSnapshotVMDK: %s opts=%s", vol_name, opts)
+    snap_name, snap_vmdk_path, error_info = get_snapshot_path(vol_name, opts, path, datastore)
+    if error_info:
+        return error_info
+    return removeVMDK(vmdk_path=snap_vmdk_path,
+                      vol_name=snap_name,
+                      vm_name=vm_name,
+                      tenant_uuid=tenant_uuid,
+                      datastore_url=datastore_url)
+
+
+def revertVMDK(vmdk_path, vol_name, opts, path, datastore, tenant_uuid=None, datastore_url=None):
+    """
+    Replaces the content of the volume with the content of snapshot opts[SNAPSHOT].
+    The snapshot is copied next to the volume first, so the volume is intact if the copy fails.
+    The volume keeps its own metadata, except for the size.
+    Returns None on success or err(msg)
+    """
+    logging.info("*** revertVMDK: %s opts=%s", vmdk_path, opts)
+    if not os.path.isfile(vmdk_path):
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path), ERR_NOT_FOUND)
+    snap_name, snap_vmdk_path, error_info = get_snapshot_path(vol_name, opts, path, datastore)
+    if error_info:
+        return error_info
+
+    attached, _, _, attached_vm_name = getStatusAttached(vmdk_path)
+    if attached:
+        return err("Failed to revert volume {0}, in use by VM = {1}.".format(vol_name, attached_vm_name))
+
+    vol_meta = kv.getAll(vmdk_path)
+    disk_format = kv.DEFAULT_ALLOCATION_FORMAT
+    if vol_meta and kv.DISK_ALLOCATION_FORMAT in vol_meta.get(kv.VOL_OPTS, {}):
+        disk_format = vol_meta[kv.VOL_OPTS][kv.DISK_ALLOCATION_FORMAT]
+
+    tmp_vmdk_path = vmdk_utils.get_vmdk_path(path, vol_name + REVERT_SUFFIX)
+    copy_err = copy_vmdk(snap_vmdk_path, tmp_vmdk_path, kv.VALID_ALLOCATION_FORMATS[disk_format])
+    if copy_err:
+        cleanVMDK(tmp_vmdk_path)
+        return err("Failed to revert volume {0}: {1}".format(vol_name, copy_err))
+
+    clean_err = cleanVMDK(vmdk_path, vol_name)
+    if clean_err:
+        cleanVMDK(tmp_vmdk_path)
+        return clean_err
+    si = get_si()
+    task = si.content.virtualDiskManager.MoveVirtualDisk(sourceName=vmdk_utils.get_datastore_path(tmp_vmdk_path),
+                                                         destName=vmdk_utils.get_datastore_path(vmdk_path),
+                                                         force=False)
+    try:
+        wait_for_tasks(si, [task])
+    except vim.fault.VimFault as ex:
+        return err("Failed to revert volume {0}, its content is left in {1}: {2}".format(vol_name,
+                                                                                      tmp_vmdk_path,
+                                                                                      ex.msg))
+
+    snap_size = kv.get_vol_info(vmdk_path)[SIZE]
+    if vol_meta:
+        vol_meta[kv.STATUS] = kv.DETACHED
+        if kv.VOL_OPTS in vol_meta:
+            vol_meta[kv.VOL_OPTS][kv.SIZE] = snap_size
+        if not kv.setAll(vmdk_path, vol_meta):
+            logging.warning("Revert: Failed to save Disk metadata for %s", vmdk_path)
+
+    if tenant_uuid:
+        auth.update_volume_size_in_volumes_table(tenant_uuid, datastore_url, vol_name,
+                                                 convert.convert_to_MB(snap_size))
+    return None
+
+
 def getVMDK(vmdk_path, vol_name, datastore):
     """Checks if the volume exists, and returns error if it does not"""
     # Note: will return more Volume info here, when Docker API actually accepts it
@@ -650,7 +1069,7 @@ def getVMDK(vmdk_path, vol_name, datastore):
     file_exist = os.path.isfile(vmdk_path)
     logging.debug("getVMDK: file_exist=%d", file_exist)
     if not os.path.isfile(vmdk_path):
-        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path))
+        return err("Volume {0} not found (file: {1})".format(vol_name, vmdk_path), ERR_NOT_FOUND)
     # Return volume info - volume policy, size, allocated capacity, allocation
     # type, creat-by, create time.
     try:
@@ -667,15 +1086,68 @@ def listVMDK(tenant):
     """
     Returns a list of volume names (note: may be an empty list).
     Each volume name is returned as either `volume@datastore`, or just `volume`
-    for volumes on vm_datastore
+    for volumes on vm_datastore, with the labels of the volume in its attributes
     """
     vmdk_utils.init_datastoreCache(force=True)
     vmdks = vmdk_utils.get_volumes(tenant)
     # build  fully qualified vol name for each volume found
     return [{u'Name': get_full_vol_name(x['filename'], x['datastore']),
-             u'Attributes': {}} \
+             u'Attributes': list_attributes(os.path.join(x['path'], x['filename']))} \
             for x in vmdks]
 
+def listDatastores(vm_uuid, vm_datastore_url, vm_datastore):
+    """
+    Returns a list of datastores the VM is allowed to create volumes on,
+    with their capacity and free space in bytes (note: may be an empty list).
+    """
+    space = vmdk_utils.get_datastores_space()
+    datastores = []
+    for (name, url, _) in vmdk_utils.get_datastores():
+        if name not in space:
+            continue
+        error_info = authorize_check(vm_uuid=vm_uuid,
+                                     datastore_url=url,
+                                     datastore=name,
+                                     cmd="create",
+                                     opts={},
+                                     use_default_ds=False,
+                                     vm_datastore_url=vm_datastore_url,
+                                     vm_datastore=vm_datastore)
+        if error_info:
+            logging.debug("listDatastores: skipping %s: %s", name, error_info)
+            continue
+        capacity, free = space[name]
+        datastores.append({u'Name': name, u'Capacity': capacity, u'Free': free})
+    return datastores
+
+def listAttached(vm_uuid, vc_uuid):
+    """
+    Returns a list of volumes attached to the requesting VM, named volume@datastore
+    (note: may be an empty list).
+    """
+    vm = findVmByUuidChoice(vm_uuid, vc_uuid)
+    if not vm:
+        return err("Failed to find VM {0}".format(vm_uuid))
+    attached = []
+    for d in vm.config.hardware.device:
+        # a disk on the delta disk of a VM snapshot is listed as the volume it is based on
+        vmdk_path = vmdk_utils.find_dvs_volume(d, base=True)
+        if not vmdk_path:
+            continue
+        vol_name = vmdk_utils.get_volname_from_vmdk_path(vmdk_path)
+        datastore = vmdk_utils.get_datastore_from_vmdk_path(vmdk_path)
+        attached.append({u'Name': "{0}@{1}".format(vol_name, datastore)})
+    return attached
+
+def list_attributes(vmdk_path):
+    """
+    Returns the attributes of a volume returned on list, its labels if it has any
+    """
+    vol_opts = kv.get_kv(vmdk_path, kv.VOL_OPTS)
+    if vol_opts and kv.LABELS in vol_opts:
+        return {kv.LABELS: vol_opts[kv.LABELS]}
+    return {}
+
 
 
 def findVmByUuid(vm_uuid, is_vc_uuid=False):
@@ -1012,6 +1484,14 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
             # if default_datastore is not set, should return error
             return listVMDK(tenant_name)
 
+        if cmd == "listDatastores":
+            threadutils.set_thread_name("{0}-nolock-{1}".format(vm_name, cmd))
+            return listDatastores(vm_uuid, vm_datastore_url, vm_datastore)
+
+        if cmd == "listAttached":
+            threadutils.set_thread_name("{0}-nolock-{1}".format(vm_name, cmd))
+            return listAttached(vm_uuid, vc_uuid)
+
         try:
             vol_name, datastore = parse_vol_name(full_vol_name)
         except ValidationError as ex:
@@ -1021,7 +1501,8 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
             return err("Invalid datastore '%s'.\n" \
                     "Known datastores: %s.\n" \
                     "Default datastore: %s" \
-                    % (datastore, ", ".join(get_datastore_names_list()), default_datastore))
+                    % (datastore, ", ".join(get_datastore_names_list()), default_datastore),
+                       ERR_DATASTORE_UNAVAILABLE)
 
         if not datastore:
             datastore_url = default_datastore_url
@@ -1044,7 +1525,7 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
                                  vm_datastore_url=vm_datastore_url,
                                  vm_datastore=vm_datastore)
     if error_info:
-        return err(error_info)
+        return err(error_info, auth_error_code(error_info))
 
     # get_vol_path() need to pass in a real datastore name
     if datastore == auth_data_const.VM_DS:
@@ -1068,10 +1549,18 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
     # Set thread name to vm_name-lockname
     threadutils.set_thread_name("{0}-{1}".format(vm_name, lockname))
 
+    locknames = [lockname]
+    if cmd == "snapshot":
+        # A snapshot also holds the lock a create of a volume with its name would
+        snap_name, _, error_info = get_snapshot_path(vol_name, opts, path, datastore, check=False)
+        if error_info:
+            return error_info
+        locknames.append("{}.{}.{}".format(vm_datastore, tenant_name, snap_name))
+
     # Get a lock for the volume
-    logging.debug("Trying to acquire lock: %s", lockname)
-    with lockManager.get_lock(lockname):
-        logging.debug("Acquired lock: %s", lockname)
+    logging.debug("Trying to acquire locks: %s", locknames)
+    with lockManager.get_locks(locknames):
+        logging.debug("Acquired locks: %s", locknames)
 
         if cmd == "get":
             response = getVMDK(vmdk_path, vol_name, datastore)
@@ -1101,10 +1590,34 @@ def executeRequest(vm_uuid, vm_name, config_path, cmd, full_vol_name, opts, vc_u
             with lockManager.get_lock(vm_uuid):
                 response = detachVMDK(vmdk_path=vmdk_path, vm_name=vm_name,
                                       bios_uuid=vm_uuid, vc_uuid=vc_uuid)
+        elif cmd == "resize":
+            # may reconfigure the VM, so hold the VM lock as attach/detach do
+            with lockManager.get_lock(vm_uuid):
+                response = resizeVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts,
+                                      bios_uuid=vm_uuid, vc_uuid=vc_uuid, datastore=datastore,
+                                      tenant_uuid=tenant_uuid, datastore_url=datastore_url,
+                                      vm_datastore_url=vm_datastore_url, vm_datastore=vm_datastore)
+        elif cmd == "snapshot":
+            response = snapshotVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts, path=path,
+                                    vm_name=vm_name, vm_uuid=vm_uuid,
+                                    datastore=datastore, datastore_url=datastore_url,
+                                    tenant_uuid=tenant_uuid,
+                                    vm_datastore_url=vm_datastore_url, vm_datastore=vm_datastore)
+        elif cmd == "listSnapshots":
+            response = listSnapshotsVMDK(vmdk_path=vmdk_path, vol_name=vol_name, path=path,
+                                         datastore=datastore)
+        elif cmd == "removeSnapshot":
+            response = removeSnapshotVMDK(vol_name=vol_name, opts=opts, path=path, datastore=datastore,
+                                          vm_name=vm_name, tenant_uuid=tenant_uuid,
+                                          datastore_url=datastore_url)
+        elif cmd == "revertSnapshot":
+            response = revertVMDK(vmdk_path=vmdk_path, vol_name=vol_name, opts=opts, path=path,
+                                  datastore=datastore, tenant_uuid=tenant_uuid,
+                                  datastore_url=datastore_url)
         else:
             return err("Unknown command:" + cmd)
 
-    logging.debug("Released lock: %s", lockname)
+    logging.debug("Released locks: %s", locknames)
     return response
 
 def connectLocalSi():
@@ -1517,10 +2030,49 @@ def disk_attach(vmdk_path, vm):
     return vm_dev_info
 
 
-def err(string):
+# Error codes sent with some error replies, so the client can tell the kind of
+# error without parsing the message. Keep in sync with client_plugin/drivers/vmdk/vmdkops/errors.go
+ERR_NOT_FOUND = "NotFound"
+ERR_ALREADY_EXISTS = "AlreadyExists"
+ERR_ACCESS_DENIED = "AccessDenied"
+ERR_QUOTA_EXCEEDED = "QuotaExceeded"
+ERR_DATASTORE_UNAVAILABLE = "DatastoreUnavailable"
+ERR_VERSION_MISMATCH = "VersionMismatch"
+
+def err(string, code=None):
+    if code:
+        return {u'Error': string, u'ErrorCode': code}
     return {u'Error': string}
 
 
+def handshake(opts):
+    """
+    Picks the highest protocol version supported by both client and server.
+    opts["versions"] is a comma separated list of versions supported by the client.
+    Returns the version to use and server capabilities, or err(msg) if there is no common version
+    """
+    client_versions = [int(v) for v in opts.get("versions", "").split(",") if v.strip().isdigit()]
+    common_versions = set(client_versions) & set(SUPPORTED_PROTOCOL_VERSIONS)
+    if not common_versions:
+        return err("No common protocol version between vDVS client (Docker plugin) supporting {0} "
+                   "and server (ESXi) supporting {1}, please make sure vDVS plugin and driver "
+                   "are from compatible releases.".format(client_versions, SUPPORTED_PROTOCOL_VERSIONS),
+                   ERR_VERSION_MISMATCH)
+    return {u'Version': str(max(common_versions)),
+            u'Versions': [str(v) for v in SUPPORTED_PROTOCOL_VERSIONS],
+            u'Capabilities': SERVER_CAPABILITIES}
+
+
+def auth_error_code(error_info):
+    """Returns error code for error_info returned by authorize_check()"""
+    if error_info in (error_code_to_message[ErrorCode.PRIVILEGE_MAX_VOL_EXCEED],
+                      error_code_to_message[ErrorCode.PRIVILEGE_USAGE_QUOTA_EXCEED]):
+        return ERR_QUOTA_EXCEEDED
+    if error_info == error_code_to_message[ErrorCode.OPT_VOLUME_SIZE_INVALID]:
+        return None
+    return ERR_ACCESS_DENIED
+
+
 def disk_detach(vmdk_path, vm):
     """detach disk (by full path) from a vm and return None or err(msg)"""
 
@@ -1615,10 +2167,13 @@ def set_vol_opts(name, tenant_name, options):
        logging.warning(msg)
        return False
 
-    # For now only allow resetting the access and attach-as options.
+    # For now only allow resetting the access and attach-as options, and the I/O limits.
+    # I/O limits are validated by their own function, as they take any number.
     valid_opts = {
         kv.ACCESS : kv.ACCESS_TYPES,
-        kv.ATTACH_AS : kv.ATTACH_AS_TYPES
+        kv.ATTACH_AS : kv.ATTACH_AS_TYPES,
+        kv.IOPS_LIMIT : validate_iops_limit,
+        kv.BPS_LIMIT : validate_bps_limit
     }
 
     invalid = frozenset(opts.keys()).difference(valid_opts.keys())
@@ -1631,7 +2186,13 @@ def set_vol_opts(name, tenant_name, options):
     has_invalid_opt_value = False
     for key in opts.keys():
         if key in valid_opts:
-            if not opts[key] in valid_opts[key]:
+            if callable(valid_opts[key]):
+                try:
+                    valid_opts[key](opts[key])
+                except ValidationError as ex:
+                    logging.warning(str(ex))
+                    has_invalid_opt_value = True
+            elif not opts[key] in valid_opts[key]:
                 msg = 'Invalid option value {0}.\n'.format(opts[key]) +\
                     'Supported values are {0}.\n'.format(valid_opts[key])
                 logging.warning(msg)
@@ -1705,16 +2266,26 @@ def execRequestThread(client_socket, cartel, request):
             send_vmci_reply(client_socket, reply_string)
         else:
             logging.debug("execRequestThread: req=%s", req)
+            # Handshake is how the client learns which versions we support,
+            # so it is served whatever version the client sent.
+            if req["cmd"] == "handshake":
+                opts = req["details"]["Opts"] if "Opts" in req["details"] else {}
+                reply_string = handshake(opts)
+                logging.info("handshake completed with ret=%s", reply_string)
+                send_vmci_reply(client_socket, reply_string)
+                return
+
             # If req from client does not include version number, set the version to
             # SERVER_PROTOCOL_VERSION by default to make backward compatible
             client_protocol_version = int(req["version"]) if "version" in req else SERVER_PROTOCOL_VERSION
             logging.debug("execRequestThread: client protocol version=%d", client_protocol_version)
-            if client_protocol_version != SERVER_PROTOCOL_VERSION:
+            if client_protocol_version not in SUPPORTED_PROTOCOL_VERSIONS:
                 reply_string = err("""There is a mismatch between vDVS client (Docker plugin) protocol version
                                     ({}) and server (ESXi) protocol version ({}) which indicates different
                                     versions of the product are installed on Guest and ESXi sides,
                                     please make sure vDVS plugin and driver are from the same release version.
-                                    """.format(client_protocol_version, SERVER_PROTOCOL_VERSION))
+                                    """.format(client_protocol_version, SERVER_PROTOCOL_VERSION),
+                                   ERR_VERSION_MISMATCH)
                 send_vmci_reply(client_socket, reply_string)
                 logging.warning("executeRequest '%s' failed: %s", req["cmd"], reply_string)
                 return
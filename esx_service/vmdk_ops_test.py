@@ -162,6 +162,17 @@ class VmdkCreateRemoveTestCase(unittest.TestCase):
             os.path.isfile(self.name), False,
             "VMDK {0} is still present after delete.".format(self.name))
 
+    def testCreateExisting(self):
+        err = vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                  vmdk_path=self.name,
+                                  vol_name=self.volName)
+        self.assertEqual(err, None, err)
+        err = vmdk_ops.createVMDK(vm_name=self.vm_name,
+                                  vmdk_path=self.name,
+                                  vol_name=self.volName)
+        self.assertNotEqual(err, None, "Create of an existing volume should fail")
+        self.assertEqual(err[u'ErrorCode'], vmdk_ops.ERR_ALREADY_EXISTS, err)
+
     def testBadOpts(self):
         err = vmdk_ops.createVMDK(vm_name=self.vm_name,
                                   vmdk_path=self.name,
@@ -390,7 +401,14 @@ class ValidationTestCase(unittest.TestCase):
     def test_failure(self):
         bad = [{volume_kv.SIZE: '2'}, {volume_kv.VSAN_POLICY_NAME: 'bad-policy'},
         {volume_kv.DISK_ALLOCATION_FORMAT: 'thiN'}, {volume_kv.SIZE: 'mb'}, {'bad-option': '4'}, {'bad-option': 'what',
-                                                             volume_kv.SIZE: '4mb'}]
+                                                             volume_kv.SIZE: '4mb'},
+        {volume_kv.VOLUME_MODE: 'raw'},
+        {volume_kv.VOLUME_MODE: volume_kv.VOLUME_MODE_BLOCK, volume_kv.CLONE_FROM: 'vol'},
+        {volume_kv.ENCRYPTION: 'aes'},
+        {volume_kv.ENCRYPTION: volume_kv.ENCRYPTION_LUKS, volume_kv.CLONE_FROM: 'vol'},
+        {volume_kv.ENCRYPTION_KEY: 'vol'},
+        {volume_kv.IOPS_LIMIT: 'fast'}, {volume_kv.BPS_LIMIT: '10tb'},
+        {volume_kv.LABELS: 'app'}, {volume_kv.LABELS: 'app=web,'}, {volume_kv.LABELS: '=web'}]
         for opts in bad:
             with self.assertRaises(vmdk_ops.ValidationError):
                 vmdk_ops.validate_opts(opts, self.path)
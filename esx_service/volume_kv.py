@@ -88,10 +88,55 @@ ACCESS_TYPES = [ACCESS_READWRITE, ACCESS_READONLY]
 FILESYSTEM_TYPE = 'fstype'
 DEFAULT_FILESYSTEM_TYPE = 'ext4'
 
+# Filesystem options
+# These options are validated and applied by the volume-plugin at the docker host,
+# and tracked in volume metadata so every mount applies the same mount options.
+MKFS_OPTS = 'mkfs-opts'
+DEFAULT_MKFS_OPTS = 'None'
+MOUNT_OPTS = 'mount-opts'
+DEFAULT_MOUNT_OPTS = 'None'
+
+# Volume mode
+# A block-mode volume has no filesystem, the volume-plugin exposes the attached disk as a device.
+VOLUME_MODE = 'volume-mode'
+VOLUME_MODE_FILESYSTEM = 'filesystem'
+VOLUME_MODE_BLOCK = 'block'
+DEFAULT_VOLUME_MODE = VOLUME_MODE_FILESYSTEM
+VOLUME_MODES = [VOLUME_MODE_FILESYSTEM, VOLUME_MODE_BLOCK]
+
+# Encryption
+# The volume-plugin encrypts the disk in the guest, keys never reach ESX.
+ENCRYPTION = 'encryption'
+ENCRYPTION_LUKS = 'luks'
+DEFAULT_ENCRYPTION = 'None'
+VALID_ENCRYPTION = [ENCRYPTION_LUKS]
+# Name the volume-plugin looks the key up by, set by it on create and kept by clones
+ENCRYPTION_KEY = 'encryption-key'
+DEFAULT_ENCRYPTION_KEY = 'None'
+
+# I/O limits
+# Applied by the volume-plugin on mount, iops-limit in operations and bps-limit
+# in bytes per second, e.g. 20mb.
+IOPS_LIMIT = 'iops-limit'
+DEFAULT_IOPS_LIMIT = 'None'
+BPS_LIMIT = 'bps-limit'
+DEFAULT_BPS_LIMIT = 'None'
+
+# Labels
+# Comma separated key=value pairs, e.g. app=web,team=infra, for tools to find
+# the volumes of an app or team.
+LABELS = 'labels'
+DEFAULT_LABELS = 'None'
+
 # Clone references
 CLONE_FROM = 'clone-from' # clone volume parent
 DEFAULT_CLONE_FROM = 'None'
 
+# Snapshot references
+SNAPSHOT_OF = 'snapshot-of' # volume the snapshot was taken of
+FROM_SNAPSHOT = 'from-snapshot' # snapshot the volume was created from
+DEFAULT_FROM_SNAPSHOT = 'None'
+
 # Create a kv store object for this volume identified by vol_path
 # Create the side car or open if it exists.
 def init():
@@ -167,6 +167,7 @@ function setupVMType {
 
 function installManagedPlugin {
     log "installManagedPlugin: Installing vDVS plugin [$MANAGED_PLUGIN_NAME]"
+    $SSH $TARGET "mkdir -p /var/lib/docker-volume-vsphere"
     $SSH $TARGET "docker plugin install --grant-all-permissions --alias vsphere $MANAGED_PLUGIN_NAME"
 }
 